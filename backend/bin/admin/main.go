@@ -0,0 +1,188 @@
+// Command admin runs operator tasks against the same MongoDB and Redis as the API.
+//
+// Usage:
+//
+//	admin cache-check [-repair]
+//	admin dlq-replay [-topic payments.events.dlq] [-limit 0] [-idle 10s]
+//	admin orders-rebuild [-id 66a0...]
+//	admin rollups-rebuild
+//
+// cache-check compares the cached users, products and orders with MongoDB and
+// prints a JSON summary of the drift. With -repair drifted entries are evicted
+// or rewritten. It exits with status 2 when drift was found and not repaired.
+//
+// dlq-replay republishes dead-lettered events to the topic they failed on, up
+// to -limit events (0 for all), and stops once the dead-letter topic has been
+// idle for -idle. It prints a JSON summary of what was replayed.
+//
+// orders-rebuild rewrites the orders collection from the order events, first
+// recording a baseline event for orders written before the event log existed.
+// With -id only that order is rebuilt. It prints a JSON summary.
+//
+// rollups-rebuild recomputes the statistics rollups from the users, products
+// and orders collections right away, as the API does periodically. It prints
+// a JSON summary.
+package main
+
+import (
+	"backend/config"
+	"backend/events"
+	"backend/services"
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	utils.InitLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "cache-check":
+		os.Exit(cacheCheck(ctx, os.Args[2:]))
+	case "dlq-replay":
+		os.Exit(dlqReplay(ctx, os.Args[2:]))
+	case "orders-rebuild":
+		os.Exit(ordersRebuild(ctx, os.Args[2:]))
+	case "rollups-rebuild":
+		os.Exit(rollupsRebuild(ctx))
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin cache-check [-repair]")
+	fmt.Fprintln(os.Stderr, "       admin dlq-replay [-topic name] [-limit n] [-idle duration]")
+	fmt.Fprintln(os.Stderr, "       admin orders-rebuild [-id order-id]")
+	fmt.Fprintln(os.Stderr, "       admin rollups-rebuild")
+	os.Exit(1)
+}
+
+func cacheCheck(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("cache-check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "evict or rewrite drifted entries")
+	flags.Parse(args)
+
+	utils.InitRedis()
+	utils.InitMongoDB()
+	if !utils.RedisAvailable() {
+		utils.Fatal("Redis unavailable, nothing to check")
+	}
+	// Repairs must reach the in-process caches of the running API instances
+	services.StartCacheInvalidation(ctx)
+
+	registry := services.NewRegistry()
+	checker := services.NewCacheChecker(registry.Users, registry.Products, registry.Orders)
+	summary, err := checker.Check(ctx, *repair)
+	if err != nil {
+		utils.Fatal("cache check failed", "error", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(summary)
+
+	if summary.Drifted > summary.Repaired {
+		return 2
+	}
+	return 0
+}
+
+func dlqReplay(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("dlq-replay", flag.ExitOnError)
+	topic := flags.String("topic", config.KafkaTopicPayments+config.ConsumerDLQSuffix, "dead-letter topic to replay")
+	limit := flags.Int("limit", 0, "maximum number of events to replay, 0 for all")
+	idle := flags.Duration("idle", 10*time.Second, "stop after no event arrived for this long")
+	flags.Parse(args)
+
+	if config.KafkaBrokers == "" {
+		utils.Fatal("KAFKA_BROKERS is not set")
+	}
+
+	result, err := events.ReplayDLQ(ctx, strings.Split(config.KafkaBrokers, ","), *topic, config.DLQReplayGroup, *limit, *idle)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+
+	if err != nil {
+		utils.Fatal("DLQ replay failed", "error", err)
+	}
+	return 0
+}
+
+func ordersRebuild(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("orders-rebuild", flag.ExitOnError)
+	id := flags.String("id", "", "rebuild only this order")
+	flags.Parse(args)
+
+	var orderID primitive.ObjectID
+	if *id != "" {
+		var err error
+		if orderID, err = primitive.ObjectIDFromHex(*id); err != nil {
+			utils.Fatal("invalid order ID", "id", *id, "error", err)
+		}
+	}
+
+	utils.InitRedis()
+	utils.InitMongoDB()
+	// Rebuilt orders must be evicted from the in-process caches of the running API instances
+	services.StartCacheInvalidation(ctx)
+
+	orders := services.NewOrderService(utils.MongoDB.Collection("orders"))
+	if err := orders.EnsureIndexes(ctx); err != nil {
+		utils.Fatal("failed to create order event indexes", "error", err)
+	}
+
+	var result any
+	var err error
+	if orderID.IsZero() {
+		result, err = orders.RebuildProjections(ctx)
+	} else {
+		var exists bool
+		exists, err = orders.RebuildProjection(ctx, orderID)
+		result = map[string]any{"id": orderID.Hex(), "exists": exists}
+	}
+	if err != nil {
+		utils.Fatal("order rebuild failed", "error", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+	return 0
+}
+
+func rollupsRebuild(ctx context.Context) int {
+	utils.InitRedis()
+	utils.InitMongoDB()
+	// Snapshotted orders must be evicted from the in-process caches of the running API instances
+	services.StartCacheInvalidation(ctx)
+
+	orders := services.NewOrderService(utils.MongoDB.Collection("orders"))
+	result, err := services.RebuildRollups(ctx, orders)
+	if err != nil {
+		utils.Fatal("rollup rebuild failed", "error", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+	return 0
+}
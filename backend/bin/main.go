@@ -1,8 +1,19 @@
 package main
 
 import (
+	"backend/config"
+	"backend/events"
+	"backend/middleware"
 	"backend/routes"
+	"backend/services"
 	"backend/utils"
+	"backend/webhooks"
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -10,23 +21,114 @@ import (
 
 func main() {
 
+	utils.InitLogger()
+
+	// Initialize tracing before the clients so they pick up the global provider
+	shutdownTracing := utils.InitTracing()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			utils.Logger.Error("Error shutting down tracing", "error", err)
+		}
+	}()
+
 	// Initialize Redis and MongoDB
 	utils.InitRedis()
 	utils.InitMongoDB()
 
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	defer stopMonitor()
+	utils.StartHealthMonitor(monitorCtx)
+	services.StartCacheInvalidation(monitorCtx)
+	// Services are created once and shared, so each cache exists once per process
+	registry := services.NewRegistry()
+	if err := registry.Orders.EnsureIndexes(monitorCtx); err != nil {
+		utils.Logger.Warn("failed to create order event indexes", "error", err)
+	}
+	services.StartRollupReconciliation(monitorCtx, registry.Orders)
+	registry.Anomalies.Start(monitorCtx)
+
+	// Live streams never finish on their own, so they are ended before shutting down
+	streamCtx, stopStreams := context.WithCancel(context.Background())
+	defer stopStreams()
+	services.StartChangeStream(streamCtx)
+
+	if bus := newEventBus(); bus != nil {
+		defer func() {
+			// Stop the relay and consumers before closing their bus
+			stopMonitor()
+			if err := bus.Close(); err != nil {
+				utils.Logger.Error("Error flushing events", "error", err)
+			}
+		}()
+
+		// Events are recorded in the outbox with each write and relayed from there
+		events.NewRelay(
+			events.NewOutbox(utils.MongoDB.Collection(config.OutboxCollection)),
+			utils.MongoDB.Collection("leases"),
+			bus,
+			events.RelayOptions{
+				BatchSize:      int64(config.OutboxBatchSize),
+				PollInterval:   config.OutboxPollInterval,
+				MaxAttempts:    config.OutboxMaxAttempts,
+				InitialBackoff: config.OutboxInitialBackoff,
+				MaxBackoff:     config.OutboxMaxBackoff,
+				Retention:      config.OutboxRetention,
+				LeaseTTL:       config.OutboxLeaseTTL,
+			},
+		).Start(monitorCtx)
+
+		startConsumers(monitorCtx, bus, registry)
+	}
+
+	// Deliveries queued before a restart are sent even when the bus is off
+	webhooks.NewDispatcher(
+		utils.MongoDB.Collection(config.WebhookSubscriptionsCollection),
+		utils.MongoDB.Collection(config.WebhookDeliveriesCollection),
+		webhooks.Options{
+			Workers:        config.WebhookWorkers,
+			PollInterval:   config.WebhookPollInterval,
+			Timeout:        config.WebhookTimeout,
+			MaxAttempts:    config.WebhookMaxAttempts,
+			InitialBackoff: config.WebhookInitialBackoff,
+			MaxBackoff:     config.WebhookMaxBackoff,
+			LockTTL:        config.WebhookLockTTL,
+		},
+	).Start(monitorCtx)
+
+	if config.CacheWarmUpOnStartup {
+		go warmUpCaches(monitorCtx, registry)
+	}
+
 	// Initialize Fiber application
 	app := fiber.New()
 
 	// Set up routes
-app.Use(cors.New(cors.Config{
-	AllowOrigins: "http://localhost:3000",
-	AllowMethods: "GET,POST,HEAD,PUT,DELETE,PATCH,OPTIONS",
-	AllowHeaders: "Origin, Content-Type, Accept, Authorization",
-	AllowCredentials: true,
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:     "http://localhost:3000",
+		AllowMethods:     "GET,POST,HEAD,PUT,DELETE,PATCH,OPTIONS",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Request-ID, traceparent, tracestate",
+		ExposeHeaders:    "X-Request-ID, X-Trace-ID",
+		AllowCredentials: true,
+	}))
+	app.Use(middleware.RequestID())
+	app.Use(middleware.RequestContext())
+	app.Use(middleware.Tracing())
+	app.Use(middleware.AccessLog())
 
-}))
+	routes.Setup(app, registry)
 
-	routes.Setup(app)
+	// Shut down gracefully so pending spans are flushed
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+		stopStreams()
+		if err := app.Shutdown(); err != nil {
+			utils.Logger.Error("Error shutting down server", "error", err)
+		}
+	}()
 
 	// Start server on port 4000
 	err := app.Listen(":4000")
@@ -34,3 +136,67 @@ app.Use(cors.New(cors.Config{
 		panic(err)
 	}
 }
+
+// newEventBus returns the event bus chosen by EVENT_BUS, or nil when events are
+// left in the outbox
+func newEventBus() events.EventBus {
+	topics := events.Topics(config.KafkaTopicUsers, config.KafkaTopicProducts, config.KafkaTopicOrders)
+
+	switch config.EventBus {
+	case "memory":
+		return events.NewMemoryBus(topics, config.EventBusPartitions)
+	case "kafka":
+		if config.KafkaBrokers == "" {
+			return nil
+		}
+		return events.NewKafkaBus(strings.Split(config.KafkaBrokers, ","), topics, config.KafkaBatchTimeout)
+	default:
+		utils.Fatal("Unknown event bus", "event_bus", config.EventBus)
+		return nil
+	}
+}
+
+// startConsumers consumes the events of other services the API reacts to
+func startConsumers(ctx context.Context, bus events.EventBus, registry *services.Registry) {
+	consumer := bus.Consumer(events.ConsumerOptions{
+		GroupID:        config.ConsumerGroup,
+		Topics:         []string{config.KafkaTopicPayments},
+		MaxAttempts:    config.ConsumerMaxAttempts,
+		InitialBackoff: config.ConsumerInitialBackoff,
+		MaxBackoff:     config.ConsumerMaxBackoff,
+		DLQSuffix:      config.ConsumerDLQSuffix,
+		DedupRetention: config.ConsumerDedupRetention,
+	}, utils.MongoDB.Collection(config.ProcessedEventsCollection))
+
+	services.RegisterEventHandlers(consumer, registry.Orders)
+	consumer.Start(ctx)
+
+	webhookConsumer := bus.Consumer(events.ConsumerOptions{
+		GroupID:        config.WebhookConsumerGroup,
+		Topics:         []string{config.KafkaTopicUsers, config.KafkaTopicProducts, config.KafkaTopicOrders},
+		MaxAttempts:    config.ConsumerMaxAttempts,
+		InitialBackoff: config.ConsumerInitialBackoff,
+		MaxBackoff:     config.ConsumerMaxBackoff,
+		DLQSuffix:      config.ConsumerDLQSuffix,
+		DedupRetention: config.ConsumerDedupRetention,
+	}, utils.MongoDB.Collection(config.ProcessedEventsCollection))
+
+	services.RegisterWebhookHandlers(webhookConsumer, registry.Webhooks)
+	webhookConsumer.Start(ctx)
+}
+
+// warmUpCaches preloads the most ordered products and the most recent orders so
+// the first requests after a deploy do not all miss
+func warmUpCaches(ctx context.Context, registry *services.Registry) {
+	if !utils.RedisAvailable() {
+		return
+	}
+
+	cacheAdmin := services.NewCacheAdmin(registry.Users, registry.Products, registry.Orders, registry.Dashboard)
+	result, err := cacheAdmin.WarmUp(ctx, int64(config.CacheWarmUpProducts), int64(config.CacheWarmUpOrders))
+	if err != nil {
+		utils.Logger.Warn("cache warm-up failed", "error", err)
+		return
+	}
+	utils.Logger.Info("cache warmed up", "products", result.Products, "orders", result.Orders, "duration_ms", result.DurationMs)
+}
@@ -0,0 +1,522 @@
+// Package cache provides a typed read-through cache on top of Redis.
+//
+// Every entry lives under a namespaced, versioned key of the form
+// "<namespace>:v<version>:<id>", so bumping a namespace's version after a
+// model change orphans the old entries instead of decoding them wrongly.
+// Not-found results are cached too (for a shorter TTL) so that repeated
+// lookups of a missing ID do not each reach MongoDB.
+//
+// GetOrLoad protects hot keys from stampedes in three ways: concurrent misses
+// for a key share one loader per process, a short-lived Redis lock lets only one
+// instance in the cluster rebuild a key while the others wait for its result,
+// and entries are refreshed in the background shortly before they expire
+// (probabilistic early expiration, "XFetch"), so a hot key rarely misses at all.
+//
+// A cache may also keep recently used values in process (see Local) in front of
+// Redis, for lookups too hot for a network round-trip. The Invalidator
+// broadcasts its invalidations so every instance evicts the same entries.
+package cache
+
+import (
+	"backend/utils"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNotFound is returned by a Loader when the entity does not exist, and by
+// Get and GetOrLoad when a not-found result is served from the cache
+var ErrNotFound = errors.New("cache: not found")
+
+// Entries are stored as a one-byte tag, then for values a header holding the
+// entry's expiry (unix ms) and how long the loader took (ms), then the encoded
+// value. The header lets readers decide on an early refresh without a PTTL call.
+const (
+	tagValue    byte = 'v'
+	tagNotFound byte = 'n'
+
+	headerLen = 1 + 8 + 4
+)
+
+// redisAvailable reports whether the cache may use Redis
+var redisAvailable = utils.RedisAvailable
+
+// lockPollInterval is how often an instance waiting on another's rebuild checks for the result
+const lockPollInterval = 25 * time.Millisecond
+
+// unlockScript deletes the lock only if it still holds our token, so an instance
+// whose lock expired cannot release a lock since taken by another
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Options configures a Cache
+type Options struct {
+	// Namespace prefixes every key, e.g. "product"
+	Namespace string
+	// Version is bumped when the cached representation changes
+	Version int
+	// TTL is how long values are kept
+	TTL time.Duration
+	// NegativeTTL is how long not-found results are kept; zero disables negative caching
+	NegativeTTL time.Duration
+	// Codec serialises values; defaults to JSONCodec
+	Codec Codec
+	// EarlyRefreshBeta scales how eagerly entries are refreshed before they expire.
+	// 1 is the usual choice, larger refreshes earlier, zero disables early refresh.
+	EarlyRefreshBeta float64
+	// LockTTL bounds how long one instance may hold the rebuild lock for a key;
+	// zero disables the cluster-wide lock
+	LockTTL time.Duration
+	// Tags returns the invalidation tags of the entry for id; see InvalidateTags
+	Tags func(id string) []string
+	// LocalSize is how many values to keep in process in front of Redis; zero
+	// disables the local tier. It requires Invalidator.
+	LocalSize int
+	// LocalTTL bounds how long a value is served from the local tier
+	LocalTTL time.Duration
+	// Invalidator broadcasts invalidations to the local tiers of other instances
+	Invalidator *Invalidator
+}
+
+// Loader fetches the authoritative value when it is not cached. It returns
+// ErrNotFound when the entity does not exist.
+type Loader[T any] func(ctx context.Context) (T, error)
+
+// Cache is a typed read-through cache for one namespace. Redis failures never
+// fail a call: reads fall through to the loader and writes are skipped, and the
+// cache is bypassed entirely while utils.RedisAvailable reports false.
+type Cache[T any] struct {
+	client *redis.Client
+	opts   Options
+	group  singleflight.Group
+	local  *Local[T]
+
+	counters *counters
+}
+
+// entry is a decoded cache entry
+type entry[T any] struct {
+	value    T
+	notFound bool
+	expiry   time.Time
+	delta    time.Duration
+}
+
+// New creates a Cache storing values of type T in client
+func New[T any](client *redis.Client, opts Options) *Cache[T] {
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec{}
+	}
+	if opts.Version == 0 {
+		opts.Version = 1
+	}
+
+	c := &Cache[T]{client: client, opts: opts, counters: countersFor(opts.Namespace)}
+	// Without an invalidator other instances could never evict our local copies
+	if opts.LocalSize > 0 && opts.Invalidator != nil {
+		c.local = NewLocal[T](opts.LocalSize, opts.LocalTTL)
+		opts.Invalidator.register(opts.Namespace, c)
+	}
+	return c
+}
+
+// Namespace returns the namespace the cache was created with
+func (c *Cache[T]) Namespace() string {
+	return c.opts.Namespace
+}
+
+// Key returns the Redis key for id
+func (c *Cache[T]) Key(id string) string {
+	return fmt.Sprintf("%s:v%d:%s", c.opts.Namespace, c.opts.Version, id)
+}
+
+// Pattern returns a SCAN pattern matching every key of the namespace, all versions included
+func (c *Cache[T]) Pattern() string {
+	return c.opts.Namespace + ":*"
+}
+
+// Get returns the cached value for id. ok is false on a miss. A cached not-found
+// result is reported as ErrNotFound.
+func (c *Cache[T]) Get(ctx context.Context, id string) (value T, ok bool, err error) {
+	e, ok := c.lookup(ctx, id)
+	if !ok {
+		return value, false, nil
+	}
+	if e.notFound {
+		return value, true, ErrNotFound
+	}
+	return e.value, true, nil
+}
+
+// Set stores value for id with the namespace TTL
+func (c *Cache[T]) Set(ctx context.Context, id string, value T) {
+	c.set(ctx, id, value, 0, fence{})
+}
+
+// SetNotFound records that id does not exist, for the namespace's NegativeTTL
+func (c *Cache[T]) SetNotFound(ctx context.Context, id string) {
+	c.setNotFound(ctx, id, fence{})
+}
+
+func (c *Cache[T]) setNotFound(ctx context.Context, id string, f fence) {
+	if c.opts.NegativeTTL <= 0 {
+		return
+	}
+	if c.local != nil {
+		c.local.Delete(id)
+	}
+	c.write(ctx, id, []byte{tagNotFound}, c.opts.NegativeTTL, f)
+}
+
+// Delete removes the entries for ids
+func (c *Cache[T]) Delete(ctx context.Context, ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+	if c.local != nil {
+		c.local.Delete(ids...)
+		defer c.opts.Invalidator.publish(ctx, invalidation{Namespace: c.opts.Namespace, IDs: ids})
+	}
+	if !redisAvailable() {
+		return
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = c.Key(id)
+	}
+	if err := deleteKeys(ctx, c.client, keys); err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache invalidation failed", "keys", keys, "error", err)
+	}
+}
+
+// Purge removes every entry of the namespace
+func (c *Cache[T]) Purge(ctx context.Context) (int64, error) {
+	return c.PurgeMatching(ctx, c.Pattern())
+}
+
+// PurgeMatching removes the entries of the namespace whose keys match pattern,
+// which must start with "<namespace>:". The local tier is dropped whole.
+func (c *Cache[T]) PurgeMatching(ctx context.Context, pattern string) (int64, error) {
+	if !strings.HasPrefix(pattern, c.opts.Namespace+":") {
+		return 0, fmt.Errorf("cache: pattern %q is outside namespace %q", pattern, c.opts.Namespace)
+	}
+	if c.local != nil {
+		c.local.Purge()
+		defer c.opts.Invalidator.publish(ctx, invalidation{Namespace: c.opts.Namespace, Purge: true})
+	}
+	return utils.PurgeKeys(ctx, pattern)
+}
+
+// GetOrLoad returns the cached value for id, calling load and caching its result
+// on a miss. Not-found results are cached and returned as ErrNotFound.
+func (c *Cache[T]) GetOrLoad(ctx context.Context, id string, load Loader[T]) (T, error) {
+	if e, ok := c.lookup(ctx, id); ok {
+		if e.notFound {
+			return e.value, ErrNotFound
+		}
+		if c.shouldRefreshEarly(e) {
+			c.refresh(ctx, id, load)
+		}
+		return e.value, nil
+	}
+
+	// Concurrent misses share one load. The load runs detached from the first
+	// caller's cancellation so that caller leaving does not fail the others.
+	result := c.group.DoChan(id, func() (any, error) {
+		loadCtx, cancel := detach(ctx)
+		defer cancel()
+		return c.loadAndStore(loadCtx, id, load)
+	})
+
+	select {
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	case res := <-result:
+		if res.Err != nil {
+			var zero T
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	}
+}
+
+// loadAndStore rebuilds the entry for id, holding the cluster-wide lock when it
+// is enabled. Instances that lose the race wait for the winner's result.
+func (c *Cache[T]) loadAndStore(ctx context.Context, id string, load Loader[T]) (T, error) {
+	if c.opts.LockTTL > 0 && redisAvailable() {
+		token, acquired := c.lock(ctx, id)
+		if acquired {
+			defer c.unlock(ctx, id, token)
+		} else if e, ok := c.waitForEntry(ctx, id); ok {
+			if e.notFound {
+				return e.value, ErrNotFound
+			}
+			return e.value, nil
+		}
+		// Either we hold the lock, or the holder took longer than LockTTL and we
+		// load the value ourselves rather than wait any longer
+	}
+
+	f, store := c.fence(ctx, id)
+	start := time.Now()
+	value, err := load(ctx)
+	if errors.Is(err, ErrNotFound) {
+		if store {
+			c.setNotFound(ctx, id, f)
+		}
+		return value, err
+	} else if err != nil {
+		return value, err
+	}
+
+	if store {
+		c.set(ctx, id, value, time.Since(start), f)
+	}
+	return value, nil
+}
+
+// refresh reloads id in the background if no other instance is already doing so
+func (c *Cache[T]) refresh(ctx context.Context, id string, load Loader[T]) {
+	go func() {
+		refreshCtx, cancel := detach(ctx)
+		defer cancel()
+
+		_, _, _ = c.group.Do("refresh:"+id, func() (any, error) {
+			if c.opts.LockTTL > 0 {
+				token, acquired := c.lock(refreshCtx, id)
+				if !acquired {
+					return nil, nil
+				}
+				defer c.unlock(refreshCtx, id, token)
+			}
+
+			f, store := c.fence(refreshCtx, id)
+			if !store {
+				return nil, nil
+			}
+			start := time.Now()
+			value, err := load(refreshCtx)
+			switch {
+			case errors.Is(err, ErrNotFound):
+				c.setNotFound(refreshCtx, id, f)
+			case err != nil:
+				utils.LoggerFromContext(refreshCtx).Warn("cache early refresh failed", "key", c.Key(id), "error", err)
+			default:
+				c.set(refreshCtx, id, value, time.Since(start), f)
+			}
+			return nil, nil
+		})
+	}()
+}
+
+// shouldRefreshEarly implements XFetch: an entry is refreshed when
+// now - delta * beta * ln(rand()) >= expiry, which grows more likely the closer
+// the entry is to expiring and the longer it takes to rebuild.
+func (c *Cache[T]) shouldRefreshEarly(e entry[T]) bool {
+	if c.opts.EarlyRefreshBeta <= 0 || e.expiry.IsZero() || e.delta <= 0 {
+		return false
+	}
+	gap := time.Duration(float64(e.delta) * c.opts.EarlyRefreshBeta * -math.Log(1-rand.Float64()))
+	return !time.Now().Add(gap).Before(e.expiry)
+}
+
+func (c *Cache[T]) lockKey(id string) string {
+	return c.Key(id) + ":lock"
+}
+
+func (c *Cache[T]) lock(ctx context.Context, id string) (string, bool) {
+	token := fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+	acquired, err := c.client.SetNX(ctx, c.lockKey(id), token, c.opts.LockTTL).Result()
+	if err != nil {
+		// Without Redis there is nobody to coordinate with
+		return "", true
+	}
+	return token, acquired
+}
+
+func (c *Cache[T]) unlock(ctx context.Context, id, token string) {
+	if token == "" {
+		return
+	}
+	if err := unlockScript.Run(ctx, c.client, []string{c.lockKey(id)}, token).Err(); err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache unlock failed", "key", c.lockKey(id), "error", err)
+	}
+}
+
+// waitForEntry polls for the entry another instance is rebuilding, for at most LockTTL
+func (c *Cache[T]) waitForEntry(ctx context.Context, id string) (entry[T], bool) {
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(c.opts.LockTTL)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return entry[T]{}, false
+		case <-timeout.C:
+			return entry[T]{}, false
+		case <-ticker.C:
+			if e, ok := c.getEntry(ctx, id); ok {
+				return e, true
+			}
+		}
+	}
+}
+
+// lookup reads the entry for id from the local tier, then Redis, and records
+// the result in the namespace's stats
+func (c *Cache[T]) lookup(ctx context.Context, id string) (entry[T], bool) {
+	if !redisAvailable() {
+		c.record(resultBypass)
+		return entry[T]{}, false
+	}
+
+	// Local values carry no expiry, so they are never refreshed early; the
+	// Redis entry behind them is
+	if c.local != nil {
+		if value, ok := c.local.Get(id); ok {
+			c.record(resultLocalHit)
+			return entry[T]{value: value}, true
+		}
+	}
+
+	e, ok := c.getEntry(ctx, id)
+	switch {
+	case !ok:
+		c.record(resultMiss)
+	case e.notFound:
+		c.record(resultNegativeHit)
+	default:
+		c.record(resultHit)
+	}
+	return e, ok
+}
+
+// getEntry reads the entry for id from Redis, filling the local tier
+func (c *Cache[T]) getEntry(ctx context.Context, id string) (entry[T], bool) {
+	if !redisAvailable() {
+		return entry[T]{}, false
+	}
+
+	data, err := c.client.Get(ctx, c.Key(id)).Bytes()
+	if err == redis.Nil {
+		return entry[T]{}, false
+	} else if err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache read failed", "key", c.Key(id), "error", err)
+		return entry[T]{}, false
+	}
+
+	e, ok := c.decode(ctx, id, data)
+	if ok && !e.notFound && c.local != nil {
+		c.local.Set(id, e.value)
+	}
+	return e, ok
+}
+
+// set stores value for id unless a generation of f moved since it was read
+func (c *Cache[T]) set(ctx context.Context, id string, value T, delta time.Duration, f fence) {
+	data, err := c.opts.Codec.Marshal(value)
+	if err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache encode failed", "key", c.Key(id), "error", err)
+		return
+	}
+
+	var expiry int64
+	if c.opts.TTL > 0 {
+		expiry = time.Now().Add(c.opts.TTL).UnixMilli()
+	}
+
+	buf := make([]byte, headerLen, headerLen+len(data))
+	buf[0] = tagValue
+	binary.BigEndian.PutUint64(buf[1:9], uint64(expiry))
+	binary.BigEndian.PutUint32(buf[9:13], uint32(delta.Milliseconds()))
+	if c.write(ctx, id, append(buf, data...), c.opts.TTL, f) && c.local != nil {
+		c.local.Set(id, value)
+	}
+}
+
+// write stores data for id unless a generation of f moved, reporting whether
+// it did
+func (c *Cache[T]) write(ctx context.Context, id string, data []byte, ttl time.Duration, f fence) bool {
+	if !redisAvailable() {
+		return false
+	}
+
+	var tags []string
+	if c.opts.Tags != nil {
+		tags = c.opts.Tags(id)
+	}
+	written, err := writeTagged(ctx, c.client, c.Key(id), data, ttl, tags, f)
+	if err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache write failed", "key", c.Key(id), "error", err)
+	}
+	return written
+}
+
+// evictLocal applies an invalidation broadcast by another instance
+func (c *Cache[T]) evictLocal(msg invalidation) {
+	switch {
+	case msg.Purge:
+		c.local.Purge()
+	case len(msg.Tags) > 0:
+		c.local.DeleteFunc(c.hasTag(msg.Tags))
+	}
+	c.local.Delete(msg.IDs...)
+}
+
+func (c *Cache[T]) purgeLocal() {
+	c.local.Purge()
+}
+
+func (c *Cache[T]) decode(ctx context.Context, id string, data []byte) (e entry[T], ok bool) {
+	if len(data) == 0 {
+		return e, false
+	}
+
+	switch data[0] {
+	case tagNotFound:
+		e.notFound = true
+		return e, true
+	case tagValue:
+		if len(data) < headerLen {
+			return e, false
+		}
+		if expiry := int64(binary.BigEndian.Uint64(data[1:9])); expiry > 0 {
+			e.expiry = time.UnixMilli(expiry)
+		}
+		e.delta = time.Duration(binary.BigEndian.Uint32(data[9:13])) * time.Millisecond
+		if err := c.opts.Codec.Unmarshal(data[headerLen:], &e.value); err != nil {
+			// Treat undecodable entries as a miss; the reload overwrites them
+			utils.LoggerFromContext(ctx).Warn("cache decode failed", "key", c.Key(id), "error", err)
+			return e, false
+		}
+		return e, true
+	default:
+		return e, false
+	}
+}
+
+// detach returns a context that keeps ctx's values and deadline but is not
+// canceled when ctx is, for work shared with other callers
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
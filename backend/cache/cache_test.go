@@ -0,0 +1,394 @@
+package cache
+
+import (
+	"backend/utils"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// testRedis is the Redis every test of the package runs against
+var testRedis *miniredis.Miniredis
+
+func TestMain(m *testing.M) {
+	var err error
+	testRedis, err = miniredis.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	utils.RedisClient = redis.NewClient(&redis.Options{Addr: testRedis.Addr()})
+	redisAvailable = func() bool { return true }
+
+	code := m.Run()
+	testRedis.Close()
+	os.Exit(code)
+}
+
+// newTestCache returns a cache of strings in a namespace of its own, on an
+// empty Redis
+func newTestCache(t *testing.T, opts Options) *Cache[string] {
+	t.Helper()
+	testRedis.FlushAll()
+	if opts.Namespace == "" {
+		opts.Namespace = t.Name()
+	}
+	if opts.TTL == 0 {
+		opts.TTL = time.Minute
+	}
+	return New[string](utils.RedisClient, opts)
+}
+
+// countingLoader returns a loader returning value and err, and the number of
+// times it was called
+func countingLoader(value string, err error) (Loader[string], *atomic.Int32) {
+	calls := &atomic.Int32{}
+	return func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		return value, err
+	}, calls
+}
+
+// eventually fails the test unless cond holds within a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacheKeyIsVersioned(t *testing.T) {
+	ctx := context.Background()
+	v1 := newTestCache(t, Options{Namespace: "product"})
+	v2 := New[string](utils.RedisClient, Options{Namespace: "product", Version: 2, TTL: time.Minute})
+
+	if got := v1.Key("42"); got != "product:v1:42" {
+		t.Errorf("Key = %s, want product:v1:42", got)
+	}
+	if got := v2.Key("42"); got != "product:v2:42" {
+		t.Errorf("Key = %s, want product:v2:42", got)
+	}
+
+	v1.Set(ctx, "42", "old")
+	if _, ok, _ := v2.Get(ctx, "42"); ok {
+		t.Error("version 2 read the entry of version 1")
+	}
+	if value, ok, err := v1.Get(ctx, "42"); !ok || err != nil || value != "old" {
+		t.Errorf("Get = %q, %v, %v; want old, true, nil", value, ok, err)
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name        string
+		negativeTTL time.Duration
+		value       string
+		loadErr     error
+		// wantCalls is how many times two lookups in a row load
+		wantCalls int32
+		wantErr   error
+	}{
+		{name: "value cached", value: "a", wantCalls: 1},
+		{name: "not found cached", negativeTTL: time.Minute, loadErr: ErrNotFound, wantCalls: 1, wantErr: ErrNotFound},
+		{name: "not found without negative caching", loadErr: ErrNotFound, wantCalls: 2, wantErr: ErrNotFound},
+		{name: "errors not cached", loadErr: errFailed, wantCalls: 2, wantErr: errFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, Options{NegativeTTL: tt.negativeTTL})
+			load, calls := countingLoader(tt.value, tt.loadErr)
+
+			for i := 0; i < 2; i++ {
+				value, err := c.GetOrLoad(context.Background(), "id", load)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("lookup %d: error = %v, want %v", i, err, tt.wantErr)
+				}
+				if err == nil && value != tt.value {
+					t.Errorf("lookup %d: value = %q, want %q", i, value, tt.value)
+				}
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("loads = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCacheNotFoundExpiresAfterNegativeTTL(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCache(t, Options{NegativeTTL: time.Second})
+
+	c.SetNotFound(ctx, "id")
+	if _, ok, err := c.Get(ctx, "id"); !ok || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get = %v, %v; want true, ErrNotFound", ok, err)
+	}
+	if ttl := testRedis.TTL(c.Key("id")); ttl != time.Second {
+		t.Errorf("TTL = %v, want 1s", ttl)
+	}
+
+	testRedis.FastForward(time.Second)
+	if _, ok, _ := c.Get(ctx, "id"); ok {
+		t.Error("not-found entry outlived NegativeTTL")
+	}
+}
+
+func TestCacheSharesConcurrentLoads(t *testing.T) {
+	c := newTestCache(t, Options{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	load := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "a", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := c.GetOrLoad(context.Background(), "id", load); err != nil || value != "a" {
+				t.Errorf("GetOrLoad = %q, %v; want a, nil", value, err)
+			}
+		}()
+	}
+	// Let every caller join the load before it returns
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("loads = %d, want 1", got)
+	}
+}
+
+func TestCacheDiscardsLoadsInvalidatedWhileRunning(t *testing.T) {
+	tags := func(id string) []string { return []string{"entity:" + id, "entities"} }
+
+	tests := []struct {
+		name       string
+		loadErr    error
+		invalidate func(ctx context.Context, c *Cache[string])
+		wantStored bool
+	}{
+		{
+			name:       "entry deleted",
+			invalidate: func(ctx context.Context, c *Cache[string]) { c.Delete(ctx, "id") },
+		},
+		{
+			name:       "tag invalidated",
+			invalidate: func(ctx context.Context, c *Cache[string]) { c.InvalidateTags(ctx, "entities") },
+		},
+		{
+			name:       "tag invalidated from another namespace",
+			invalidate: func(ctx context.Context, c *Cache[string]) { InvalidateTags(ctx, utils.RedisClient, "entity:id") },
+		},
+		{
+			name:       "not found deleted",
+			loadErr:    ErrNotFound,
+			invalidate: func(ctx context.Context, c *Cache[string]) { c.Delete(ctx, "id") },
+		},
+		{
+			name:       "other entry deleted",
+			invalidate: func(ctx context.Context, c *Cache[string]) { c.Delete(ctx, "other") },
+			wantStored: true,
+		},
+		{
+			name:       "other tag invalidated",
+			invalidate: func(ctx context.Context, c *Cache[string]) { c.InvalidateTags(ctx, "entity:other") },
+			wantStored: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newTestCache(t, Options{Tags: tags, NegativeTTL: time.Minute})
+
+			// The write the invalidation stands for lands after the load read
+			_, err := c.GetOrLoad(ctx, "id", func(ctx context.Context) (string, error) {
+				tt.invalidate(ctx, c)
+				return "stale", tt.loadErr
+			})
+			if !errors.Is(err, tt.loadErr) {
+				t.Fatalf("GetOrLoad error = %v, want %v", err, tt.loadErr)
+			}
+
+			if _, ok, _ := c.Get(ctx, "id"); ok != tt.wantStored {
+				t.Errorf("stored = %v, want %v", ok, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestCacheStoresLoadsAfterEarlierInvalidations(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCache(t, Options{Tags: func(id string) []string { return []string{"entities"} }})
+
+	// Generations bumped before the load started do not hold it back
+	c.Delete(ctx, "id")
+	c.InvalidateTags(ctx, "entities")
+	load, _ := countingLoader("fresh", nil)
+	if _, err := c.GetOrLoad(ctx, "id", load); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, ok, _ := c.Get(ctx, "id"); !ok || value != "fresh" {
+		t.Errorf("Get = %q, %v; want fresh, true", value, ok)
+	}
+	if !testRedis.Exists(generationKey(c.Key("id"))) || !testRedis.Exists(generationKey(TagKey("entities"))) {
+		t.Error("invalidations did not bump the generations")
+	}
+}
+
+func TestInvalidateTagsDeletesEntriesOfEveryNamespace(t *testing.T) {
+	ctx := context.Background()
+	users := newTestCache(t, Options{Namespace: "users", Tags: func(id string) []string { return []string{"users"} }})
+	stats := New[string](utils.RedisClient, Options{Namespace: "stats", TTL: time.Minute, Tags: func(id string) []string { return []string{"users", "orders"} }})
+	orders := New[string](utils.RedisClient, Options{Namespace: "orders", TTL: time.Minute, Tags: func(id string) []string { return []string{"orders"} }})
+
+	users.Set(ctx, "1", "a")
+	stats.Set(ctx, "day", "b")
+	orders.Set(ctx, "2", "c")
+	InvalidateTags(ctx, utils.RedisClient, "users")
+
+	for _, tt := range []struct {
+		c    *Cache[string]
+		id   string
+		want bool
+	}{
+		{users, "1", false},
+		{stats, "day", false},
+		{orders, "2", true},
+	} {
+		if _, ok, _ := tt.c.Get(ctx, tt.id); ok != tt.want {
+			t.Errorf("%s after invalidation: cached = %v, want %v", tt.c.Key(tt.id), ok, tt.want)
+		}
+	}
+	if testRedis.Exists(TagKey("users")) {
+		t.Error("tag set outlived its invalidation")
+	}
+}
+
+func TestCacheShouldRefreshEarly(t *testing.T) {
+	tests := []struct {
+		name   string
+		beta   float64
+		expiry time.Duration
+		delta  time.Duration
+		want   bool
+	}{
+		{name: "disabled", beta: 0, expiry: -time.Second, delta: time.Second, want: false},
+		{name: "no expiry", beta: 1, delta: time.Second, want: false},
+		{name: "load time unknown", beta: 1, expiry: time.Millisecond, want: false},
+		{name: "expired", beta: 1, expiry: -time.Millisecond, delta: time.Millisecond, want: true},
+		// ln(rand) is at least -ln(2^53), so the gap stays under a second
+		{name: "far from expiry", beta: 1, expiry: time.Hour, delta: time.Millisecond, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cache[string]{opts: Options{EarlyRefreshBeta: tt.beta}}
+			e := entry[string]{delta: tt.delta}
+			if tt.expiry != 0 {
+				e.expiry = time.Now().Add(tt.expiry)
+			}
+			for i := 0; i < 100; i++ {
+				if got := c.shouldRefreshEarly(e); got != tt.want {
+					t.Fatalf("shouldRefreshEarly = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheRefreshesEarlyInBackground(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCache(t, Options{EarlyRefreshBeta: 1, LockTTL: time.Second})
+
+	// A load this slow makes an entry a minute from expiry all but certain
+	// to be refreshed
+	c.set(ctx, "id", "old", 1000*time.Hour, fence{})
+	load, calls := countingLoader("new", nil)
+	if value, err := c.GetOrLoad(ctx, "id", load); err != nil || value != "old" {
+		t.Fatalf("GetOrLoad = %q, %v; want the cached old, nil", value, err)
+	}
+
+	eventually(t, "the refreshed value", func() bool {
+		value, _, _ := c.Get(ctx, "id")
+		return value == "new"
+	})
+	if got := calls.Load(); got != 1 {
+		t.Errorf("loads = %d, want 1", got)
+	}
+	if testRedis.Exists(c.lockKey("id")) {
+		t.Error("refresh left its lock behind")
+	}
+}
+
+func TestCacheRebuildLock(t *testing.T) {
+	tests := []struct {
+		name string
+		// published is what the instance holding the lock stores, if anything
+		published string
+		lockTTL   time.Duration
+		wantValue string
+		wantCalls int32
+	}{
+		{name: "waits for the holder's result", published: "theirs", lockTTL: time.Second, wantValue: "theirs", wantCalls: 0},
+		{name: "loads itself once the lock times out", lockTTL: 50 * time.Millisecond, wantValue: "ours", wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newTestCache(t, Options{LockTTL: tt.lockTTL})
+			// Another instance is rebuilding the entry
+			if err := testRedis.Set(c.lockKey("id"), "theirs"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.published != "" {
+				time.AfterFunc(2*lockPollInterval, func() { c.Set(ctx, "id", tt.published) })
+			}
+
+			load, calls := countingLoader("ours", nil)
+			value, err := c.GetOrLoad(ctx, "id", load)
+			if err != nil || value != tt.wantValue {
+				t.Errorf("GetOrLoad = %q, %v; want %q, nil", value, err, tt.wantValue)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("loads = %d, want %d", got, tt.wantCalls)
+			}
+			// Only the holder releases its lock
+			if got, _ := testRedis.Get(c.lockKey("id")); got != "theirs" {
+				t.Errorf("lock = %q, want the holder's", got)
+			}
+		})
+	}
+}
+
+func TestCacheReleasesRebuildLock(t *testing.T) {
+	c := newTestCache(t, Options{LockTTL: time.Second})
+	load, _ := countingLoader("a", nil)
+	if _, err := c.GetOrLoad(context.Background(), "id", load); err != nil {
+		t.Fatal(err)
+	}
+	if testRedis.Exists(c.lockKey("id")) {
+		t.Error("lock held after the load")
+	}
+}
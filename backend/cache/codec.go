@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"encoding/json"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Codec serialises values stored in the cache
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec stores values as JSON. It is the default and handles any value.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// BSONCodec stores values as BSON, which keeps ObjectIDs and dates in their
+// MongoDB types. Values must be documents (structs or maps).
+type BSONCodec struct{}
+
+func (BSONCodec) Marshal(v any) ([]byte, error)      { return bson.Marshal(v) }
+func (BSONCodec) Unmarshal(data []byte, v any) error { return bson.Unmarshal(data, v) }
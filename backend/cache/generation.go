@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"backend/utils"
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A load reads MongoDB before it writes Redis, so a write to MongoDB and its
+// invalidation can land in between and be overwritten by the value read
+// before it. To prevent that, every entry and every tag has a generation
+// counter at "gen:<key>" that each invalidation bumps. A load notes the
+// generations of its entry and the entry's tags before it starts, and its
+// result is written only if none of them moved in the meantime.
+//
+// Purges do not bump generations; a load racing a purge may still store its
+// value.
+
+// generationTTL is how long a generation counter is kept after its last bump.
+// A load that takes longer may store a value invalidated while it ran.
+const generationTTL = time.Hour
+
+// deleteScript deletes entries and bumps their generations.
+//
+// KEYS are the entry keys followed by their generation keys, in the same
+// order; ARGV[1] is generationTTL in milliseconds. It returns the number of
+// entries deleted.
+var deleteScript = redis.NewScript(`
+local n = #KEYS / 2
+local deleted = 0
+for i = 1, n do
+	deleted = deleted + redis.call("DEL", KEYS[i])
+	redis.call("INCR", KEYS[n + i])
+	redis.call("PEXPIRE", KEYS[n + i], ARGV[1])
+end
+return deleted
+`)
+
+// generationKey returns the key of the generation counter of key, an entry or
+// tag key
+func generationKey(key string) string {
+	return "gen:" + key
+}
+
+// fence holds the generations of an entry and its tags when a load started.
+// The zero fence guards nothing.
+type fence struct {
+	keys        []string
+	generations []string
+}
+
+// fence reads the generations of the entry for id and its tags. ok is false
+// when they could not be read, in which case the load's result must not be
+// stored.
+func (c *Cache[T]) fence(ctx context.Context, id string) (f fence, ok bool) {
+	if !redisAvailable() {
+		return f, true
+	}
+
+	f.keys = []string{generationKey(c.Key(id))}
+	if c.opts.Tags != nil {
+		for _, tag := range c.opts.Tags(id) {
+			f.keys = append(f.keys, generationKey(TagKey(tag)))
+		}
+	}
+	values, err := c.client.MGet(ctx, f.keys...).Result()
+	if err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache generation read failed", "key", c.Key(id), "error", err)
+		return f, false
+	}
+
+	f.generations = make([]string, len(values))
+	for i, v := range values {
+		// A counter never bumped, or expired, reads as ""
+		if s, ok := v.(string); ok {
+			f.generations[i] = s
+		}
+	}
+	return f, true
+}
+
+// deleteKeys deletes the entries at keys and bumps their generations
+func deleteKeys(ctx context.Context, client *redis.Client, keys []string) error {
+	all := make([]string, 0, 2*len(keys))
+	all = append(all, keys...)
+	for _, key := range keys {
+		all = append(all, generationKey(key))
+	}
+	return deleteScript.Run(ctx, client, all, generationTTL.Milliseconds()).Err()
+}
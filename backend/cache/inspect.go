@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// scanBatch is how many keys Scan reads per SCAN call and pipeline
+const scanBatch = 500
+
+// ErrUndecodable is reported by Inspect and Scan for an entry that cannot be decoded
+var ErrUndecodable = errors.New("cache: undecodable entry")
+
+// StoredEntry describes an entry as it is stored in Redis, for administration
+// and consistency checks
+type StoredEntry[T any] struct {
+	// Key is the Redis key
+	Key string
+	// ID is the entity ID, empty for keys of another version of the namespace
+	ID string
+	// Outdated reports a key written under another version of the namespace
+	Outdated bool
+	// Value is the decoded value unless NotFound or Err is set
+	Value T
+	// NotFound reports a cached not-found result
+	NotFound bool
+	// TTL is the remaining time to live, negative for an entry without one
+	TTL time.Duration
+	// Err is ErrUndecodable when the entry could not be decoded
+	Err error
+}
+
+// Inspect returns the entry stored for id, bypassing the in-process tier. ok is
+// false when nothing is stored.
+func (c *Cache[T]) Inspect(ctx context.Context, id string) (e StoredEntry[T], ok bool, err error) {
+	pipe := c.client.Pipeline()
+	get := pipe.Get(ctx, c.Key(id))
+	ttl := pipe.PTTL(ctx, c.Key(id))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return e, false, err
+	}
+	if get.Err() == redis.Nil {
+		return e, false, nil
+	}
+
+	data, _ := get.Bytes()
+	return c.stored(ctx, c.Key(id), data, ttl.Val()), true, nil
+}
+
+// Scan calls fn with every entry of the namespace, all versions included, in
+// batches. Rebuild locks are skipped. Scan stops at the first error fn returns.
+func (c *Cache[T]) Scan(ctx context.Context, fn func(entries []StoredEntry[T]) error) error {
+	iter := c.client.Scan(ctx, 0, c.Pattern(), scanBatch).Iterator()
+
+	keys := make([]string, 0, scanBatch)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		defer func() { keys = keys[:0] }()
+
+		pipe := c.client.Pipeline()
+		gets := make([]*redis.StringCmd, len(keys))
+		ttls := make([]*redis.DurationCmd, len(keys))
+		for i, key := range keys {
+			gets[i] = pipe.Get(ctx, key)
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+
+		entries := make([]StoredEntry[T], 0, len(keys))
+		for i, key := range keys {
+			// The key may have expired since it was scanned
+			if gets[i].Err() == redis.Nil {
+				continue
+			}
+			data, _ := gets[i].Bytes()
+			entries = append(entries, c.stored(ctx, key, data, ttls[i].Val()))
+		}
+		return fn(entries)
+	}
+
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if strings.HasSuffix(key, ":lock") {
+			continue
+		}
+		keys = append(keys, key)
+		if len(keys) == cap(keys) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// DeleteKeys removes raw keys of the namespace, such as outdated ones found by
+// Scan. Use Delete for entity IDs.
+func (c *Cache[T]) DeleteKeys(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.client.Del(ctx, keys...).Err()
+}
+
+func (c *Cache[T]) stored(ctx context.Context, key string, data []byte, ttl time.Duration) StoredEntry[T] {
+	e := StoredEntry[T]{Key: key, TTL: ttl}
+
+	prefix := c.Key("")
+	if !strings.HasPrefix(key, prefix) {
+		e.Outdated = true
+		return e
+	}
+	e.ID = strings.TrimPrefix(key, prefix)
+
+	decoded, ok := c.decode(ctx, e.ID, data)
+	switch {
+	case !ok:
+		e.Err = ErrUndecodable
+	case decoded.notFound:
+		e.NotFound = true
+	default:
+		e.Value = decoded.value
+	}
+	return e
+}
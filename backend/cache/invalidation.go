@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// resubscribeDelay is how long the invalidator waits before receiving again
+// after losing its subscription
+const resubscribeDelay = time.Second
+
+// invalidation is the message broadcast when entries of a namespace change
+type invalidation struct {
+	Origin    string   `json:"origin"`
+	Namespace string   `json:"namespace"`
+	IDs       []string `json:"ids,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Purge     bool     `json:"purge,omitempty"`
+}
+
+// localTier is implemented by every Cache with an in-process tier
+type localTier interface {
+	evictLocal(msg invalidation)
+	purgeLocal()
+}
+
+// Invalidator keeps the in-process tiers of caches coherent across API
+// instances. Every Delete, Purge and InvalidateTags on a cache with a local tier
+// is published on a Redis channel, and each instance evicts the same entries
+// from its own tier when the message arrives.
+//
+// Pub/sub is fire-and-forget, so an instance that loses its subscription drops
+// its whole local tier once it is subscribed again; LocalTTL bounds staleness
+// in the remaining races.
+type Invalidator struct {
+	client  *redis.Client
+	channel string
+	origin  string
+
+	mu     sync.RWMutex
+	locals map[string][]localTier
+}
+
+// NewInvalidator creates an Invalidator broadcasting on channel
+func NewInvalidator(client *redis.Client, channel string) *Invalidator {
+	return &Invalidator{
+		client:  client,
+		channel: channel,
+		origin:  fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63()),
+		locals:  make(map[string][]localTier),
+	}
+}
+
+// Start subscribes to the channel and applies invalidations from other
+// instances until ctx is done
+func (i *Invalidator) Start(ctx context.Context) {
+	go func() {
+		pubsub := i.client.Subscribe(ctx, i.channel)
+		defer pubsub.Close()
+
+		for {
+			msg, err := pubsub.Receive(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// Receive reconnects and resubscribes on the next call
+				utils.Logger.Warn("cache invalidation subscription lost", "channel", i.channel, "error", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(resubscribeDelay):
+				}
+				continue
+			}
+
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				// Invalidations published before this (re)subscription were missed
+				i.purgeAll()
+			case *redis.Message:
+				i.apply(msg.Payload)
+			}
+		}
+	}()
+}
+
+func (i *Invalidator) register(namespace string, tier localTier) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.locals[namespace] = append(i.locals[namespace], tier)
+}
+
+// publish applies msg to the other tiers of the namespace in this process, then
+// broadcasts it to the other instances
+func (i *Invalidator) publish(ctx context.Context, msg invalidation) {
+	i.dispatch(msg)
+	if !redisAvailable() {
+		return
+	}
+
+	msg.Origin = i.origin
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err := i.client.Publish(ctx, i.channel, data).Err(); err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache invalidation broadcast failed", "namespace", msg.Namespace, "error", err)
+	}
+}
+
+func (i *Invalidator) apply(payload string) {
+	var msg invalidation
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		utils.Logger.Warn("invalid cache invalidation message", "channel", i.channel, "error", err)
+		return
+	}
+	if msg.Origin == i.origin {
+		return
+	}
+	i.dispatch(msg)
+}
+
+func (i *Invalidator) dispatch(msg invalidation) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, tier := range i.locals[msg.Namespace] {
+		tier.evictLocal(msg)
+	}
+}
+
+func (i *Invalidator) purgeAll() {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, tiers := range i.locals {
+		for _, tier := range tiers {
+			tier.purgeLocal()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Local is a bounded in-process LRU cache. It holds at most size entries, each
+// for at most ttl, evicting the least recently used entry when full. It is safe
+// for concurrent use.
+type Local[T any] struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List // front is most recently used
+}
+
+type localItem[T any] struct {
+	id     string
+	value  T
+	expiry time.Time
+}
+
+// NewLocal creates a Local holding up to size entries for ttl each; a zero ttl
+// keeps entries until they are evicted
+func NewLocal[T any](size int, ttl time.Duration) *Local[T] {
+	return &Local[T]{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+// Get returns the value for id and marks it as recently used
+func (l *Local[T]) Get(id string) (value T, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.items[id]
+	if !ok {
+		return value, false
+	}
+	item := el.Value.(*localItem[T])
+	if !item.expiry.IsZero() && time.Now().After(item.expiry) {
+		l.remove(el)
+		return value, false
+	}
+	l.order.MoveToFront(el)
+	return item.value, true
+}
+
+// Set stores value for id, evicting the least recently used entry if full
+func (l *Local[T]) Set(id string, value T) {
+	if l.size <= 0 {
+		return
+	}
+
+	var expiry time.Time
+	if l.ttl > 0 {
+		expiry = time.Now().Add(l.ttl)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.items[id]; ok {
+		item := el.Value.(*localItem[T])
+		item.value, item.expiry = value, expiry
+		l.order.MoveToFront(el)
+		return
+	}
+
+	l.items[id] = l.order.PushFront(&localItem[T]{id: id, value: value, expiry: expiry})
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+	}
+}
+
+// Delete removes the entries for ids
+func (l *Local[T]) Delete(ids ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, id := range ids {
+		if el, ok := l.items[id]; ok {
+			l.remove(el)
+		}
+	}
+}
+
+// DeleteFunc removes every entry whose id matches
+func (l *Local[T]) DeleteFunc(match func(id string) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for id, el := range l.items {
+		if match(id) {
+			l.remove(el)
+		}
+	}
+}
+
+// Purge removes every entry
+func (l *Local[T]) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.items = make(map[string]*list.Element, l.size)
+	l.order.Init()
+}
+
+// Len returns the number of entries, expired ones included until they are evicted
+func (l *Local[T]) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.order.Len()
+}
+
+func (l *Local[T]) remove(el *list.Element) {
+	l.order.Remove(el)
+	delete(l.items, el.Value.(*localItem[T]).id)
+}
@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestLocal(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		// ops run in order: "set:<id>", "get:<id>", "delete:<id>", "purge"
+		ops  []string
+		want []string
+	}{
+		{name: "keeps up to size", size: 2, ops: []string{"set:a", "set:b"}, want: []string{"a", "b"}},
+		{name: "evicts least recently set", size: 2, ops: []string{"set:a", "set:b", "set:c"}, want: []string{"b", "c"}},
+		{name: "get marks recently used", size: 2, ops: []string{"set:a", "set:b", "get:a", "set:c"}, want: []string{"a", "c"}},
+		{name: "set again marks recently used", size: 2, ops: []string{"set:a", "set:b", "set:a", "set:c"}, want: []string{"a", "c"}},
+		{name: "delete", size: 2, ops: []string{"set:a", "set:b", "delete:a"}, want: []string{"b"}},
+		{name: "purge", size: 2, ops: []string{"set:a", "set:b", "purge", "set:c"}, want: []string{"c"}},
+		{name: "size zero keeps nothing", size: 0, ops: []string{"set:a"}, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLocal[string](tt.size, 0)
+			for _, op := range tt.ops {
+				verb, id, _ := strings.Cut(op, ":")
+				switch verb {
+				case "set":
+					l.Set(id, "value of "+id)
+				case "get":
+					l.Get(id)
+				case "delete":
+					l.Delete(id)
+				case "purge":
+					l.Purge()
+				}
+			}
+
+			if l.Len() != len(tt.want) {
+				t.Errorf("Len = %d, want %d", l.Len(), len(tt.want))
+			}
+			for _, id := range tt.want {
+				if value, ok := l.Get(id); !ok || value != "value of "+id {
+					t.Errorf("Get(%s) = %q, %v; want its value", id, value, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalExpires(t *testing.T) {
+	l := NewLocal[string](2, 10*time.Millisecond)
+	l.Set("a", "a")
+	if _, ok := l.Get("a"); !ok {
+		t.Fatal("value missing before its TTL")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := l.Get("a"); ok {
+		t.Error("value served after its TTL")
+	}
+	if l.Len() != 0 {
+		t.Errorf("Len = %d, want the expired value evicted", l.Len())
+	}
+}
+
+func TestLocalDeleteFunc(t *testing.T) {
+	l := NewLocal[string](10, 0)
+	for _, id := range []string{"user:1", "user:2", "order:1"} {
+		l.Set(id, id)
+	}
+	l.DeleteFunc(func(id string) bool { return strings.HasPrefix(id, "user:") })
+
+	if _, ok := l.Get("order:1"); !ok || l.Len() != 1 {
+		t.Errorf("Len = %d, want only order:1 left", l.Len())
+	}
+}
+
+func TestLocalConcurrentUse(t *testing.T) {
+	l := NewLocal[int](8, time.Millisecond)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				id := fmt.Sprint((g + i) % 16)
+				switch i % 5 {
+				case 0:
+					l.Delete(id)
+				case 1:
+					l.DeleteFunc(func(other string) bool { return other == id })
+				case 2:
+					l.Get(id)
+				default:
+					l.Set(id, i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if l.Len() > 8 {
+		t.Errorf("Len = %d, want at most 8", l.Len())
+	}
+}
+
+// newTestInstance returns a cache with a local tier, as one API instance
+// would have it, whose invalidator is subscribed to channel
+func newTestInstance(t *testing.T, channel string, tags func(id string) []string) *Cache[string] {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: testRedis.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	invalidator := NewInvalidator(client, channel)
+	c := New[string](client, Options{
+		Namespace:   "local",
+		TTL:         time.Minute,
+		Tags:        tags,
+		LocalSize:   10,
+		Invalidator: invalidator,
+	})
+
+	// The invalidator purges the local tier once it is subscribed
+	c.local.Set("subscribed", "")
+	invalidator.Start(ctx)
+	eventually(t, "the subscription", func() bool { return c.local.Len() == 0 })
+	return c
+}
+
+func TestInvalidatorEvictsOtherInstances(t *testing.T) {
+	tags := func(id string) []string { return []string{"entity:" + id} }
+
+	tests := []struct {
+		name       string
+		invalidate func(ctx context.Context, c *Cache[string])
+		wantKept   []string
+	}{
+		{
+			name:       "delete",
+			invalidate: func(ctx context.Context, c *Cache[string]) { c.Delete(ctx, "a") },
+			wantKept:   []string{"b"},
+		},
+		{
+			name:       "tags",
+			invalidate: func(ctx context.Context, c *Cache[string]) { c.InvalidateTags(ctx, "entity:b") },
+			wantKept:   []string{"a"},
+		},
+		{
+			name: "purge",
+			invalidate: func(ctx context.Context, c *Cache[string]) {
+				if _, err := c.Purge(ctx); err != nil {
+					t.Error(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			testRedis.FlushAll()
+			channel := "invalidations:" + t.Name()
+			writer := newTestInstance(t, channel, tags)
+			reader := newTestInstance(t, channel, tags)
+
+			for _, id := range []string{"a", "b"} {
+				writer.Set(ctx, id, id)
+				// Reads fill the local tier of the other instance
+				if _, ok, _ := reader.Get(ctx, id); !ok {
+					t.Fatalf("Get(%s) missed", id)
+				}
+			}
+			tt.invalidate(ctx, writer)
+
+			kept := map[string]bool{}
+			for _, id := range tt.wantKept {
+				kept[id] = true
+			}
+			for _, id := range []string{"a", "b"} {
+				if kept[id] {
+					continue
+				}
+				eventually(t, "the eviction of "+id, func() bool {
+					_, ok := reader.local.Get(id)
+					return !ok
+				})
+				if _, ok := writer.local.Get(id); ok {
+					t.Errorf("writer kept %s in its own local tier", id)
+				}
+			}
+			for _, id := range tt.wantKept {
+				if _, ok := reader.local.Get(id); !ok {
+					t.Errorf("reader evicted %s", id)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidatorPurgesOnSubscription(t *testing.T) {
+	channel := "invalidations:" + t.Name()
+	c := newTestInstance(t, channel, nil)
+	c.local.Set("a", "a")
+
+	// A second invalidator stands for the first one resubscribing after it
+	// missed invalidations
+	resubscribed := NewInvalidator(c.client, channel)
+	resubscribed.register(c.opts.Namespace, c)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resubscribed.Start(ctx)
+
+	eventually(t, "the local tier purged", func() bool { return c.local.Len() == 0 })
+}
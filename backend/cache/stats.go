@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Lookup results recorded for every Get and GetOrLoad
+const (
+	resultLocalHit    = "local_hit"
+	resultHit         = "hit"
+	resultNegativeHit = "negative_hit"
+	resultMiss        = "miss"
+	resultBypass      = "bypass"
+)
+
+// lookups counts lookups per namespace and result across the cluster, via /metrics
+var lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backend_cache_lookups_total",
+	Help: "Cache lookups by namespace and result (local_hit, hit, negative_hit, miss or bypass while Redis is down).",
+}, []string{"namespace", "result"})
+
+// Stats counts the lookups of one namespace in this process
+type Stats struct {
+	Namespace    string  `json:"namespace"`
+	LocalHits    uint64  `json:"local_hits"`
+	Hits         uint64  `json:"hits"`
+	NegativeHits uint64  `json:"negative_hits"`
+	Misses       uint64  `json:"misses"`
+	Bypassed     uint64  `json:"bypassed"`
+	HitRatio     float64 `json:"hit_ratio"`
+}
+
+type counters struct {
+	localHits, hits, negativeHits, misses, bypassed atomic.Uint64
+}
+
+// namespaceStats holds the counters of every namespace, shared by all caches of
+// the namespace in this process
+var namespaceStats sync.Map // namespace -> *counters
+
+func countersFor(namespace string) *counters {
+	c, _ := namespaceStats.LoadOrStore(namespace, &counters{})
+	return c.(*counters)
+}
+
+func (c *Cache[T]) record(result string) {
+	lookups.WithLabelValues(c.opts.Namespace, result).Inc()
+
+	n := c.counters
+	switch result {
+	case resultLocalHit:
+		n.localHits.Add(1)
+	case resultHit:
+		n.hits.Add(1)
+	case resultNegativeHit:
+		n.negativeHits.Add(1)
+	case resultMiss:
+		n.misses.Add(1)
+	case resultBypass:
+		n.bypassed.Add(1)
+	}
+}
+
+// AllStats returns the lookup counters of every namespace used in this process
+// since it started, sorted by namespace. Lookups bypassing the cache while
+// Redis is down count as misses in the hit ratio.
+func AllStats() []Stats {
+	var all []Stats
+	namespaceStats.Range(func(key, value any) bool {
+		n := value.(*counters)
+		s := Stats{
+			Namespace:    key.(string),
+			LocalHits:    n.localHits.Load(),
+			Hits:         n.hits.Load(),
+			NegativeHits: n.negativeHits.Load(),
+			Misses:       n.misses.Load(),
+			Bypassed:     n.bypassed.Load(),
+		}
+		hits := s.LocalHits + s.Hits + s.NegativeHits
+		if total := hits + s.Misses + s.Bypassed; total > 0 {
+			s.HitRatio = float64(hits) / float64(total)
+		}
+		all = append(all, s)
+		return true
+	})
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Namespace < all[j].Namespace })
+	return all
+}
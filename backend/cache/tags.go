@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"backend/utils"
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Tags group cache entries across namespaces so that a mutation can drop exactly
+// the entries derived from the changed data. Each tag is a Redis set at
+// "tag:<name>" holding the keys of its entries, e.g. "user:<id>" for one user's
+// entry and "users" for every list page and statistic computed from users.
+
+// setTaggedScript writes an entry and adds its key to each tag set, unless a
+// generation of its fence moved. Tag sets live at least as long as their
+// longest-lived entry.
+//
+// KEYS[1] is the entry key, KEYS[2..n+1] the tag keys and the remaining keys
+// the generation keys of the fence; ARGV[1] is the entry, ARGV[2] its TTL in
+// milliseconds (0 for none), ARGV[3] the number of tags n and ARGV[4..] the
+// generations of the fence. It returns 0 when the entry was not written.
+var setTaggedScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+local ntags = tonumber(ARGV[3])
+for i = ntags + 2, #KEYS do
+	if (redis.call("GET", KEYS[i]) or "") ~= ARGV[i - ntags + 2] then
+		return 0
+	end
+end
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+for i = 2, ntags + 1 do
+	redis.call("SADD", KEYS[i], KEYS[1])
+	if ttl > 0 then
+		if redis.call("PTTL", KEYS[i]) < ttl then
+			redis.call("PEXPIRE", KEYS[i], ttl)
+		end
+	else
+		redis.call("PERSIST", KEYS[i])
+	end
+end
+return 1
+`)
+
+// invalidateTagsScript deletes every entry of each tag, then the tag sets
+// themselves, and bumps the generations of the tags, in one atomic step.
+//
+// KEYS are the tag keys followed by their generation keys, in the same order;
+// ARGV[1] is generationTTL in milliseconds. It returns the number of entries
+// deleted.
+var invalidateTagsScript = redis.NewScript(`
+local n = #KEYS / 2
+local deleted = 0
+for i = 1, n do
+	local members = redis.call("SMEMBERS", KEYS[i])
+	for j = 1, #members, 500 do
+		deleted = deleted + redis.call("DEL", unpack(members, j, math.min(j + 499, #members)))
+	end
+	redis.call("DEL", KEYS[i])
+	redis.call("INCR", KEYS[n + i])
+	redis.call("PEXPIRE", KEYS[n + i], ARGV[1])
+end
+return deleted
+`)
+
+// TagKey returns the Redis key of the set holding tag's entries
+func TagKey(tag string) string {
+	return "tag:" + tag
+}
+
+// InvalidateTags deletes every entry carrying any of tags, whichever cache
+// namespace it belongs to. It does not reach in-process tiers; use the Cache
+// method for caches that have one.
+func InvalidateTags(ctx context.Context, client *redis.Client, tags ...string) {
+	if !redisAvailable() || len(tags) == 0 {
+		return
+	}
+
+	keys := make([]string, 2*len(tags))
+	for i, tag := range tags {
+		keys[i] = TagKey(tag)
+		keys[len(tags)+i] = generationKey(TagKey(tag))
+	}
+	if err := invalidateTagsScript.Run(ctx, client, keys, generationTTL.Milliseconds()).Err(); err != nil {
+		utils.LoggerFromContext(ctx).Warn("cache tag invalidation failed", "tags", tags, "error", err)
+	}
+}
+
+// InvalidateTags deletes every entry carrying any of tags, whichever cache
+// namespace it belongs to
+func (c *Cache[T]) InvalidateTags(ctx context.Context, tags ...string) {
+	InvalidateTags(ctx, c.client, tags...)
+	if c.local != nil && c.opts.Tags != nil {
+		c.local.DeleteFunc(c.hasTag(tags))
+		c.opts.Invalidator.publish(ctx, invalidation{Namespace: c.opts.Namespace, Tags: tags})
+	}
+}
+
+// hasTag returns a matcher for the ids whose entries carry any of tags
+func (c *Cache[T]) hasTag(tags []string) func(id string) bool {
+	return func(id string) bool {
+		if c.opts.Tags == nil {
+			return false
+		}
+		for _, t := range c.opts.Tags(id) {
+			for _, tag := range tags {
+				if t == tag {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// writeTagged stores data under key and registers key with tags, unless a
+// generation of f moved. It reports whether data was stored.
+func writeTagged(ctx context.Context, client *redis.Client, key string, data []byte, ttl time.Duration, tags []string, f fence) (bool, error) {
+	keys := make([]string, 0, 1+len(tags)+len(f.keys))
+	keys = append(keys, key)
+	for _, tag := range tags {
+		keys = append(keys, TagKey(tag))
+	}
+	keys = append(keys, f.keys...)
+
+	args := make([]any, 0, 3+len(f.generations))
+	args = append(args, data, ttl.Milliseconds(), len(tags))
+	for _, g := range f.generations {
+		args = append(args, g)
+	}
+	written, err := setTaggedScript.Run(ctx, client, keys, args...).Int()
+	return written == 1, err
+}
@@ -1,11 +1,189 @@
 package config
 
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
 const (
 	//Redis Config
-	RedisAddr    = "localhost:6379"
-	RedisPass	 = ""
-	RedisDB		 = 0
+	RedisAddr = "localhost:6379"
+	RedisPass = ""
+	RedisDB   = 0
 
 	//MongoDB Config
-	MongoURI     = "mongodb://localhost:27017/test"
+	MongoURI = "mongodb://localhost:27017/test"
 )
+
+var (
+	//Admin Config
+	AdminToken = getEnv("ADMIN_TOKEN", "") // admin endpoints are disabled while empty
+
+	//Logging Config
+	LogLevel = getEnv("LOG_LEVEL", "info") // debug, info, warn or error
+
+	//Timeout Config
+	RequestTimeout   = getDuration("REQUEST_TIMEOUT", 30*time.Second)
+	ReadTimeout      = getDuration("DB_READ_TIMEOUT", 5*time.Second)
+	WriteTimeout     = getDuration("DB_WRITE_TIMEOUT", 10*time.Second)
+	AggregateTimeout = getDuration("DB_AGGREGATE_TIMEOUT", 20*time.Second)
+
+	//Cache Config
+	CacheTTLProducts         = getDuration("CACHE_TTL_PRODUCTS", time.Hour)
+	CacheTTLOrders           = getDuration("CACHE_TTL_ORDERS", 10*time.Minute)
+	CacheTTLUsers            = getDuration("CACHE_TTL_USERS", 30*time.Minute)
+	CacheTTLLists            = getDuration("CACHE_TTL_LISTS", time.Minute)
+	CacheTTLStats            = getDuration("CACHE_TTL_STATS", 5*time.Minute)
+	CacheNegativeTTL         = getDuration("CACHE_NEGATIVE_TTL", 30*time.Second)
+	CacheRefreshBeta         = getFloat("CACHE_EARLY_REFRESH_BETA", 1)
+	CacheLockTTL             = getDuration("CACHE_LOCK_TTL", 3*time.Second)
+	CacheLocalSize           = getInt("CACHE_LOCAL_SIZE", 10000)
+	CacheLocalTTL            = getDuration("CACHE_LOCAL_TTL", 30*time.Second)
+	CacheInvalidationChannel = getEnv("CACHE_INVALIDATION_CHANNEL", "cache:invalidate")
+	CacheWarmUpOnStartup     = getEnv("CACHE_WARMUP_ON_STARTUP", "true") == "true"
+	CacheWarmUpProducts      = getInt("CACHE_WARMUP_PRODUCTS", 100)
+	CacheWarmUpOrders        = getInt("CACHE_WARMUP_ORDERS", 100)
+
+	//Statistics Config
+	StatsTimezone     = getEnv("STATS_TIMEZONE", "Asia/Bangkok")
+	StatsMaxBuckets   = getInt("STATS_MAX_BUCKETS", 1000)
+	LeaderboardWindow = getDuration("LEADERBOARD_WINDOW", 30*24*time.Hour)
+	// StatsRollups serves statistics from counters kept up to date on every
+	// write, reconciled from the collections every RollupReconcileInterval
+	StatsRollups            = getEnv("STATS_ROLLUPS", "true") == "true"
+	RollupsCollection       = getEnv("ROLLUPS_COLLECTION", "stats_rollups")
+	RollupReconcileInterval = getDuration("ROLLUP_RECONCILE_INTERVAL", time.Hour)
+
+	//Anomaly Detection Config
+	AnomaliesCollection = getEnv("ANOMALIES_COLLECTION", "anomalies")
+	// Each day is compared with the AnomalyBaselineDays days before it, once at
+	// least AnomalyMinBaselineDays of them have passed
+	AnomalyBaselineDays    = getInt("ANOMALY_BASELINE_DAYS", 28)
+	AnomalyMinBaselineDays = getInt("ANOMALY_MIN_BASELINE_DAYS", 7)
+	// Orders with one of these statuses are left out of the days compared
+	AnomalyExcludeStatuses = getEnv("ANOMALY_EXCLUDE_STATUSES", "cancelled") // comma-separated
+	// A day is flagged when its z-score or its MAD score, the modified z-score
+	// based on the median absolute deviation, reaches its threshold either way
+	AnomalyZThreshold   = getFloat("ANOMALY_Z_THRESHOLD", 3)
+	AnomalyMADThreshold = getFloat("ANOMALY_MAD_THRESHOLD", 3.5)
+	// Every AnomalyInterval the last AnomalyLookbackDays complete days are checked
+	AnomalyInterval     = getDuration("ANOMALY_INTERVAL", time.Hour)
+	AnomalyLookbackDays = getInt("ANOMALY_LOOKBACK_DAYS", 7)
+
+	//Dashboard Config
+	DashboardRecentOrders = getInt("DASHBOARD_RECENT_ORDERS", 10)
+	// Products with a tracked stock at or below LowStockThreshold are listed as low on stock
+	LowStockThreshold = getInt("LOW_STOCK_THRESHOLD", 10)
+	LowStockLimit     = getInt("LOW_STOCK_LIMIT", 10)
+
+	//Startup and Health Config
+	StartupRetryTimeout  = getDuration("STARTUP_RETRY_TIMEOUT", 60*time.Second)
+	RetryInitialInterval = getDuration("RETRY_INITIAL_INTERVAL", 500*time.Millisecond)
+	RetryMaxInterval     = getDuration("RETRY_MAX_INTERVAL", 10*time.Second)
+	HealthCheckInterval  = getDuration("HEALTH_CHECK_INTERVAL", 5*time.Second)
+
+	//Stream Config
+	StreamKey         = getEnv("STREAM_KEY", "changes")
+	StreamMaxLen      = getInt("STREAM_MAX_LEN", 10000)     // changes kept for clients resuming with Last-Event-ID
+	StreamReplayLimit = getInt("STREAM_REPLAY_LIMIT", 1000) // most missed changes sent on resume before asking for a reload
+	StreamBuffer      = getInt("STREAM_BUFFER", 256)        // changes queued per client before it is dropped
+	StreamHeartbeat   = getDuration("STREAM_HEARTBEAT", 15*time.Second)
+	StreamTokenSecret = getEnv("STREAM_TOKEN_SECRET", "") // user subscriber tokens are disabled while empty
+	StreamTokenTTL    = getDuration("STREAM_TOKEN_TTL", 24*time.Hour)
+
+	//Webhook Config
+	WebhookSubscriptionsCollection = getEnv("WEBHOOK_SUBSCRIPTIONS_COLLECTION", "webhook_subscriptions")
+	WebhookDeliveriesCollection    = getEnv("WEBHOOK_DELIVERIES_COLLECTION", "webhook_deliveries")
+	WebhookConsumerGroup           = getEnv("WEBHOOK_CONSUMER_GROUP", "webhooks")
+	WebhookWorkers                 = getInt("WEBHOOK_WORKERS", 4)
+	WebhookPollInterval            = getDuration("WEBHOOK_POLL_INTERVAL", time.Second)
+	WebhookTimeout                 = getDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	WebhookMaxAttempts             = getInt("WEBHOOK_MAX_ATTEMPTS", 10)
+	WebhookInitialBackoff          = getDuration("WEBHOOK_INITIAL_BACKOFF", 30*time.Second)
+	WebhookMaxBackoff              = getDuration("WEBHOOK_MAX_BACKOFF", 6*time.Hour)
+	WebhookLockTTL                 = getDuration("WEBHOOK_LOCK_TTL", time.Minute) // must exceed WEBHOOK_TIMEOUT
+
+	//Event Bus Config
+	EventBus           = getEnv("EVENT_BUS", "kafka")      // "kafka" or "memory" for an in-process bus
+	EventBusPartitions = getInt("EVENT_BUS_PARTITIONS", 8) // partitions per topic of the in-process bus
+
+	//Kafka Config
+	KafkaBrokers       = getEnv("KAFKA_BROKERS", "localhost:9092") // comma-separated; when empty, events wait in the outbox
+	KafkaTopicUsers    = getEnv("KAFKA_TOPIC_USERS", "users.events")
+	KafkaTopicProducts = getEnv("KAFKA_TOPIC_PRODUCTS", "products.events")
+	KafkaTopicOrders   = getEnv("KAFKA_TOPIC_ORDERS", "orders.events")
+	KafkaTopicPayments = getEnv("KAFKA_TOPIC_PAYMENTS", "payments.events")
+	KafkaBatchTimeout  = getDuration("KAFKA_BATCH_TIMEOUT", 10*time.Millisecond)
+
+	//Consumer Config
+	ConsumerGroup             = getEnv("CONSUMER_GROUP", "backend")
+	ConsumerMaxAttempts       = getInt("CONSUMER_MAX_ATTEMPTS", 5)
+	ConsumerInitialBackoff    = getDuration("CONSUMER_INITIAL_BACKOFF", 500*time.Millisecond)
+	ConsumerMaxBackoff        = getDuration("CONSUMER_MAX_BACKOFF", 30*time.Second)
+	ConsumerDLQSuffix         = getEnv("CONSUMER_DLQ_SUFFIX", ".dlq")
+	ConsumerDedupRetention    = getDuration("CONSUMER_DEDUP_RETENTION", 7*24*time.Hour)
+	ProcessedEventsCollection = getEnv("PROCESSED_EVENTS_COLLECTION", "processed_events")
+	DLQReplayGroup            = getEnv("DLQ_REPLAY_GROUP", "dlq-replay")
+
+	//Outbox Config
+	OutboxCollection     = getEnv("OUTBOX_COLLECTION", "outbox")
+	OutboxBatchSize      = getInt("OUTBOX_BATCH_SIZE", 100)
+	OutboxPollInterval   = getDuration("OUTBOX_POLL_INTERVAL", time.Second)
+	OutboxMaxAttempts    = getInt("OUTBOX_MAX_ATTEMPTS", 20)
+	OutboxInitialBackoff = getDuration("OUTBOX_INITIAL_BACKOFF", time.Second)
+	OutboxMaxBackoff     = getDuration("OUTBOX_MAX_BACKOFF", time.Minute)
+	OutboxRetention      = getDuration("OUTBOX_RETENTION", 24*time.Hour)
+	OutboxLeaseTTL       = getDuration("OUTBOX_LEASE_TTL", 30*time.Second)
+
+	//Order History Config
+	OrderEventsCollection = getEnv("ORDER_EVENTS_COLLECTION", "order_events")
+
+	//Tracing Config
+	ServiceName     = getEnv("SERVICE_NAME", "backend")
+	TracingExporter = getEnv("TRACING_EXPORTER", "none") // otlp, stdout, file or none
+	TracingFile     = getEnv("TRACING_FILE", "traces.json")
+	OTLPEndpoint    = getEnv("OTLP_ENDPOINT", "localhost:4318")
+	OTLPInsecure    = getEnv("OTLP_INSECURE", "true") == "true"
+)
+
+// getEnv returns the value of the environment variable key, or fallback when it is unset
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// getDuration parses the environment variable key as a time.Duration such as "5s",
+// or returns fallback when it is unset or invalid
+func getDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+// getFloat parses the environment variable key as a float64, or returns fallback
+// when it is unset or invalid
+func getFloat(key string, fallback float64) float64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
+// getInt parses the environment variable key as an int, or returns fallback when
+// it is unset or invalid
+func getInt(key string, fallback int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return fallback
+}
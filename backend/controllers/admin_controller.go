@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"backend/config"
+	"backend/services"
+	"backend/stream"
+	"backend/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AdminController serves the operator endpoints mounted under /admin
+type AdminController struct {
+	users        *services.UserService
+	cacheChecker *services.CacheChecker
+	cacheAdmin   *services.CacheAdmin
+}
+
+func NewAdminController(users *services.UserService, products *services.ProductService, orders *services.OrderService, dashboard *services.DashboardService) *AdminController {
+	return &AdminController{
+		users:        users,
+		cacheChecker: services.NewCacheChecker(users, products, orders),
+		cacheAdmin:   services.NewCacheAdmin(users, products, orders, dashboard),
+	}
+}
+
+// GetCacheStats reports the cache namespaces and this instance's hit ratios.
+// Cluster-wide counters are exported on /metrics.
+func (ac *AdminController) GetCacheStats(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"namespaces": ac.cacheAdmin.Namespaces(),
+		"stats":      ac.cacheAdmin.Stats(),
+	})
+}
+
+// InspectCache returns the cached value and TTL of an entity
+func (ac *AdminController) InspectCache(c *fiber.Ctx) error {
+	entry, err := ac.cacheAdmin.Inspect(c.UserContext(), c.Params("namespace"), c.Params("id"))
+	if err != nil {
+		return respondServiceError(c, err, "Failed to inspect cache entry")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(entry)
+}
+
+// PurgeCacheNamespace removes every entry of a namespace
+func (ac *AdminController) PurgeCacheNamespace(c *fiber.Ctx) error {
+	namespace := c.Params("namespace")
+	deleted, err := ac.cacheAdmin.Purge(c.UserContext(), namespace)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to purge cache")
+	}
+
+	utils.LoggerFromContext(c.UserContext()).Info("cache namespace purged", "namespace", namespace, "deleted", deleted)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"deleted": deleted})
+}
+
+// PurgeCachePattern removes the entries matching the pattern query parameter,
+// e.g. ?pattern=product:v1:66a*
+func (ac *AdminController) PurgeCachePattern(c *fiber.Ctx) error {
+	pattern := c.Query("pattern")
+	if pattern == "" {
+		return respondError(c, fiber.StatusBadRequest, "pattern is required", nil)
+	}
+
+	deleted, err := ac.cacheAdmin.PurgePattern(c.UserContext(), pattern)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to purge cache")
+	}
+
+	utils.LoggerFromContext(c.UserContext()).Info("cache keys purged", "pattern", pattern, "deleted", deleted)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"deleted": deleted})
+}
+
+// WarmUpCache preloads the top products and the most recent orders. The
+// products and orders query parameters override the configured counts.
+func (ac *AdminController) WarmUpCache(c *fiber.Ctx) error {
+	if !utils.RedisAvailable() {
+		return respondError(c, fiber.StatusServiceUnavailable, "Cache unavailable", nil)
+	}
+
+	products := c.QueryInt("products", config.CacheWarmUpProducts)
+	orders := c.QueryInt("orders", config.CacheWarmUpOrders)
+	if products < 0 || orders < 0 {
+		return respondError(c, fiber.StatusBadRequest, "products and orders must not be negative", nil)
+	}
+
+	result, err := ac.cacheAdmin.WarmUp(c.UserContext(), int64(products), int64(orders))
+	if err != nil {
+		return respondServiceError(c, err, "Failed to warm up cache")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// CheckCache compares the cached users, products and orders with MongoDB and
+// reports the drift; with ?repair=true drifted entries are evicted or rewritten
+func (ac *AdminController) CheckCache(c *fiber.Ctx) error {
+	if !utils.RedisAvailable() {
+		return respondError(c, fiber.StatusServiceUnavailable, "Cache unavailable", nil)
+	}
+
+	summary, err := ac.cacheChecker.Check(c.UserContext(), c.QueryBool("repair"))
+	if err != nil {
+		return respondServiceError(c, err, "Failed to check cache consistency")
+	}
+
+	utils.LoggerFromContext(c.UserContext()).Info("cache consistency checked",
+		"repair", summary.Repair, "scanned", summary.Scanned, "drifted", summary.Drifted, "repaired", summary.Repaired)
+	return c.Status(fiber.StatusOK).JSON(summary)
+}
+
+// IssueStreamToken issues a token that lets a user subscribe to the changes of
+// their own account and orders on /stream and /ws. The body is
+// {"user_id": "...", "ttl_seconds": 3600}; the TTL defaults to config.StreamTokenTTL.
+func (ac *AdminController) IssueStreamToken(c *fiber.Ctx) error {
+	if config.StreamTokenSecret == "" {
+		return respondError(c, fiber.StatusServiceUnavailable, "Stream tokens are disabled", nil)
+	}
+
+	var body struct {
+		UserID     string `json:"user_id"`
+		TTLSeconds int    `json:"ttl_seconds"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid request body", err)
+	}
+	id, err := primitive.ObjectIDFromHex(body.UserID)
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid user ID", err)
+	}
+	if body.TTLSeconds < 0 {
+		return respondError(c, fiber.StatusBadRequest, "ttl_seconds must not be negative", nil)
+	}
+
+	if _, err := ac.users.GetUser(c.UserContext(), id); err != nil {
+		return respondServiceError(c, err, "Failed to fetch user")
+	}
+
+	ttl := config.StreamTokenTTL
+	if body.TTLSeconds > 0 {
+		ttl = time.Duration(body.TTLSeconds) * time.Second
+	}
+	expires := time.Now().Add(ttl)
+	token := stream.SignToken([]byte(config.StreamTokenSecret), id.Hex(), expires)
+
+	utils.LoggerFromContext(c.UserContext()).Info("stream token issued", "user_id", id.Hex(), "expires_at", expires)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"token": token, "expires_at": expires.UTC()})
+}
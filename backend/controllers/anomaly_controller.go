@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"backend/services"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AnomalyController lists and detects days of unusual order volume or revenue
+type AnomalyController struct {
+	service *services.AnomalyService
+}
+
+func NewAnomalyController(service *services.AnomalyService) *AnomalyController {
+	return &AnomalyController{service: service}
+}
+
+// ListAnomalies returns the flagged days, latest first. ?metric= narrows them
+// to orders or revenue.
+func (ac *AnomalyController) ListAnomalies(c *fiber.Ctx) error {
+	page, err := parsePage(c)
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+
+	anomalies, err := ac.service.ListAnomalies(c.UserContext(), c.Query("metric"), page)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to list anomalies")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(anomalies)
+}
+
+// DetectAnomalies checks the complete days from ?from= to ?to=, read like the
+// statistics endpoints in ?tz=, right away and returns those flagged.
+// ?z_threshold= and ?mad_threshold= override the configured thresholds. The
+// days flagged are only recorded, and reported with events, with ?record=true,
+// which keeps the configured thresholds.
+func (ac *AnomalyController) DetectAnomalies(c *fiber.Ctx) error {
+	loc, err := services.StatsLocation(c.Query("tz"))
+	if err != nil {
+		return respondServiceError(c, err, "Invalid anomaly query")
+	}
+	from, err := parseStatsTime(c.Query("from"), loc, false)
+	if err != nil {
+		return respondServiceError(c, fmt.Errorf("%w: from %v", services.ErrInvalidInput, err), "Invalid anomaly query")
+	}
+	to, err := parseStatsTime(c.Query("to"), loc, true)
+	if err != nil {
+		return respondServiceError(c, fmt.Errorf("%w: to %v", services.ErrInvalidInput, err), "Invalid anomaly query")
+	}
+	query, err := services.NewAnomalyQuery(from, to, c.QueryFloat("z_threshold", 0), c.QueryFloat("mad_threshold", 0), loc, c.QueryBool("record"))
+	if err != nil {
+		return respondServiceError(c, err, "Invalid anomaly query")
+	}
+
+	anomalies, err := ac.service.Detect(c.UserContext(), query)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to detect anomalies")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(anomalies)
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"backend/services"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// DashboardController serves the summary the landing page is drawn from
+type DashboardController struct {
+	service *services.DashboardService
+}
+
+func NewDashboardController(service *services.DashboardService) *DashboardController {
+	return &DashboardController{service: service}
+}
+
+// GetDashboard summarises the current ?period= (day, week, month, the default,
+// quarter or year) in ?tz= so far, or the window ?from= to ?to=, read like the
+// statistics endpoints, and compares it with the period of the same length
+// before it
+func (dc *DashboardController) GetDashboard(c *fiber.Ctx) error {
+	window, err := parseDashboardWindow(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid dashboard query")
+	}
+
+	dashboard, err := dc.service.GetDashboard(c.UserContext(), window)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to get dashboard")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(dashboard)
+}
+
+func parseDashboardWindow(c *fiber.Ctx) (services.DashboardWindow, error) {
+	loc, err := services.StatsLocation(c.Query("tz"))
+	if err != nil {
+		return services.DashboardWindow{}, err
+	}
+	from, err := parseStatsTime(c.Query("from"), loc, false)
+	if err != nil {
+		return services.DashboardWindow{}, fmt.Errorf("%w: from %v", services.ErrInvalidInput, err)
+	}
+	to, err := parseStatsTime(c.Query("to"), loc, true)
+	if err != nil {
+		return services.DashboardWindow{}, fmt.Errorf("%w: to %v", services.ErrInvalidInput, err)
+	}
+	return services.NewDashboardWindow(c.Query("period"), from, to, loc)
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"backend/services"
+	"backend/utils"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// StatusClientClosedRequest is the non-standard status used when the request's
+// context was canceled before the service finished
+const StatusClientClosedRequest = 499
+
+// respondError logs err with the request logger and sends message to the client.
+// The underlying error is never included in the response.
+func respondError(c *fiber.Ctx, status int, message string, err error) error {
+	logger := utils.LoggerFromContext(c.UserContext())
+	if status >= fiber.StatusInternalServerError {
+		logger.Error(message, "status", status, "error", err)
+	} else {
+		logger.Warn(message, "status", status, "error", err)
+	}
+
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// respondServiceError maps a service error to an HTTP status. Errors of a known
+// class carry a client-safe message; anything else is reported as message.
+func respondServiceError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidInput):
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	case errors.Is(err, services.ErrNotFound):
+		return respondError(c, fiber.StatusNotFound, err.Error(), err)
+	case errors.Is(err, services.ErrConflict):
+		return respondError(c, fiber.StatusConflict, err.Error(), err)
+	case errors.Is(err, services.ErrCanceled):
+		return respondError(c, StatusClientClosedRequest, "Request canceled", err)
+	case errors.Is(err, services.ErrTimeout):
+		return respondError(c, fiber.StatusGatewayTimeout, "Request timed out", err)
+	case errors.Is(err, services.ErrUnavailable):
+		return respondError(c, fiber.StatusServiceUnavailable, err.Error(), err)
+	default:
+		return respondError(c, fiber.StatusInternalServerError, message, err)
+	}
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"backend/services"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ForecastController projects order demand for planning stock
+type ForecastController struct {
+	orders *services.OrderService
+}
+
+func NewForecastController(orders *services.OrderService) *ForecastController {
+	return &ForecastController{orders: orders}
+}
+
+// ForecastOrders projects the demand over all products
+func (fc *ForecastController) ForecastOrders(c *fiber.Ctx) error {
+	query, err := parseForecastQuery(c, services.MetricOrders)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid forecast query")
+	}
+
+	forecast, err := fc.orders.ForecastOrders(c.UserContext(), query)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to forecast orders")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(forecast)
+}
+
+// ForecastProduct projects the demand for one product, in units unless
+// ?metric= says otherwise
+func (fc *ForecastController) ForecastProduct(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid ID", err)
+	}
+	query, err := parseForecastQuery(c, services.MetricUnits)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid forecast query")
+	}
+
+	forecast, err := fc.orders.ForecastProduct(c.UserContext(), id, query)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to forecast product")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(forecast)
+}
+
+// parseForecastQuery reads the granularity (day by default), from, to and tz
+// query parameters like the statistics endpoints, bounding the history, plus
+// horizon, metric (orders, units or revenue), model (moving_average or
+// holt_winters), window, confidence, status and exclude_status
+func parseForecastQuery(c *fiber.Ctx, metric string) (services.ForecastQuery, error) {
+	loc, err := services.StatsLocation(c.Query("tz"))
+	if err != nil {
+		return services.ForecastQuery{}, err
+	}
+	from, err := parseStatsTime(c.Query("from"), loc, false)
+	if err != nil {
+		return services.ForecastQuery{}, fmt.Errorf("%w: from %v", services.ErrInvalidInput, err)
+	}
+	to, err := parseStatsTime(c.Query("to"), loc, true)
+	if err != nil {
+		return services.ForecastQuery{}, fmt.Errorf("%w: to %v", services.ErrInvalidInput, err)
+	}
+
+	return services.NewForecastQuery(
+		c.Query("granularity"), from, to, loc,
+		c.QueryInt("horizon", 0),
+		c.Query("metric", metric),
+		c.Query("model"),
+		c.QueryInt("window", 0),
+		c.QueryFloat("confidence", 0),
+		services.StatusFilter{
+			Include: splitList(c.Query("status")),
+			Exclude: splitList(c.Query("exclude_status")),
+		},
+	)
+}
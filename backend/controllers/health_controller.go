@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"backend/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type HealthController struct{}
+
+func NewHealthController() *HealthController {
+	return &HealthController{}
+}
+
+// GetHealth reports the state of MongoDB and Redis. The API is degraded, but still
+// serving, while Redis is down; it is unavailable while MongoDB is down.
+func (hc *HealthController) GetHealth(c *fiber.Ctx) error {
+	status := "ok"
+	code := fiber.StatusOK
+	switch {
+	case !utils.MongoAvailable():
+		status = "unavailable"
+		code = fiber.StatusServiceUnavailable
+	case utils.Degraded():
+		status = "degraded"
+	}
+
+	return c.Status(code).JSON(fiber.Map{
+		"status":   status,
+		"degraded": utils.Degraded(),
+		"dependencies": fiber.Map{
+			"mongodb": upOrDown(utils.MongoAvailable()),
+			"redis":   upOrDown(utils.RedisAvailable()),
+		},
+	})
+}
+
+func upOrDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"backend/services"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LeaderboardController ranks the best-selling products and the biggest
+// customers
+type LeaderboardController struct {
+	orders *services.OrderService
+}
+
+func NewLeaderboardController(orders *services.OrderService) *LeaderboardController {
+	return &LeaderboardController{orders: orders}
+}
+
+// TopProducts ranks products ?by=units (the default) or ?by=revenue
+func (lc *LeaderboardController) TopProducts(c *fiber.Ctx) error {
+	query, err := parseLeaderboardQuery(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid leaderboard query")
+	}
+
+	rankings, err := lc.orders.TopProducts(c.UserContext(), query)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to rank products")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(rankings)
+}
+
+// TopUsers ranks users ?by=orders (the default) or ?by=spend
+func (lc *LeaderboardController) TopUsers(c *fiber.Ctx) error {
+	query, err := parseLeaderboardQuery(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid leaderboard query")
+	}
+
+	rankings, err := lc.orders.TopUsers(c.UserContext(), query)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to rank users")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(rankings)
+}
+
+// parseLeaderboardQuery reads the by, from, to, tz, limit, status and
+// exclude_status query parameters. from and to are read like those of the
+// statistics endpoints.
+func parseLeaderboardQuery(c *fiber.Ctx) (services.LeaderboardQuery, error) {
+	loc, err := services.StatsLocation(c.Query("tz"))
+	if err != nil {
+		return services.LeaderboardQuery{}, err
+	}
+	from, err := parseStatsTime(c.Query("from"), loc, false)
+	if err != nil {
+		return services.LeaderboardQuery{}, fmt.Errorf("%w: from %v", services.ErrInvalidInput, err)
+	}
+	to, err := parseStatsTime(c.Query("to"), loc, true)
+	if err != nil {
+		return services.LeaderboardQuery{}, fmt.Errorf("%w: to %v", services.ErrInvalidInput, err)
+	}
+
+	return services.NewLeaderboardQuery(c.Query("by"), from, to, int64(c.QueryInt("limit", 0)), services.StatusFilter{
+		Include: splitList(c.Query("status")),
+		Exclude: splitList(c.Query("exclude_status")),
+	})
+}
@@ -3,7 +3,7 @@ package controllers
 import (
 	"backend/models"
 	"backend/services"
-	"backend/utils"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,11 +14,9 @@ type OrderController struct {
 	service *services.OrderService
 }
 
-func NewOrderController() *OrderController {
-	// Pass the MongoDB collection to the NewOrderService function
-	orderCollection := utils.MongoDB.Collection("orders")
+func NewOrderController(service *services.OrderService) *OrderController {
 	return &OrderController{
-		service: services.NewOrderService(orderCollection),
+		service: service,
 	}
 }
 
@@ -26,12 +24,12 @@ func (oc *OrderController) CreateOrder(c *fiber.Ctx) error {
 	order := new(models.Order)
 
 	if err := c.BodyParser(order); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		return respondError(c, fiber.StatusBadRequest, "Invalid order data", err)
 	}
 
-	result, err := oc.service.CreateOrder(order)
+	result, err := oc.service.CreateOrder(c.UserContext(), order)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return respondServiceError(c, err, "Failed to create order")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(result)
@@ -44,21 +42,51 @@ func (oc *OrderController) GetOrderById(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
 	}
 
-	order, err := oc.service.GetOrderById(id)
-	if err != nil {
-		if err.Error() == "mongo: no documents in result" {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	// ?as_of=2024-05-01T12:00:00Z returns the order as it was at that time
+	if asOf := c.Query("as_of"); asOf != "" {
+		at, err := time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			return respondError(c, fiber.StatusBadRequest, "as_of must be an RFC 3339 time", err)
+		}
+		order, err := oc.service.GetOrderAsOf(c.UserContext(), id, at)
+		if err != nil {
+			return respondServiceError(c, err, "Failed to get order")
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return c.Status(fiber.StatusOK).JSON(order)
+	}
+
+	order, err := oc.service.GetOrderById(c.UserContext(), id)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to get order")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(order)
 }
 
+// GetOrderEvents returns every change made to an order, oldest first
+func (oc *OrderController) GetOrderEvents(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	orderEvents, err := oc.service.GetOrderEvents(c.UserContext(), id)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to get order events")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(orderEvents)
+}
+
 func (oc *OrderController) GetAllOrders(c *fiber.Ctx) error {
-	orders, err := oc.service.GetAllOrders()
+	page, err := parsePage(c)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+
+	orders, err := oc.service.GetAllOrders(c.UserContext(), page)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to list orders")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(orders)
@@ -73,12 +101,12 @@ func (oc *OrderController) UpdateOrder(c *fiber.Ctx) error {
 
 	var update bson.M
 	if err := c.BodyParser(&update); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		return respondError(c, fiber.StatusBadRequest, "Invalid order data", err)
 	}
 
-	result, err := oc.service.UpdateOrder(id, update)
+	result, err := oc.service.UpdateOrder(c.UserContext(), id, update)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return respondServiceError(c, err, "Failed to update order")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(result)
@@ -91,25 +119,47 @@ func (oc *OrderController) DeleteOrder(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
 	}
 
-	result, err := oc.service.DeleteOrder(id)
+	result, err := oc.service.DeleteOrder(c.UserContext(), id)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return respondServiceError(c, err, "Failed to delete order")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(result)
 }
 
 func (oc *OrderController) GetOrderStatistics(c *fiber.Ctx) error {
+	query, err := parseStatsQuery(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid statistics query")
+	}
+
 	// Call the GetOrderStatistics method from the service
-	statistics, err := oc.service.GetOrderStatistics()
+	statistics, err := oc.service.GetOrderStatistics(c.UserContext(), query)
 	if err != nil {
-		// Return a 500 status code if there's an error
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get order statistics",
-			"details": err.Error(),
-		})
+		return respondServiceError(c, err, "Failed to get order statistics")
 	}
 
 	// Return the statistics with a 200 status code
 	return c.Status(fiber.StatusOK).JSON(statistics)
-}
\ No newline at end of file
+}
+
+// GetRevenueStatistics reports revenue, units, orders and average order value
+// per period. ?status= and ?exclude_status= take comma-separated statuses, e.g.
+// ?exclude_status=cancelled.
+func (oc *OrderController) GetRevenueStatistics(c *fiber.Ctx) error {
+	query, err := parseStatsQuery(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid statistics query")
+	}
+
+	filter := services.StatusFilter{
+		Include: splitList(c.Query("status")),
+		Exclude: splitList(c.Query("exclude_status")),
+	}
+	statistics, err := oc.service.GetRevenueStatistics(c.UserContext(), query, filter)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to get revenue statistics")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(statistics)
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"backend/services"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxPageLimit caps the page size a client may request
+const maxPageLimit = 100
+
+// parsePage reads the optional page and limit query parameters. Without limit the
+// whole list is returned.
+func parsePage(c *fiber.Ctx) (services.Page, error) {
+	page := services.Page{
+		Page:  int64(c.QueryInt("page", 1)),
+		Limit: int64(c.QueryInt("limit", 0)),
+	}
+	if page.Page < 1 || page.Limit < 0 || page.Limit > maxPageLimit {
+		return page, errors.New("page must be at least 1 and limit between 0 (the whole list) and 100")
+	}
+	return page, nil
+}
@@ -3,13 +3,10 @@ package controllers
 import (
 	"backend/models"
 	"backend/services"
-	"backend/utils"
-	"log"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // ProductController struct to hold service instance
@@ -18,48 +15,39 @@ type ProductController struct {
 }
 
 // NewProductController creates a new instance of ProductController
-func NewProductController() *ProductController {
-	// Get MongoDB and Redis clients
-	productCollection := utils.MongoDB.Collection("products")
-	redisClient := utils.RedisClient // Make sure you have this initialized in your utils
-
+func NewProductController(service *services.ProductService) *ProductController {
 	return &ProductController{
-		service: services.NewProductService(productCollection, redisClient),
+		service: service,
 	}
 }
 func (pc *ProductController) CreateProduct(c *fiber.Ctx) error {
 	var product models.Product
 	if err := c.BodyParser(&product); err != nil {
-		log.Printf("Error parsing product data: %v", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid product data"})
+		return respondError(c, fiber.StatusBadRequest, "Invalid product data", err)
 	}
 
 	if product.Name == "" || product.Price <= 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Product name and price must be valid"})
 	}
 
-	result, err := pc.service.CreateProduct(product)
+	result, err := pc.service.CreateProduct(c.UserContext(), product)
 	if err != nil {
-		log.Printf("Error creating product: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create product"})
+		return respondServiceError(c, err, "Failed to create product")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(result)
 }
 
-
 func (pc *ProductController) GetProduct(c *fiber.Ctx) error {
 	idHex := c.Params("id")
 	id, err := primitive.ObjectIDFromHex(idHex)
 	if err != nil {
-		log.Printf("Invalid product ID format: %v", err)
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
+		return respondError(c, fiber.StatusBadRequest, "Invalid product ID", err)
 	}
 
-	product, err := pc.service.GetProduct(id)
+	product, err := pc.service.GetProduct(c.UserContext(), id)
 	if err != nil {
-		log.Printf("Error retrieving product: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to retrieve product")
+		return respondServiceError(c, err, "Failed to retrieve product")
 	}
 
 	if product == nil {
@@ -76,9 +64,9 @@ func (pc *ProductController) DeleteProduct(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
 	}
 
-	result, err := pc.service.DeleteProduct(id)
+	result, err := pc.service.DeleteProduct(c.UserContext(), id)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return respondServiceError(c, err, "Failed to delete product")
 	}
 
 	if result.DeletedCount == 0 {
@@ -97,49 +85,50 @@ func (pc *ProductController) UpdateProduct(c *fiber.Ctx) error {
 
 	var updateData bson.M
 	if err := c.BodyParser(&updateData); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		return respondError(c, fiber.StatusBadRequest, "Invalid product data", err)
 	}
 
-	result, err := pc.service.UpdateProduct(id, updateData)
+	result, err := pc.service.UpdateProduct(c.UserContext(), id, updateData)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to update product")
+		return respondServiceError(c, err, "Failed to update product")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(result)
 }
 
 func (pc *ProductController) GetProductCount(c *fiber.Ctx) error {
-	count, err := pc.service.GetProductCount()
+	count, err := pc.service.GetProductCount(c.UserContext())
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get product count")
+		return respondServiceError(c, err, "Failed to get product count")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"productCount": count})
 }
 
 func (pc *ProductController) ListProduct(c *fiber.Ctx) error {
-	products, err := pc.service.ListProduct()
+	page, err := parsePage(c)
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+
+	products, err := pc.service.ListProduct(c.UserContext(), page)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get products")
+		return respondServiceError(c, err, "Failed to get products")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(products)
 }
 
 func (pc *ProductController) GetProductStatistics(c *fiber.Ctx) error {
-	pipeline := mongo.Pipeline{
-		{{Key: "$group", Value: bson.D{
-			{Key: "id", Value: bson.D{{Key: "$substr", Value: bson.A{"$createdAt", 0, 7}}}}, // Group by month
-			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}, // Count documents
-		}}},
-		{{Key: "$sort", Value: bson.D{{Key: "id", Value: 1}}}}, // Sort by month
+	query, err := parseStatsQuery(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid statistics query")
 	}
 
-	statistics, err := pc.service.AggregateProducts(pipeline)
+	statistics, err := pc.service.GetProductStatistics(c.UserContext(), query)
 	if err != nil {
-		log.Printf("Error aggregating product statistics: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve product statistics"})
+		return respondServiceError(c, err, "Failed to retrieve product statistics")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(statistics)
-}
\ No newline at end of file
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"backend/services"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseStatsQuery reads the optional granularity, from, to and tz query
+// parameters of the statistics endpoints, e.g.
+// ?granularity=day&from=2024-05-01&to=2024-05-31&tz=Asia/Bangkok. from and to
+// are RFC 3339 times or dates in tz; a date to includes that whole day.
+func parseStatsQuery(c *fiber.Ctx) (services.StatsQuery, error) {
+	loc, err := services.StatsLocation(c.Query("tz"))
+	if err != nil {
+		return services.StatsQuery{}, err
+	}
+	from, err := parseStatsTime(c.Query("from"), loc, false)
+	if err != nil {
+		return services.StatsQuery{}, fmt.Errorf("%w: from %v", services.ErrInvalidInput, err)
+	}
+	to, err := parseStatsTime(c.Query("to"), loc, true)
+	if err != nil {
+		return services.StatsQuery{}, fmt.Errorf("%w: to %v", services.ErrInvalidInput, err)
+	}
+	return services.NewStatsQuery(c.Query("granularity"), from, to, loc)
+}
+
+// parseStatsTime parses an RFC 3339 time or a date in loc, returning the end of
+// the date when end is set. An empty value is the zero time.
+func parseStatsTime(value string, loc *time.Location, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be an RFC 3339 time or a date like 2024-05-31")
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// splitList splits a comma-separated query parameter, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
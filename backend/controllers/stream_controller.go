@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"backend/config"
+	"backend/middleware"
+	"backend/services"
+	"backend/stream"
+	"backend/utils"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Locals keys handed from UpgradeWebSocket to WebSocket
+const (
+	localsLastEventID  = "stream_last_event_id"
+	localsPrincipal    = "stream_principal"
+	localsSubscription = "stream_subscription"
+)
+
+// StreamController pushes changes to users, products and orders to live clients
+// over Server-Sent Events and WebSocket
+type StreamController struct{}
+
+func NewStreamController() *StreamController {
+	return &StreamController{}
+}
+
+// Stream serves the changes as Server-Sent Events. The resources, actions and
+// filter query parameters select the changes, e.g.
+// ?resources=orders&actions=created,updated&filter=status:pending. A client
+// reconnecting with Last-Event-ID (or ?last_event_id=) is sent what it missed,
+// or a "reset" event when too much was missed and it should reload.
+func (sc *StreamController) Stream(c *fiber.Ctx) error {
+	subscription, err := stream.ParseSubscription(c.Query("resources"), c.Query("actions"), c.Query("filter"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+	listener, err := services.SubscribeChanges(c.UserContext(), c.Get("Last-Event-ID", c.Query("last_event_id")))
+	if err != nil {
+		return respondServiceError(c, err, "Failed to subscribe to changes")
+	}
+	principal := middleware.SubscriberFrom(c)
+	logger := utils.LoggerFromContext(c.UserContext())
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	// The writer runs after the handler returned, so it must not use the request context
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer listener.Close()
+
+		fmt.Fprint(w, "retry: 3000\n\n")
+		if listener.Gap {
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		}
+		if w.Flush() != nil {
+			return
+		}
+
+		err := pump(listener, principal, func() stream.Subscription { return subscription },
+			func(change stream.Change) error {
+				data, err := json.Marshal(change)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s.%s\ndata: %s\n\n", change.ID, change.Resource, change.Action, data)
+				return w.Flush()
+			},
+			func() error {
+				fmt.Fprint(w, ": ping\n\n")
+				return w.Flush()
+			})
+		logger.Debug("change stream closed", "transport", "sse", "reason", err)
+	})
+	return nil
+}
+
+// UpgradeWebSocket authorises and validates a WebSocket request, so failures
+// are still answered with an HTTP status. The initial subscription and resume
+// ID are taken from the same query parameters as Stream. The connection is
+// subscribed by WebSocket once upgraded; a listener subscribed here would leak
+// when the handshake fails.
+func (sc *StreamController) UpgradeWebSocket(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return respondError(c, fiber.StatusUpgradeRequired, "WebSocket upgrade required", nil)
+	}
+
+	subscription, err := stream.ParseSubscription(c.Query("resources"), c.Query("actions"), c.Query("filter"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+	lastEventID := c.Query("last_event_id")
+	if lastEventID != "" {
+		if _, _, err := stream.ParseID(lastEventID); err != nil {
+			return respondError(c, fiber.StatusBadRequest, "invalid last_event_id", err)
+		}
+	}
+
+	c.Locals(localsLastEventID, lastEventID)
+	c.Locals(localsPrincipal, middleware.SubscriberFrom(c))
+	c.Locals(localsSubscription, subscription)
+	return c.Next()
+}
+
+// wsMessage is a message exchanged over the WebSocket. Clients send
+// {"type": "subscribe", "subscription": {...}} to change what they receive;
+// the server sends "subscribed", "change", "reset" and "error" messages.
+type wsMessage struct {
+	Type         string               `json:"type"`
+	Subscription *stream.Subscription `json:"subscription,omitempty"`
+	Change       *stream.Change       `json:"change,omitempty"`
+	Error        string               `json:"error,omitempty"`
+}
+
+// WebSocket serves the changes to a connection prepared by UpgradeWebSocket
+func (sc *StreamController) WebSocket(conn *websocket.Conn) {
+	principal := conn.Locals(localsPrincipal).(stream.Principal)
+	subscription := conn.Locals(localsSubscription).(stream.Subscription)
+
+	var mu sync.Mutex
+	write := func(msg wsMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(config.StreamHeartbeat))
+		return conn.WriteJSON(msg)
+	}
+
+	listener, err := services.SubscribeChanges(context.Background(), conn.Locals(localsLastEventID).(string))
+	if err != nil {
+		utils.Logger.Warn("failed to subscribe to changes", "transport", "websocket", "error", err)
+		write(wsMessage{Type: "error", Error: "failed to subscribe to changes"})
+		return
+	}
+	defer listener.Close()
+	current := func() stream.Subscription {
+		mu.Lock()
+		defer mu.Unlock()
+		return subscription
+	}
+
+	if listener.Gap && write(wsMessage{Type: "reset"}) != nil {
+		return
+	}
+
+	// Read subscription changes until the client goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var msg wsMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					write(wsMessage{Type: "error", Error: "invalid message"})
+					continue
+				}
+				return
+			}
+			if msg.Type != "subscribe" || msg.Subscription == nil {
+				write(wsMessage{Type: "error", Error: "expected a subscribe message"})
+				continue
+			}
+			if err := msg.Subscription.Validate(); err != nil {
+				write(wsMessage{Type: "error", Error: err.Error()})
+				continue
+			}
+
+			mu.Lock()
+			subscription = *msg.Subscription
+			mu.Unlock()
+			write(wsMessage{Type: "subscribed", Subscription: msg.Subscription})
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-closed:
+			// Unblocks pump, which then returns
+			listener.Close()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = pump(listener, principal, current,
+		func(change stream.Change) error {
+			return write(wsMessage{Type: "change", Change: &change})
+		},
+		func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.StreamHeartbeat))
+		})
+	utils.Logger.Debug("change stream closed", "transport", "websocket", "reason", err)
+}
+
+// pump sends the changes principal may see and subscription selects until a
+// send fails or the listener is closed, sending a heartbeat whenever the
+// stream was idle for config.StreamHeartbeat so dead clients are noticed
+func pump(listener *stream.Listener, principal stream.Principal, subscription func() stream.Subscription,
+	send func(stream.Change) error, heartbeat func() error) error {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), config.StreamHeartbeat)
+		change, err := listener.Next(ctx)
+		cancel()
+
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			err = heartbeat()
+		case err != nil:
+			return err
+		case principal.CanSee(change) && subscription().Matches(change):
+			err = send(change)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
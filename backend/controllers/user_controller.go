@@ -3,24 +3,19 @@ package controllers
 import (
 	"backend/models"
 	"backend/services"
-	"backend/utils"
-	"context"
-	"log"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type UserController struct {
 	service *services.UserService
 }
 
-func NewUserController() *UserController {
-	userCollection := utils.MongoDB.Collection("users")
+func NewUserController(service *services.UserService) *UserController {
 	return &UserController{
-		service: services.NewUserService(userCollection),
+		service: service,
 	}
 }
 
@@ -28,13 +23,12 @@ func NewUserController() *UserController {
 func (uc *UserController) CreateUser(c *fiber.Ctx) error {
 	var user models.User
 	if err := c.BodyParser(&user); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload", "details": err.Error()})
+		return respondError(c, fiber.StatusBadRequest, "Invalid request payload", err)
 	}
 
-	result, err := uc.service.CreateUser(user)
+	result, err := uc.service.CreateUser(c.UserContext(), user)
 	if err != nil {
-		log.Printf("Failed to create user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create user", "details": err.Error()})
+		return respondServiceError(c, err, "Failed to create user")
 	}
 	return c.Status(fiber.StatusCreated).JSON(result)
 }
@@ -47,10 +41,9 @@ func (uc *UserController) GetUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID format"})
 	}
 
-	user, err := uc.service.GetUser(id)
+	user, err := uc.service.GetUser(c.UserContext(), id)
 	if err != nil {
-		log.Printf("Failed to get user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get user", "details": err.Error()})
+		return respondServiceError(c, err, "Failed to get user")
 	}
 
 	if user == nil {
@@ -70,13 +63,12 @@ func (uc *UserController) UpdateUser(c *fiber.Ctx) error {
 
 	var updateData bson.M
 	if err := c.BodyParser(&updateData); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload", "details": err.Error()})
+		return respondError(c, fiber.StatusBadRequest, "Invalid request payload", err)
 	}
 
-	result, err := uc.service.UpdateUser(id, updateData)
+	result, err := uc.service.UpdateUser(c.UserContext(), id, updateData)
 	if err != nil {
-		log.Printf("Failed to update user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update user", "details": err.Error()})
+		return respondServiceError(c, err, "Failed to update user")
 	}
 
 	if result.MatchedCount == 0 {
@@ -94,10 +86,9 @@ func (uc *UserController) DeleteUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID format"})
 	}
 
-	result, err := uc.service.DeleteUser(id)
+	result, err := uc.service.DeleteUser(c.UserContext(), id)
 	if err != nil {
-		log.Printf("Failed to delete user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete user", "details": err.Error()})
+		return respondServiceError(c, err, "Failed to delete user")
 	}
 
 	if result.DeletedCount == 0 {
@@ -109,10 +100,9 @@ func (uc *UserController) DeleteUser(c *fiber.Ctx) error {
 
 // GetUserCount handles requests to get the total number of users.
 func (uc *UserController) GetUserCount(c *fiber.Ctx) error {
-	count, err := uc.service.GetUserCount()
+	count, err := uc.service.GetUserCount(c.UserContext())
 	if err != nil {
-		log.Printf("Failed to get user count: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get user count", "details": err.Error()})
+		return respondServiceError(c, err, "Failed to get user count")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"userCount": count})
@@ -120,35 +110,54 @@ func (uc *UserController) GetUserCount(c *fiber.Ctx) error {
 
 // ListUsers handles requests to list all users.
 func (uc *UserController) ListUsers(c *fiber.Ctx) error {
-	users, err := uc.service.ListUser()
+	page, err := parsePage(c)
 	if err != nil {
-		log.Printf("Failed to list users: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list users", "details": err.Error()})
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+
+	users, err := uc.service.ListUser(c.UserContext(), page)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to list users")
 	}
 	return c.Status(fiber.StatusOK).JSON(users)
 }
 
 // GetUserStatistics provides aggregated data for charts.
 func (uc *UserController) GetUserStatistics(c *fiber.Ctx) error {
-	collection := utils.MongoDB.Collection("users")
+	query, err := parseStatsQuery(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid statistics query")
+	}
 
-	pipeline := mongo.Pipeline{
-		{{Key: "$group", Value: bson.D{{Key: "id", Value: bson.D{{Key: "$substr", Value: bson.A{"$createdAt", 0, 7}}}}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
-		{{Key: "$sort", Value: bson.D{{Key: "id", Value: 1}}}},
+	results, err := uc.service.GetUserStatistics(c.UserContext(), query)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to get user statistics")
 	}
 
-	cursor, err := collection.Aggregate(context.Background(), pipeline)
+	return c.Status(fiber.StatusOK).JSON(results)
+}
+
+// GetUserCohorts reports the retention of users by signup period. It takes the
+// statistics query parameters, granularity defaulting to month, plus ?periods=
+// to follow each cohort for and ?status= and ?exclude_status= to select the
+// orders that count.
+func (uc *UserController) GetUserCohorts(c *fiber.Ctx) error {
+	stats, err := parseStatsQuery(c)
+	if err != nil {
+		return respondServiceError(c, err, "Invalid cohort query")
+	}
+	query, err := services.NewCohortQuery(stats, c.QueryInt("periods", 0), services.StatusFilter{
+		Include: splitList(c.Query("status")),
+		Exclude: splitList(c.Query("exclude_status")),
+	})
 	if err != nil {
-		log.Printf("Aggregation error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Internal Server Error", "details": err.Error()})
+		return respondServiceError(c, err, "Invalid cohort query")
 	}
-	defer cursor.Close(context.Background())
 
-	var results []bson.M
-	if err := cursor.All(context.Background(), &results); err != nil {
-		log.Printf("Cursor error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Internal Server Error", "details": err.Error()})
+	report, err := uc.service.GetCohorts(c.UserContext(), query)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to get user cohorts")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(results)
+	return c.Status(fiber.StatusOK).JSON(report)
 }
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/services"
+	"backend/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WebhookController manages the webhook subscriptions mounted under /webhooks
+type WebhookController struct {
+	service *services.WebhookService
+}
+
+func NewWebhookController(service *services.WebhookService) *WebhookController {
+	return &WebhookController{service: service}
+}
+
+// CreateSubscription registers a URL for the given event types. The body is
+// {"url": "...", "event_types": ["order.created"], "description": "..."}; "*"
+// subscribes to every type. The response carries the signing secret, which is
+// not shown again.
+func (wc *WebhookController) CreateSubscription(c *fiber.Ctx) error {
+	var body struct {
+		URL         string   `json:"url"`
+		EventTypes  []string `json:"event_types"`
+		Description string   `json:"description"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid webhook data", err)
+	}
+
+	subscription, err := wc.service.CreateSubscription(c.UserContext(), models.WebhookSubscription{
+		URL:         body.URL,
+		EventTypes:  body.EventTypes,
+		Description: body.Description,
+	})
+	if err != nil {
+		return respondServiceError(c, err, "Failed to create webhook subscription")
+	}
+
+	utils.LoggerFromContext(c.UserContext()).Info("webhook subscription created",
+		"subscription_id", subscription.ID.Hex(), "url", subscription.URL, "event_types", subscription.EventTypes)
+	return c.Status(fiber.StatusCreated).JSON(subscription)
+}
+
+func (wc *WebhookController) ListSubscriptions(c *fiber.Ctx) error {
+	page, err := parsePage(c)
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+
+	subscriptions, err := wc.service.ListSubscriptions(c.UserContext(), page)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to list webhook subscriptions")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(subscriptions)
+}
+
+func (wc *WebhookController) GetSubscription(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid ID", err)
+	}
+
+	subscription, err := wc.service.GetSubscription(c.UserContext(), id)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to get webhook subscription")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(subscription)
+}
+
+// UpdateSubscription changes the url, event_types, description or active flag
+// of a subscription
+func (wc *WebhookController) UpdateSubscription(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid ID", err)
+	}
+
+	var update services.WebhookSubscriptionUpdate
+	if err := c.BodyParser(&update); err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid webhook data", err)
+	}
+
+	subscription, err := wc.service.UpdateSubscription(c.UserContext(), id, update)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to update webhook subscription")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(subscription)
+}
+
+func (wc *WebhookController) DeleteSubscription(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid ID", err)
+	}
+
+	if err := wc.service.DeleteSubscription(c.UserContext(), id); err != nil {
+		return respondServiceError(c, err, "Failed to delete webhook subscription")
+	}
+
+	utils.LoggerFromContext(c.UserContext()).Info("webhook subscription deleted", "subscription_id", id.Hex())
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Webhook subscription deleted successfully"})
+}
+
+// ListDeliveries returns the delivery log of a subscription, newest first, with
+// every attempt's status code, error and response. ?status= narrows it to
+// pending, delivered or failed deliveries.
+func (wc *WebhookController) ListDeliveries(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid ID", err)
+	}
+	page, err := parsePage(c)
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, err.Error(), err)
+	}
+
+	deliveries, err := wc.service.ListDeliveries(c.UserContext(), id, c.Query("status"), page)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to list webhook deliveries")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(deliveries)
+}
+
+// Redeliver sends a delivery again, e.g. once a failed endpoint is fixed
+func (wc *WebhookController) Redeliver(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid ID", err)
+	}
+	deliveryID, err := primitive.ObjectIDFromHex(c.Params("deliveryId"))
+	if err != nil {
+		return respondError(c, fiber.StatusBadRequest, "Invalid delivery ID", err)
+	}
+
+	delivery, err := wc.service.Redeliver(c.UserContext(), id, deliveryID)
+	if err != nil {
+		return respondServiceError(c, err, "Failed to redeliver webhook")
+	}
+
+	utils.LoggerFromContext(c.UserContext()).Info("webhook redelivery queued",
+		"subscription_id", id.Hex(), "delivery_id", deliveryID.Hex())
+	return c.Status(fiber.StatusAccepted).JSON(delivery)
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+)
+
+// EventBus publishes events and delivers them to consumer groups. Every
+// implementation has the same delivery semantics:
+//
+//   - events are keyed by EntityID and the events of one key are delivered to a
+//     group in the order they were published
+//   - each group receives every event; within a group, an event's offset is
+//     committed only once it was handled or dead-lettered, so an event whose
+//     handler failed, or whose consumer stopped mid-way, is delivered again
+//   - a group that subscribes for the first time starts from the oldest event
+type EventBus interface {
+	Publisher
+	// Consumer creates a consumer for opts.GroupID on opts.Topics, remembering
+	// handled events in processed. Register handlers with Handle, then Start it.
+	Consumer(opts ConsumerOptions, processed *mongo.Collection) *Consumer
+}
+
+// source is where a Consumer reads its messages from
+type source interface {
+	// fetch blocks until the next message for the group is available
+	fetch(ctx context.Context) (kafka.Message, error)
+	// commit marks msg, and every message before it in its partition, handled
+	commit(ctx context.Context, msg kafka.Message) error
+	// deadLetter writes msg to the topic it names
+	deadLetter(ctx context.Context, msg kafka.Message) error
+	close() error
+}
+
+// encode turns events into the messages published for them, routing each event
+// type to the topic topics maps it to and keying it by EntityID
+func encode(ctx context.Context, topics map[string]string, events []Envelope) ([]kafka.Message, error) {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, e := range events {
+		topic, ok := topics[e.Type]
+		if !ok {
+			return nil, fmt.Errorf("events: no topic for event type %q", e.Type)
+		}
+		value, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("events: failed to encode %s: %w", e.Type, err)
+		}
+
+		headers := []kafka.Header{
+			{Key: "event-type", Value: []byte(e.Type)},
+			{Key: "event-id", Value: []byte(e.ID)},
+			{Key: "content-type", Value: []byte("application/json")},
+		}
+		otel.GetTextMapPropagator().Inject(ctx, (*headerCarrier)(&headers))
+
+		messages = append(messages, kafka.Message{
+			Topic:   topic,
+			Key:     []byte(e.EntityID),
+			Value:   value,
+			Headers: headers,
+			Time:    e.Timestamp,
+		})
+	}
+	return messages, nil
+}
+
+// countPublished records the outcome of publishing events
+func countPublished(events []Envelope, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	for _, e := range events {
+		published.WithLabelValues(e.Type, result).Inc()
+	}
+}
@@ -0,0 +1,296 @@
+package events
+
+import (
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers added to messages sent to a dead-letter topic
+const (
+	HeaderDLQTopic     = "dlq-original-topic"
+	HeaderDLQPartition = "dlq-original-partition"
+	HeaderDLQOffset    = "dlq-original-offset"
+	HeaderDLQGroup     = "dlq-consumer-group"
+	HeaderDLQError     = "dlq-error"
+	HeaderDLQAttempts  = "dlq-attempts"
+	HeaderDLQFailedAt  = "dlq-failed-at"
+)
+
+// consumed counts consumed events by consumer group, type and outcome
+var consumed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backend_events_consumed_total",
+	Help: "Consumed events by consumer group, type and result (ok, duplicate, skipped, retried or dead_lettered).",
+}, []string{"group", "type", "result"})
+
+// HandlerFunc handles one event. Returning an error retries the event; wrap it
+// with Permanent to send the event to the dead-letter topic straight away.
+type HandlerFunc func(ctx context.Context, event Envelope) error
+
+// Handle registers fn for eventType on c, decoding each event's payload into P.
+// Payloads that do not decode are dead-lettered without retries.
+func Handle[P any](c *Consumer, eventType string, fn func(ctx context.Context, event Envelope, payload P) error) {
+	c.handlers[eventType] = func(ctx context.Context, event Envelope) error {
+		var payload P
+		if err := event.Decode(&payload); err != nil {
+			return Permanent(fmt.Errorf("invalid %s payload: %w", eventType, err))
+		}
+		return fn(ctx, event, payload)
+	}
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// ConsumerOptions configures a Consumer
+type ConsumerOptions struct {
+	// GroupID names the consumer group; instances of a group share the partitions
+	GroupID string
+	Topics  []string
+	// MaxAttempts is how many times a failing event is handled before it is
+	// dead-lettered
+	MaxAttempts int
+	// InitialBackoff and MaxBackoff bound the wait between attempts
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// DLQSuffix is appended to a topic to name its dead-letter topic
+	DLQSuffix string
+	// DedupRetention is how long handled event IDs are remembered
+	DedupRetention time.Duration
+}
+
+// Consumer reads events as part of a consumer group and dispatches them to the
+// handler registered for their type.
+//
+// Delivery is at-least-once: an offset is committed only once its event was
+// handled or dead-lettered. Handled event IDs are remembered per group in the
+// processed collection, so an event delivered again (after a rebalance, a
+// crash or a replay from the dead-letter topic) is not handled twice. Without a
+// processed collection, as in tests, handled events are not remembered. Events
+// of one entity share a partition and are handled in order.
+//
+// Consumers are created by an EventBus.
+type Consumer struct {
+	opts      ConsumerOptions
+	source    source
+	processed *mongo.Collection
+	handlers  map[string]HandlerFunc
+}
+
+func newConsumer(opts ConsumerOptions, processed *mongo.Collection, source source) *Consumer {
+	return &Consumer{
+		opts:      opts,
+		source:    source,
+		processed: processed,
+		handlers:  map[string]HandlerFunc{},
+	}
+}
+
+// Start consumes until ctx is done, then closes the consumer
+func (c *Consumer) Start(ctx context.Context) {
+	if c.processed != nil {
+		_, err := c.processed.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "processed_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(c.opts.DedupRetention.Seconds())),
+		})
+		if err != nil {
+			utils.Logger.Warn("failed to create processed events index", "error", err)
+		}
+	}
+
+	go func() {
+		defer c.close()
+
+		for {
+			msg, err := c.source.fetch(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				utils.Logger.Warn("failed to fetch event", "group", c.opts.GroupID, "error", err)
+				if !sleep(ctx, c.opts.InitialBackoff) {
+					return
+				}
+				continue
+			}
+
+			if !c.process(ctx, msg) {
+				// Shutting down; the uncommitted message is delivered again
+				return
+			}
+			if err := c.source.commit(ctx, msg); err != nil && ctx.Err() == nil {
+				utils.Logger.Warn("failed to commit event offset", "group", c.opts.GroupID, "topic", msg.Topic,
+					"partition", msg.Partition, "offset", msg.Offset, "error", err)
+			}
+		}
+	}()
+}
+
+// process handles msg, retrying and dead-lettering as needed. It returns false
+// when ctx ended before msg was dealt with.
+func (c *Consumer) process(ctx context.Context, msg kafka.Message) bool {
+	headers := headerCarrier(msg.Headers)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, &headers)
+
+	var event Envelope
+	if err := json.Unmarshal(msg.Value, &event); err != nil {
+		return c.deadLetter(ctx, msg, "unknown", fmt.Errorf("invalid envelope: %w", err), 0)
+	}
+
+	handler, ok := c.handlers[event.Type]
+	if !ok {
+		consumed.WithLabelValues(c.opts.GroupID, event.Type, "skipped").Inc()
+		return true
+	}
+
+	ctx, span := otel.Tracer("backend/events").Start(ctx, "consume "+event.Type, trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	logger := utils.LoggerFromContext(ctx).With("group", c.opts.GroupID, "event_id", event.ID, "type", event.Type)
+
+	if c.handled(ctx, logger, event) {
+		consumed.WithLabelValues(c.opts.GroupID, event.Type, "duplicate").Inc()
+		return true
+	}
+
+	var err error
+	attempts := 0
+	for attempts < c.opts.MaxAttempts {
+		attempts++
+		if err = handler(ctx, event); err == nil {
+			break
+		}
+
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempts == c.opts.MaxAttempts {
+			break
+		}
+		consumed.WithLabelValues(c.opts.GroupID, event.Type, "retried").Inc()
+		wait := backoff(c.opts.InitialBackoff, c.opts.MaxBackoff, attempts)
+		logger.Warn("event handler failed, retrying", "attempt", attempts, "retry_in", wait.String(), "error", err)
+		if !sleep(ctx, wait) {
+			return false
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		return c.deadLetter(ctx, msg, event.Type, err, attempts)
+	}
+
+	c.markHandled(ctx, logger, event)
+	consumed.WithLabelValues(c.opts.GroupID, event.Type, "ok").Inc()
+	return true
+}
+
+// handled reports whether the group already handled event
+func (c *Consumer) handled(ctx context.Context, logger *slog.Logger, event Envelope) bool {
+	if c.processed == nil {
+		return false
+	}
+	err := c.processed.FindOne(ctx, bson.M{"_id": c.dedupKey(event)}).Err()
+	if err != nil && err != mongo.ErrNoDocuments {
+		// Handling a possible duplicate is safer than dropping the event
+		logger.Warn("failed to check for duplicate event", "error", err)
+	}
+	return err == nil
+}
+
+// markHandled remembers that the group handled event
+func (c *Consumer) markHandled(ctx context.Context, logger *slog.Logger, event Envelope) {
+	if c.processed == nil {
+		return
+	}
+	_, err := c.processed.InsertOne(ctx, bson.M{"_id": c.dedupKey(event), "processed_at": time.Now()})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		logger.Warn("failed to record processed event", "error", err)
+	}
+}
+
+func (c *Consumer) dedupKey(event Envelope) string {
+	return c.opts.GroupID + ":" + event.ID
+}
+
+// deadLetter copies msg to its topic's dead-letter topic along with why it
+// failed, retrying until it is written or ctx ends
+func (c *Consumer) deadLetter(ctx context.Context, msg kafka.Message, eventType string, cause error, attempts int) bool {
+	headers := append([]kafka.Header{}, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderDLQTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderDLQPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderDLQOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderDLQGroup, Value: []byte(c.opts.GroupID)},
+		kafka.Header{Key: HeaderDLQError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderDLQAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderDLQFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+	dead := kafka.Message{
+		Topic:   msg.Topic + c.opts.DLQSuffix,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+
+	for failures := 1; ; failures++ {
+		err := c.source.deadLetter(ctx, dead)
+		if err == nil {
+			break
+		}
+		utils.Logger.Error("failed to dead-letter event", "group", c.opts.GroupID, "topic", dead.Topic, "error", err)
+		if !sleep(ctx, backoff(c.opts.InitialBackoff, c.opts.MaxBackoff, failures)) {
+			return false
+		}
+	}
+
+	consumed.WithLabelValues(c.opts.GroupID, eventType, "dead_lettered").Inc()
+	utils.LoggerFromContext(ctx).Error("event dead-lettered", "group", c.opts.GroupID, "type", eventType,
+		"topic", msg.Topic, "offset", msg.Offset, "attempts", attempts, "error", cause)
+	return true
+}
+
+func (c *Consumer) close() {
+	if err := c.source.close(); err != nil {
+		utils.Logger.Warn("failed to close consumer", "group", c.opts.GroupID, "error", err)
+	}
+}
+
+// backoff returns the exponential wait before attempt+1, capped at max
+func backoff(initial, max time.Duration, attempt int) time.Duration {
+	d := initial << min(attempt-1, 16)
+	if d <= 0 || d > max {
+		return max
+	}
+	return d
+}
+
+// sleep waits for d, returning false if ctx ends first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
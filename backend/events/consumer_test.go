@@ -0,0 +1,187 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const testDLQSuffix = ".dlq"
+
+func newTestConsumer(bus *MemoryBus) *Consumer {
+	return bus.Consumer(ConsumerOptions{
+		GroupID:        "g",
+		Topics:         []string{testTopic},
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		DLQSuffix:      testDLQSuffix,
+	}, nil)
+}
+
+// headerValue returns the value of the header key of msg
+func headerValue(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestConsumerProcess(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name string
+		// failures is how many times the handler fails before it succeeds;
+		// -1 fails every time
+		failures  int
+		permanent bool
+		// value replaces the published event when set
+		value []byte
+		// unhandled publishes an event type without a handler
+		unhandled    bool
+		wantCalls    int
+		wantDLQ      bool
+		wantAttempts string
+	}{
+		{name: "handled first time", failures: 0, wantCalls: 1},
+		{name: "retried until handled", failures: 2, wantCalls: 3},
+		{name: "dead-lettered after max attempts", failures: -1, wantCalls: 3, wantDLQ: true, wantAttempts: "3"},
+		{name: "permanent error dead-lettered at once", failures: -1, permanent: true, wantCalls: 1, wantDLQ: true, wantAttempts: "1"},
+		{name: "invalid envelope dead-lettered", value: []byte("{"), wantCalls: 0, wantDLQ: true, wantAttempts: "0"},
+		{name: "invalid payload dead-lettered", value: []byte(`{"type":"TestEvent","payload":{"n":"x"}}`), wantCalls: 0, wantDLQ: true, wantAttempts: "1"},
+		{name: "unknown type skipped", unhandled: true, wantCalls: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := newTestBus(t, 1)
+			consumer := newTestConsumer(bus)
+
+			calls := 0
+			Handle(consumer, testEvent, func(ctx context.Context, event Envelope, payload testPayload) error {
+				calls++
+				if tt.failures < 0 || calls <= tt.failures {
+					if tt.permanent {
+						return Permanent(errFailed)
+					}
+					return errFailed
+				}
+				return nil
+			})
+
+			eventType := testEvent
+			if tt.unhandled {
+				eventType = "Unhandled"
+				bus.topics[eventType] = testTopic
+			}
+			event, err := New(eventType, "a", testPayload{N: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages, err := encode(context.Background(), bus.topics, []Envelope{event})
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := messages[0]
+			if tt.value != nil {
+				msg.Value = tt.value
+			}
+
+			if !consumer.process(context.Background(), msg) {
+				t.Fatal("process = false, want true")
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler calls = %d, want %d", calls, tt.wantCalls)
+			}
+
+			dlq := &memorySource{bus: bus, group: "dlq", topics: []string{testTopic + testDLQSuffix}}
+			if !tt.wantDLQ {
+				assertDrained(t, dlq)
+				return
+			}
+			dead := fetchN(t, dlq, 1)[0]
+			assertDrained(t, dlq)
+			if string(dead.Value) != string(msg.Value) {
+				t.Errorf("dead-lettered value = %s, want %s", dead.Value, msg.Value)
+			}
+			if got := headerValue(dead, HeaderDLQAttempts); got != tt.wantAttempts {
+				t.Errorf("%s = %s, want %s", HeaderDLQAttempts, got, tt.wantAttempts)
+			}
+			if got := headerValue(dead, HeaderDLQTopic); got != testTopic {
+				t.Errorf("%s = %s, want %s", HeaderDLQTopic, got, testTopic)
+			}
+			if got := headerValue(dead, HeaderDLQGroup); got != "g" {
+				t.Errorf("%s = %s, want g", HeaderDLQGroup, got)
+			}
+		})
+	}
+}
+
+func TestConsumerProcessStopsRetryingWhenCanceled(t *testing.T) {
+	bus := newTestBus(t, 1)
+	consumer := newTestConsumer(bus)
+	consumer.opts.InitialBackoff, consumer.opts.MaxBackoff = time.Hour, time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	Handle(consumer, testEvent, func(ctx context.Context, event Envelope, payload testPayload) error {
+		cancel()
+		return errors.New("failed")
+	})
+
+	event, _ := New(testEvent, "a", testPayload{})
+	messages, _ := encode(context.Background(), bus.topics, []Envelope{event})
+	if consumer.process(ctx, messages[0]) {
+		t.Fatal("process = true, want false so the event is not committed")
+	}
+	assertDrained(t, &memorySource{bus: bus, group: "dlq", topics: []string{testTopic + testDLQSuffix}})
+}
+
+func TestConsumerCommitsHandledEvents(t *testing.T) {
+	bus := newTestBus(t, 2)
+	publish(t, bus, "a", "b", "a")
+
+	handled := make(chan int, 3)
+	consumer := newTestConsumer(bus)
+	Handle(consumer, testEvent, func(ctx context.Context, event Envelope, payload testPayload) error {
+		handled <- payload.N
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer.Start(ctx)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of 3 events handled", i)
+		}
+	}
+	cancel()
+
+	// The offset of the last event is committed after its handler returns
+	deadline := time.Now().Add(time.Second)
+	for {
+		bus.mu.Lock()
+		var committed int64
+		for _, offset := range bus.committed("g", testTopic) {
+			committed += offset
+		}
+		bus.mu.Unlock()
+		if committed == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("committed offsets sum to %d, want 3", committed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A new consumer of the group has nothing left to handle
+	assertDrained(t, &memorySource{bus: bus, group: "g", topics: []string{testTopic}})
+}
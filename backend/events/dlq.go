@@ -0,0 +1,91 @@
+package events
+
+import (
+	"backend/utils"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ReplayResult reports what ReplayDLQ did
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+	// Skipped counts messages without an original topic, which cannot be routed
+	Skipped int `json:"skipped"`
+}
+
+// ReplayDLQ republishes the messages of the dead-letter topic dlqTopic to the
+// topics they originally came from, up to limit messages (0 for all). It reads
+// as consumer group group, so a replay resumes where the last one stopped, and
+// returns once no message arrived for idle.
+//
+// Consumers that already handled a replayed event drop it by its ID, so only
+// the groups it failed for handle it again.
+func ReplayDLQ(ctx context.Context, brokers []string, dlqTopic, group string, limit int, idle time.Duration) (ReplayResult, error) {
+	var result ReplayResult
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     brokers,
+		GroupID:     group,
+		Topic:       dlqTopic,
+		StartOffset: kafka.FirstOffset,
+		MaxBytes:    10e6,
+	})
+	defer reader.Close()
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+
+	for limit == 0 || result.Replayed+result.Skipped < limit {
+		fetchCtx, cancel := context.WithTimeout(ctx, idle)
+		msg, err := reader.FetchMessage(fetchCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return result, nil
+		} else if err != nil {
+			return result, fmt.Errorf("failed to read %s: %w", dlqTopic, err)
+		}
+
+		original := header(msg.Headers, HeaderDLQTopic)
+		if original == "" {
+			result.Skipped++
+			utils.Logger.Warn("skipping dead-lettered message without an original topic",
+				"topic", dlqTopic, "partition", msg.Partition, "offset", msg.Offset)
+		} else {
+			replay := kafka.Message{
+				Topic:   original,
+				Key:     msg.Key,
+				Value:   msg.Value,
+				Headers: withoutDLQHeaders(msg.Headers),
+			}
+			if err := writer.WriteMessages(ctx, replay); err != nil {
+				return result, fmt.Errorf("failed to republish to %s: %w", original, err)
+			}
+			result.Replayed++
+		}
+
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			return result, fmt.Errorf("failed to commit %s offset: %w", dlqTopic, err)
+		}
+	}
+	return result, nil
+}
+
+// withoutDLQHeaders drops the headers deadLetter added, keeping the original ones
+func withoutDLQHeaders(headers []kafka.Header) []kafka.Header {
+	kept := make([]kafka.Header, 0, len(headers))
+	for _, h := range headers {
+		if !strings.HasPrefix(h.Key, "dlq-") {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,71 @@
+// Package events defines the domain events the API emits and carries them over
+// an EventBus, backed by Kafka or kept in process.
+//
+// Every event travels in the same versioned JSON envelope. The envelope's
+// Version is the schema version of the payload for its Type, bumped whenever a
+// payload changes incompatibly so consumers can tell old events from new ones.
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types
+const (
+	UserRegistered      = "UserRegistered"
+	ProductCreated      = "ProductCreated"
+	ProductPriceChanged = "ProductPriceChanged"
+	OrderCreated        = "OrderCreated"
+	OrderStatusChanged  = "OrderStatusChanged"
+	// AnomalyDetected reports a day of unusual order volume or revenue
+	AnomalyDetected = "AnomalyDetected"
+)
+
+// Event types consumed from other services
+const (
+	// PaymentSucceeded is published by the payment service once an order is paid
+	PaymentSucceeded = "PaymentSucceeded"
+)
+
+// Envelope wraps the payload of every event
+type Envelope struct {
+	// ID identifies the event; consumers use it to drop duplicates
+	ID string `json:"id"`
+	// Type is one of the event type constants
+	Type string `json:"type"`
+	// Version is the schema version of Payload for Type
+	Version int `json:"version"`
+	// Timestamp is when the change happened
+	Timestamp time.Time `json:"timestamp"`
+	// EntityID is the hex ObjectID of the user, product, order or anomaly the
+	// event is about.
+	// Events are keyed by it, so the events of one entity stay in order.
+	EntityID string `json:"entity_id"`
+	// Payload is the type-specific body, one of the payload structs
+	Payload json.RawMessage `json:"payload"`
+}
+
+// New creates the envelope of an event of eventType about entityID
+func New(eventType, entityID string, payload any) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		ID:        uuid.NewString(),
+		Type:      eventType,
+		Version:   schemaVersions[eventType],
+		Timestamp: time.Now().UTC(),
+		EntityID:  entityID,
+		Payload:   data,
+	}, nil
+}
+
+// Decode unmarshals the payload into v
+func (e Envelope) Decode(v any) error {
+	return json.Unmarshal(e.Payload, v)
+}
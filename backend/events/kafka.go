@@ -0,0 +1,137 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// published counts events handed to the event bus by type and result
+var published = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backend_events_published_total",
+	Help: "Domain events published to the event bus by type and result (ok or error).",
+}, []string{"type", "result"})
+
+// KafkaBus is the EventBus backed by Kafka. Publish returns once every broker
+// in sync has acknowledged the events, which is what lets the Relay mark outbox
+// entries delivered.
+type KafkaBus struct {
+	brokers []string
+	writer  *kafka.Writer
+	topics  map[string]string
+}
+
+// NewKafkaBus creates a bus for brokers, sending each event type to the topic
+// topics maps it to
+func NewKafkaBus(brokers []string, topics map[string]string, batchTimeout time.Duration) *KafkaBus {
+	return &KafkaBus{
+		brokers: brokers,
+		writer: &kafka.Writer{
+			Addr: kafka.TCP(brokers...),
+			// Hashing the key sends every event of an entity to the same partition
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			BatchTimeout:           batchTimeout,
+			AllowAutoTopicCreation: true,
+		},
+		topics: topics,
+	}
+}
+
+// Publish writes events and waits for their acknowledgement
+func (b *KafkaBus) Publish(ctx context.Context, events ...Envelope) error {
+	messages, err := encode(ctx, b.topics, events)
+	if err != nil {
+		return err
+	}
+
+	err = b.writer.WriteMessages(ctx, messages...)
+	countPublished(events, err)
+	return err
+}
+
+// Consumer creates a consumer reading as a Kafka consumer group
+func (b *KafkaBus) Consumer(opts ConsumerOptions, processed *mongo.Collection) *Consumer {
+	return newConsumer(opts, processed, &kafkaSource{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     b.brokers,
+			GroupID:     opts.GroupID,
+			GroupTopics: opts.Topics,
+			StartOffset: kafka.FirstOffset,
+			MaxBytes:    10e6,
+		}),
+		dlq: &kafka.Writer{
+			Addr:                   kafka.TCP(b.brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+	})
+}
+
+// Close flushes queued events and closes the writer
+func (b *KafkaBus) Close() error {
+	return b.writer.Close()
+}
+
+// kafkaSource reads a consumer group's messages from Kafka
+type kafkaSource struct {
+	reader *kafka.Reader
+	dlq    *kafka.Writer
+}
+
+func (s *kafkaSource) fetch(ctx context.Context) (kafka.Message, error) {
+	return s.reader.FetchMessage(ctx)
+}
+
+func (s *kafkaSource) commit(ctx context.Context, msg kafka.Message) error {
+	return s.reader.CommitMessages(ctx, msg)
+}
+
+func (s *kafkaSource) deadLetter(ctx context.Context, msg kafka.Message) error {
+	return s.dlq.WriteMessages(ctx, msg)
+}
+
+func (s *kafkaSource) close() error {
+	return errors.Join(s.reader.Close(), s.dlq.Close())
+}
+
+func header(headers []kafka.Header, key string) string {
+	for _, h := range headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// headerCarrier carries trace context in Kafka headers, so consumers can
+// continue the trace of the request that emitted the event
+type headerCarrier []kafka.Header
+
+func (c *headerCarrier) Get(key string) string {
+	return header(*c, key)
+}
+
+func (c *headerCarrier) Set(key, value string) {
+	for i, h := range *c {
+		if h.Key == key {
+			(*c)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c = append(*c, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c *headerCarrier) Keys() []string {
+	keys := make([]string, len(*c))
+	for i, h := range *c {
+		keys[i] = h.Key
+	}
+	return keys
+}
@@ -0,0 +1,194 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrBusClosed is returned when publishing to a closed MemoryBus
+var ErrBusClosed = errors.New("events: bus closed")
+
+// MemoryBus is the EventBus kept in process, for local development and tests.
+// It mirrors Kafka: each topic is split into partitions chosen by hashing the
+// key, every consumer group tracks a committed offset per partition, and a
+// consumer resumes from the committed offsets, so uncommitted events are
+// delivered again to the next consumer of the group.
+//
+// Events are kept for the life of the process and each group is expected to
+// have a single consumer at a time.
+type MemoryBus struct {
+	topics     map[string]string
+	partitions int
+
+	mu     sync.Mutex
+	logs   map[string][][]kafka.Message
+	groups map[string]map[string][]int64
+	// published is closed and replaced whenever messages are appended
+	published chan struct{}
+	closed    bool
+}
+
+// NewMemoryBus creates an in-process bus with partitions partitions per topic,
+// sending each event type to the topic topics maps it to
+func NewMemoryBus(topics map[string]string, partitions int) *MemoryBus {
+	return &MemoryBus{
+		topics:     topics,
+		partitions: max(partitions, 1),
+		logs:       map[string][][]kafka.Message{},
+		groups:     map[string]map[string][]int64{},
+		published:  make(chan struct{}),
+	}
+}
+
+// Publish appends events to their topics
+func (b *MemoryBus) Publish(ctx context.Context, events ...Envelope) error {
+	messages, err := encode(ctx, b.topics, events)
+	if err == nil {
+		err = b.write(messages...)
+	}
+	countPublished(events, err)
+	return err
+}
+
+// Consumer creates a consumer reading as group opts.GroupID
+func (b *MemoryBus) Consumer(opts ConsumerOptions, processed *mongo.Collection) *Consumer {
+	return newConsumer(opts, processed, &memorySource{bus: b, group: opts.GroupID, topics: opts.Topics})
+}
+
+// Close stops accepting events and wakes up waiting consumers
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.published)
+	}
+	return nil
+}
+
+// write appends messages to the partition their key hashes to
+func (b *MemoryBus) write(messages ...kafka.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+	for _, msg := range messages {
+		log := b.log(msg.Topic)
+		msg.Partition = b.partition(msg.Key)
+		msg.Offset = int64(len(log[msg.Partition]))
+		log[msg.Partition] = append(log[msg.Partition], msg)
+	}
+
+	close(b.published)
+	b.published = make(chan struct{})
+	return nil
+}
+
+// log returns the partitions of topic, creating them on first use. The caller
+// must hold mu.
+func (b *MemoryBus) log(topic string) [][]kafka.Message {
+	log, ok := b.logs[topic]
+	if !ok {
+		log = make([][]kafka.Message, b.partitions)
+		b.logs[topic] = log
+	}
+	return log
+}
+
+// committed returns the next offset of each partition of topic for group. The
+// caller must hold mu.
+func (b *MemoryBus) committed(group, topic string) []int64 {
+	offsets, ok := b.groups[group]
+	if !ok {
+		offsets = map[string][]int64{}
+		b.groups[group] = offsets
+	}
+	if _, ok := offsets[topic]; !ok {
+		// New groups start from the oldest event, as with Kafka's FirstOffset
+		offsets[topic] = make([]int64, b.partitions)
+	}
+	return offsets[topic]
+}
+
+func (b *MemoryBus) partition(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(b.partitions))
+}
+
+// memorySource reads a consumer group's messages from a MemoryBus
+type memorySource struct {
+	bus    *MemoryBus
+	group  string
+	topics []string
+
+	// positions is the next offset to fetch per topic and partition, starting
+	// from the group's committed offsets
+	positions map[string][]int64
+	// next is where the round-robin over topics and partitions resumes
+	next int
+}
+
+func (s *memorySource) fetch(ctx context.Context) (kafka.Message, error) {
+	for {
+		s.bus.mu.Lock()
+		if s.positions == nil {
+			s.positions = map[string][]int64{}
+			for _, topic := range s.topics {
+				s.positions[topic] = append([]int64{}, s.bus.committed(s.group, topic)...)
+			}
+		}
+
+		// Take turns between partitions so one busy key does not starve the others
+		slots := len(s.topics) * s.bus.partitions
+		for i := 0; i < slots; i++ {
+			slot := (s.next + i) % slots
+			topic, partition := s.topics[slot/s.bus.partitions], slot%s.bus.partitions
+			log := s.bus.log(topic)[partition]
+			if offset := s.positions[topic][partition]; offset < int64(len(log)) {
+				s.positions[topic][partition]++
+				s.next = slot + 1
+				msg := log[offset]
+				s.bus.mu.Unlock()
+				return msg, nil
+			}
+		}
+
+		published, closed := s.bus.published, s.bus.closed
+		s.bus.mu.Unlock()
+		if closed {
+			return kafka.Message{}, ErrBusClosed
+		}
+
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-published:
+		}
+	}
+}
+
+func (s *memorySource) commit(_ context.Context, msg kafka.Message) error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	offsets := s.bus.committed(s.group, msg.Topic)
+	offsets[msg.Partition] = max(offsets[msg.Partition], msg.Offset+1)
+	return nil
+}
+
+func (s *memorySource) deadLetter(_ context.Context, msg kafka.Message) error {
+	return s.bus.write(msg)
+}
+
+func (s *memorySource) close() error {
+	return nil
+}
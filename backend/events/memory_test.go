@@ -0,0 +1,225 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	testEvent = "TestEvent"
+	testTopic = "test"
+)
+
+// testPayload is the payload of the events the tests publish
+type testPayload struct {
+	N int `json:"n"`
+}
+
+func newTestBus(t *testing.T, partitions int) *MemoryBus {
+	t.Helper()
+	bus := NewMemoryBus(map[string]string{testEvent: testTopic}, partitions)
+	t.Cleanup(func() { bus.Close() })
+	return bus
+}
+
+// publish publishes one event per key, in order, with N counting up from 0
+func publish(t *testing.T, bus *MemoryBus, keys ...string) {
+	t.Helper()
+	for i, key := range keys {
+		event, err := New(testEvent, key, testPayload{N: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bus.Publish(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fetchN fetches n messages from source, failing the test if they do not arrive
+func fetchN(t *testing.T, source *memorySource, n int) []kafka.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	messages := make([]kafka.Message, n)
+	for i := range messages {
+		msg, err := source.fetch(ctx)
+		if err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+		messages[i] = msg
+	}
+	return messages
+}
+
+// payloadN decodes the N of the event in msg
+func payloadN(t *testing.T, msg kafka.Message) int {
+	t.Helper()
+	var event Envelope
+	if err := json.Unmarshal(msg.Value, &event); err != nil {
+		t.Fatal(err)
+	}
+	var payload testPayload
+	if err := event.Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload.N
+}
+
+// assertDrained fails the test if source has another message
+func assertDrained(t *testing.T, source *memorySource) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if msg, err := source.fetch(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("fetch = offset %d, %v; want nothing left", msg.Offset, err)
+	}
+}
+
+func TestMemorySourceResumesFromCommittedOffsets(t *testing.T) {
+	tests := []struct {
+		name string
+		// fetched is how many of the five events the first consumer fetches,
+		// and committed how many of those it commits, in order
+		fetched   int
+		committed int
+		// want are the events the next consumer of the group fetches
+		want []int
+	}{
+		{name: "new group starts at the oldest event", fetched: 0, committed: 0, want: []int{0, 1, 2, 3, 4}},
+		{name: "committed events are not delivered again", fetched: 5, committed: 5, want: nil},
+		{name: "uncommitted events are delivered again", fetched: 4, committed: 2, want: []int{2, 3, 4}},
+		{name: "events not fetched yet come next", fetched: 3, committed: 3, want: []int{3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := newTestBus(t, 4)
+			// One key, so every event lands in one partition, in order
+			publish(t, bus, "a", "a", "a", "a", "a")
+
+			first := &memorySource{bus: bus, group: "g", topics: []string{testTopic}}
+			for _, msg := range fetchN(t, first, tt.fetched)[:tt.committed] {
+				if err := first.commit(context.Background(), msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			next := &memorySource{bus: bus, group: "g", topics: []string{testTopic}}
+			for i, msg := range fetchN(t, next, len(tt.want)) {
+				if got := payloadN(t, msg); got != tt.want[i] {
+					t.Errorf("event %d = %d, want %d", i, got, tt.want[i])
+				}
+			}
+			assertDrained(t, next)
+
+			// Other groups keep their own offsets
+			other := &memorySource{bus: bus, group: "other", topics: []string{testTopic}}
+			fetchN(t, other, 5)
+			assertDrained(t, other)
+		})
+	}
+}
+
+func TestMemorySourceCommitKeepsHighestOffset(t *testing.T) {
+	bus := newTestBus(t, 1)
+	publish(t, bus, "a", "a", "a")
+
+	source := &memorySource{bus: bus, group: "g", topics: []string{testTopic}}
+	messages := fetchN(t, source, 3)
+	// A late commit of an earlier offset must not rewind the group
+	for _, i := range []int{2, 0} {
+		if err := source.commit(context.Background(), messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertDrained(t, &memorySource{bus: bus, group: "g", topics: []string{testTopic}})
+}
+
+func TestMemoryBusPartitionsByKey(t *testing.T) {
+	bus := newTestBus(t, 8)
+	keys := []string{"a", "b", "a", "c", "b", "a"}
+	publish(t, bus, keys...)
+
+	source := &memorySource{bus: bus, group: "g", topics: []string{testTopic}}
+	partitions := map[string]int{}
+	last := map[string]int{}
+	for _, msg := range fetchN(t, source, len(keys)) {
+		key, n := string(msg.Key), payloadN(t, msg)
+		if p, ok := partitions[key]; ok && p != msg.Partition {
+			t.Errorf("key %s in partitions %d and %d", key, p, msg.Partition)
+		}
+		partitions[key] = msg.Partition
+		// Events of one key arrive in the order they were published
+		if prev, ok := last[key]; ok && prev > n {
+			t.Errorf("key %s: event %d after %d", key, n, prev)
+		}
+		last[key] = n
+	}
+	assertDrained(t, source)
+}
+
+func TestMemorySourceFetch(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(bus *MemoryBus, cancel context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name:    "closed bus",
+			prepare: func(bus *MemoryBus, _ context.CancelFunc) { bus.Close() },
+			wantErr: ErrBusClosed,
+		},
+		{
+			name:    "canceled context",
+			prepare: func(_ *MemoryBus, cancel context.CancelFunc) { cancel() },
+			wantErr: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := newTestBus(t, 1)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tt.prepare(bus, cancel)
+
+			source := &memorySource{bus: bus, group: "g", topics: []string{testTopic}}
+			if _, err := source.fetch(ctx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("fetch error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemorySourceWakesOnPublish(t *testing.T) {
+	bus := newTestBus(t, 1)
+	source := &memorySource{bus: bus, group: "g", topics: []string{testTopic}}
+
+	fetched := make(chan kafka.Message, 1)
+	go func() {
+		msg, err := source.fetch(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		fetched <- msg
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	publish(t, bus, "a")
+	select {
+	case msg := <-fetched:
+		if got := payloadN(t, msg); got != 0 {
+			t.Errorf("event = %d, want 0", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fetch did not return after publish")
+	}
+}
@@ -0,0 +1,74 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Outbox entry states
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	// StatusFailed marks an entry the relay gave up on after its maximum attempts
+	StatusFailed = "failed"
+)
+
+// OutboxEntry is an event waiting in, or delivered from, the outbox collection
+type OutboxEntry struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Event       Envelope           `bson:"event"`
+	Status      string             `bson:"status"`
+	Attempts    int                `bson:"attempts"`
+	LastError   string             `bson:"last_error,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	DeliveredAt *time.Time         `bson:"delivered_at,omitempty"`
+}
+
+// Outbox stores events in MongoDB next to the writes that caused them. Add them
+// with a transaction's session context and the events are committed, or
+// discarded, together with the write; the Relay publishes them afterwards.
+type Outbox struct {
+	collection *mongo.Collection
+}
+
+// NewOutbox creates an Outbox stored in collection
+func NewOutbox(collection *mongo.Collection) *Outbox {
+	return &Outbox{collection: collection}
+}
+
+// Add appends events to the outbox. Entries are relayed in _id order, which is
+// the order they were added in.
+func (o *Outbox) Add(ctx context.Context, events ...Envelope) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	docs := make([]any, len(events))
+	for i, e := range events {
+		docs[i] = OutboxEntry{
+			ID:        primitive.NewObjectID(),
+			Event:     e,
+			Status:    StatusPending,
+			CreatedAt: now,
+		}
+	}
+	_, err := o.collection.InsertMany(ctx, docs)
+	return err
+}
+
+// pending returns up to limit pending entries, oldest first
+func (o *Outbox) pending(ctx context.Context, limit int64) ([]OutboxEntry, error) {
+	cursor, err := o.collection.Find(ctx, bson.M{"status": StatusPending},
+		findOldest().SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	var entries []OutboxEntry
+	err = cursor.All(ctx, &entries)
+	return entries, err
+}
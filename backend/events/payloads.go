@@ -0,0 +1,68 @@
+package events
+
+// schemaVersions is the current payload schema version of each event type
+var schemaVersions = map[string]int{
+	UserRegistered:      2,
+	ProductCreated:      1,
+	ProductPriceChanged: 1,
+	OrderCreated:        1,
+	OrderStatusChanged:  1,
+	AnomalyDetected:     1,
+}
+
+// UserRegisteredPayload is the payload of UserRegistered. It carries no
+// personal data, which would reach every consumer and webhook subscriber;
+// consumers look the user up by ID. Version 1 also carried the name and email.
+type UserRegisteredPayload struct {
+	UserID string `json:"user_id"`
+}
+
+// ProductCreatedPayload is the payload of ProductCreated
+type ProductCreatedPayload struct {
+	ProductID string  `json:"product_id"`
+	Name      string  `json:"name"`
+	Price     float64 `json:"price"`
+}
+
+// ProductPriceChangedPayload is the payload of ProductPriceChanged
+type ProductPriceChangedPayload struct {
+	ProductID string  `json:"product_id"`
+	OldPrice  float64 `json:"old_price"`
+	NewPrice  float64 `json:"new_price"`
+}
+
+// OrderCreatedPayload is the payload of OrderCreated
+type OrderCreatedPayload struct {
+	OrderID   string `json:"order_id"`
+	UserID    string `json:"user_id"`
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Status    string `json:"status"`
+}
+
+// OrderStatusChangedPayload is the payload of OrderStatusChanged
+type OrderStatusChangedPayload struct {
+	OrderID   string `json:"order_id"`
+	OldStatus string `json:"old_status"`
+	NewStatus string `json:"new_status"`
+}
+
+// AnomalyDetectedPayload is the payload of AnomalyDetected
+type AnomalyDetectedPayload struct {
+	AnomalyID      string   `json:"anomaly_id"`
+	Metric         string   `json:"metric"`
+	Day            string   `json:"day"`
+	Timezone       string   `json:"timezone"`
+	Value          float64  `json:"value"`
+	BaselineMedian float64  `json:"baseline_median"`
+	ZScore         *float64 `json:"z_score"`
+	MADScore       *float64 `json:"mad_score"`
+	Direction      string   `json:"direction"`
+}
+
+// PaymentSucceededPayload is the payload of PaymentSucceeded
+type PaymentSucceededPayload struct {
+	PaymentID string  `json:"payment_id"`
+	OrderID   string  `json:"order_id"`
+	Amount    float64 `json:"amount"`
+}
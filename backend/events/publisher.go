@@ -0,0 +1,38 @@
+package events
+
+import (
+	"context"
+	"sort"
+)
+
+// Publisher delivers events to the broker
+type Publisher interface {
+	// Publish sends events, keeping the order of events with the same EntityID
+	Publish(ctx context.Context, events ...Envelope) error
+	// Close flushes pending events and releases the connection
+	Close() error
+}
+
+// Topics routes each event type to the topic of its entity, so that every event
+// of one entity lands in the same topic and, keyed by EntityID, the same partition
+func Topics(users, products, orders string) map[string]string {
+	return map[string]string{
+		UserRegistered:      users,
+		ProductCreated:      products,
+		ProductPriceChanged: products,
+		OrderCreated:        orders,
+		OrderStatusChanged:  orders,
+		// Anomalies are about order volume
+		AnomalyDetected: orders,
+	}
+}
+
+// Types returns the event types the API emits, sorted
+func Types() []string {
+	types := make([]string, 0, len(schemaVersions))
+	for t := range schemaVersions {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
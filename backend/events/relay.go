@@ -0,0 +1,277 @@
+package events
+
+import (
+	"backend/utils"
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// relayLeaseID names the lease document that elects the instance running the relay
+const relayLeaseID = "outbox-relay"
+
+var (
+	outboxRelayed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_outbox_relayed_total",
+		Help: "Outbox entries published to the broker.",
+	})
+	outboxRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_outbox_publish_failures_total",
+		Help: "Failed attempts to publish a batch of outbox entries.",
+	})
+	outboxFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_outbox_failed_total",
+		Help: "Outbox entries given up on after their maximum attempts.",
+	})
+	outboxPruned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_outbox_pruned_total",
+		Help: "Delivered outbox entries deleted after their retention.",
+	})
+	outboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backend_outbox_pending",
+		Help: "Outbox entries waiting to be published.",
+	})
+	outboxLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backend_outbox_oldest_pending_age_seconds",
+		Help: "Age of the oldest outbox entry waiting to be published.",
+	})
+)
+
+// RelayOptions configures a Relay
+type RelayOptions struct {
+	// BatchSize is how many entries are published at once
+	BatchSize int64
+	// PollInterval is how often the outbox is checked when it was last empty
+	PollInterval time.Duration
+	// MaxAttempts is how many times an entry is tried before it is marked failed
+	MaxAttempts int
+	// InitialBackoff and MaxBackoff bound the wait between failed attempts
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Retention is how long delivered entries are kept before they are pruned
+	Retention time.Duration
+	// LeaseTTL is how long the elected instance keeps the relay without renewing
+	LeaseTTL time.Duration
+}
+
+// Relay publishes outbox entries to the broker, oldest first, with at-least-once
+// delivery: an entry is marked delivered only after the broker acknowledged
+// it, so a crash in between publishes it again. Consumers drop duplicates by
+// event ID.
+//
+// A failed batch is retried as a whole, with backoff, before anything newer is
+// published, so the events of an entity keep their order while they are
+// retried. Entries still failing after MaxAttempts are marked failed and
+// skipped, and the events after them published, so an entity's later events
+// may reach consumers without an earlier one; failed entries stay in the
+// outbox for inspection. Only one instance relays at a time, elected through a
+// lease in the leases collection.
+type Relay struct {
+	outbox    *Outbox
+	leases    *mongo.Collection
+	publisher Publisher
+	opts      RelayOptions
+	owner     string
+
+	failures int
+}
+
+// NewRelay creates a Relay publishing the entries of outbox with publisher
+func NewRelay(outbox *Outbox, leases *mongo.Collection, publisher Publisher, opts RelayOptions) *Relay {
+	return &Relay{
+		outbox:    outbox,
+		leases:    leases,
+		publisher: publisher,
+		opts:      opts,
+		owner:     primitive.NewObjectID().Hex(),
+	}
+}
+
+// Start ensures the outbox indexes and relays entries until ctx is done
+func (r *Relay) Start(ctx context.Context) {
+	_, err := r.outbox.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		utils.Logger.Warn("failed to create outbox index", "error", err)
+	}
+
+	go r.run(ctx)
+}
+
+func (r *Relay) run(ctx context.Context) {
+	lastPrune := time.Time{}
+
+	for {
+		wait := r.opts.PollInterval
+
+		leader, err := r.acquireLease(ctx)
+		if err != nil && ctx.Err() == nil {
+			utils.Logger.Warn("failed to acquire outbox relay lease", "error", err)
+		}
+		if leader {
+			full, err := r.relayBatch(ctx)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				r.failures++
+				outboxRetries.Inc()
+				wait = r.backoff()
+				utils.Logger.Warn("failed to relay outbox entries", "error", err, "retry_in", wait.String())
+			case err == nil:
+				r.failures = 0
+				if full {
+					// More entries are waiting
+					wait = 0
+				}
+			}
+
+			if time.Since(lastPrune) > r.opts.Retention/10 {
+				r.prune(ctx)
+				lastPrune = time.Now()
+			}
+			r.updateGauges(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// relayBatch publishes the oldest pending entries. full reports whether the
+// batch was full, i.e. more entries may be waiting.
+func (r *Relay) relayBatch(ctx context.Context) (full bool, err error) {
+	entries, err := r.outbox.pending(ctx, r.opts.BatchSize)
+	if err != nil || len(entries) == 0 {
+		return false, err
+	}
+
+	ids := make([]primitive.ObjectID, len(entries))
+	envelopes := make([]Envelope, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+		envelopes[i] = e.Event
+	}
+
+	if err := r.publisher.Publish(ctx, envelopes...); err != nil {
+		r.recordFailure(ctx, entries, err)
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	_, err = r.outbox.collection.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{"$set": bson.M{"status": StatusDelivered, "delivered_at": now}, "$inc": bson.M{"attempts": 1}})
+	if err != nil {
+		// The entries are published again on the next pass
+		return false, fmt.Errorf("failed to mark outbox entries delivered: %w", err)
+	}
+
+	outboxRelayed.Add(float64(len(entries)))
+	return int64(len(entries)) == r.opts.BatchSize, nil
+}
+
+// recordFailure counts the attempt on every entry of the batch and gives up on
+// those that reached MaxAttempts
+func (r *Relay) recordFailure(ctx context.Context, entries []OutboxEntry, cause error) {
+	var retry, failed []primitive.ObjectID
+	for _, e := range entries {
+		if e.Attempts+1 >= r.opts.MaxAttempts {
+			failed = append(failed, e.ID)
+			utils.Logger.Error("giving up on outbox entry", "event_id", e.Event.ID, "type", e.Event.Type,
+				"attempts", e.Attempts+1, "error", cause)
+		} else {
+			retry = append(retry, e.ID)
+		}
+	}
+
+	set := func(ids []primitive.ObjectID, status string) {
+		if len(ids) == 0 {
+			return
+		}
+		_, err := r.outbox.collection.UpdateMany(ctx,
+			bson.M{"_id": bson.M{"$in": ids}},
+			bson.M{"$set": bson.M{"status": status, "last_error": cause.Error()}, "$inc": bson.M{"attempts": 1}})
+		if err != nil {
+			utils.Logger.Warn("failed to record outbox attempt", "error", err)
+		}
+	}
+	set(retry, StatusPending)
+	set(failed, StatusFailed)
+	outboxFailed.Add(float64(len(failed)))
+}
+
+// backoff returns the wait before the next attempt, growing exponentially with
+// consecutive failures, with jitter
+func (r *Relay) backoff() time.Duration {
+	d := backoff(r.opts.InitialBackoff, r.opts.MaxBackoff, r.failures)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// prune deletes entries delivered more than Retention ago
+func (r *Relay) prune(ctx context.Context) {
+	cutoff := time.Now().Add(-r.opts.Retention)
+	result, err := r.outbox.collection.DeleteMany(ctx, bson.M{
+		"status":       StatusDelivered,
+		"delivered_at": bson.M{"$lt": cutoff},
+	})
+	if err != nil {
+		utils.Logger.Warn("failed to prune outbox", "error", err)
+		return
+	}
+	if result.DeletedCount > 0 {
+		outboxPruned.Add(float64(result.DeletedCount))
+		utils.Logger.Info("pruned outbox", "deleted", result.DeletedCount)
+	}
+}
+
+func (r *Relay) updateGauges(ctx context.Context) {
+	pending, err := r.outbox.collection.CountDocuments(ctx, bson.M{"status": StatusPending})
+	if err != nil {
+		return
+	}
+	outboxPending.Set(float64(pending))
+
+	var oldest OutboxEntry
+	err = r.outbox.collection.FindOne(ctx, bson.M{"status": StatusPending}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})).Decode(&oldest)
+	if err == nil {
+		outboxLag.Set(time.Since(oldest.CreatedAt).Seconds())
+	} else {
+		outboxLag.Set(0)
+	}
+}
+
+// acquireLease takes or renews the relay lease. The upsert fails with a
+// duplicate key error while another instance holds an unexpired lease.
+func (r *Relay) acquireLease(ctx context.Context) (bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id": relayLeaseID,
+		"$or": bson.A{
+			bson.M{"owner": r.owner},
+			bson.M{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"owner": r.owner, "expires_at": now.Add(r.opts.LeaseTTL)}}
+
+	_, err := r.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// findOldest sorts entries in the order they were added
+func findOldest() *options.FindOptions {
+	return options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+}
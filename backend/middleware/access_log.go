@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"backend/utils"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AccessLog writes one structured line per request with the matched route,
+// response status, latency and caller. It must run after RequestID and Tracing
+// so that the line carries both IDs.
+func AccessLog() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			status = fiberErr.Code
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= fiber.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= fiber.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		utils.LoggerFromContext(c.UserContext()).LogAttrs(c.UserContext(), level, "request completed",
+			slog.String("method", c.Method()),
+			slog.String("route", c.Route().Path),
+			slog.String("path", c.Path()),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Group("caller",
+				slog.String("ip", c.IP()),
+				slog.String("user_agent", c.Get(fiber.HeaderUserAgent)),
+			),
+		)
+
+		return err
+	}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"backend/config"
+	"backend/utils"
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AdminOnly admits requests carrying "Authorization: Bearer <config.AdminToken>".
+// Admin routes answer 404 while no token is configured, so they are never open
+// by accident.
+func AdminOnly() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if config.AdminToken == "" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Not found"})
+		}
+
+		token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok || !isAdminToken(token) {
+			utils.LoggerFromContext(c.UserContext()).Warn("admin request rejected", "path", c.Path())
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		return c.Next()
+	}
+}
+
+// isAdminToken reports whether token is the configured admin token
+func isAdminToken(token string) bool {
+	return config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"backend/config"
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequestContext bounds every request with config.RequestTimeout and cancels its
+// user context when the handler returns or the server shuts down. fasthttp does
+// not report client disconnects, so the deadline is what stops abandoned work.
+func RequestContext() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), config.RequestTimeout)
+		defer cancel()
+
+		stop := context.AfterFunc(c.Context(), cancel)
+		defer stop()
+
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
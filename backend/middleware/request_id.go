@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"backend/utils"
+	"regexp"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is the header used to accept and return the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits client-supplied IDs to a safe length and character set
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,128}$`)
+
+// RequestID accepts the caller's X-Request-ID or generates a new one, echoes it in
+// the response and stores a logger tagged with it in the request's user context.
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		requestID := c.Get(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		c.Locals("requestId", requestID)
+		c.Set(RequestIDHeader, requestID)
+
+		logger := utils.Logger.With("request_id", requestID)
+		c.SetUserContext(utils.WithLogger(c.UserContext(), logger))
+
+		return c.Next()
+	}
+}
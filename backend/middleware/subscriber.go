@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"backend/config"
+	"backend/stream"
+	"backend/utils"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// subscriberKey is the Locals key the subscriber's principal is stored under
+const subscriberKey = "subscriber"
+
+// Subscriber identifies who is opening a change stream and rejects anonymous
+// clients. The token is the admin token or one issued by SignToken, sent as
+// "Authorization: Bearer <token>" or, since browsers cannot set headers on
+// EventSource and WebSocket requests, as the access_token query parameter.
+func Subscriber() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok {
+			token = c.Query("access_token")
+		}
+
+		var principal stream.Principal
+		switch {
+		case token == "":
+		case isAdminToken(token):
+			principal.Admin = true
+		case config.StreamTokenSecret != "":
+			principal.UserID, _ = stream.VerifyToken([]byte(config.StreamTokenSecret), token, time.Now())
+		}
+
+		if !principal.Admin && principal.UserID == "" {
+			utils.LoggerFromContext(c.UserContext()).Warn("subscriber rejected", "path", c.Path())
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		c.Locals(subscriberKey, principal)
+		return c.Next()
+	}
+}
+
+// SubscriberFrom returns the principal stored by Subscriber
+func SubscriberFrom(c *fiber.Ctx) stream.Principal {
+	principal, _ := c.Locals(subscriberKey).(stream.Principal)
+	return principal
+}
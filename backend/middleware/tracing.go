@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fiberHeaderCarrier adapts the Fiber request headers to a propagation.TextMapCarrier
+type fiberHeaderCarrier struct {
+	c *fiber.Ctx
+}
+
+func (fc fiberHeaderCarrier) Get(key string) string {
+	return fc.c.Get(key)
+}
+
+func (fc fiberHeaderCarrier) Set(key, value string) {
+	fc.c.Request().Header.Set(key, value)
+}
+
+func (fc fiberHeaderCarrier) Keys() []string {
+	keys := make([]string, 0)
+	fc.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+var _ propagation.TextMapCarrier = fiberHeaderCarrier{}
+
+// Tracing starts a server span for every request, continuing any trace passed in
+// the W3C traceparent header, and stores it in the request's user context so that
+// services and database clients create child spans.
+func Tracing() fiber.Handler {
+	tracer := otel.Tracer("backend/http")
+
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), fiberHeaderCarrier{c})
+		ctx, span := tracer.Start(ctx, c.Method()+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Method()),
+				semconv.URLPath(c.Path()),
+				semconv.ClientAddress(c.IP()),
+			),
+		)
+		defer span.End()
+
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		// The matched route is only known once the router has run
+		route := c.Route().Path
+		span.SetName(c.Method() + " " + route)
+
+		status := c.Response().StatusCode()
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			status = fiberErr.Code
+		}
+		span.SetAttributes(
+			semconv.HTTPRoute(route),
+			semconv.HTTPResponseStatusCode(status),
+		)
+		if err != nil {
+			span.RecordError(err)
+		}
+		if status >= fiber.StatusInternalServerError || err != nil {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+		if span.SpanContext().HasTraceID() {
+			c.Set("X-Trace-ID", span.SpanContext().TraceID().String())
+		}
+
+		return err
+	}
+}
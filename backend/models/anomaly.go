@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Anomaly metrics
+const (
+	AnomalyOrders  = "orders"
+	AnomalyRevenue = "revenue"
+)
+
+// Anomaly directions
+const (
+	AnomalySpike = "spike"
+	AnomalyDrop  = "drop"
+)
+
+// Anomaly is a day whose order count or revenue strayed from the days before
+// it. A day is flagged at most once per metric and time zone.
+type Anomaly struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Metric string             `json:"metric" bson:"metric"`
+	// Day labels the day, e.g. 2024-05-01, in Timezone
+	Day      string    `json:"day" bson:"day"`
+	Timezone string    `json:"timezone" bson:"timezone"`
+	Start    time.Time `json:"start" bson:"start"`
+	Value    float64   `json:"value" bson:"value"`
+	// BaselineDays is how many earlier days Value was compared with
+	BaselineDays   int     `json:"baseline_days" bson:"baseline_days"`
+	BaselineMean   float64 `json:"baseline_mean" bson:"baseline_mean"`
+	BaselineMedian float64 `json:"baseline_median" bson:"baseline_median"`
+	// ZScore and MADScore are nil when the baseline does not vary
+	ZScore     *float64  `json:"z_score" bson:"z_score"`
+	MADScore   *float64  `json:"mad_score" bson:"mad_score"`
+	Direction  string    `json:"direction" bson:"direction"`
+	DetectedAt time.Time `json:"detected_at" bson:"detected_at"`
+}
@@ -1,6 +1,8 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type Order struct {
 	ID primitive.ObjectID `json:"id" bson:"_id,omitempty"`
@@ -8,4 +10,16 @@ type Order struct {
 	ProductID primitive.ObjectID `json:"product_id" bson:"product_id"`
 	Quantity int `json:"quantity" bson:"quantity"`
 	Status string `json:"status" bson:"status"`
-}
\ No newline at end of file
+	// UnitPrice is the product's price when the order was placed; orders placed
+	// before prices were recorded have none
+	UnitPrice float64 `json:"unit_price,omitempty" bson:"unit_price,omitempty"`
+	// Version is the version of the last event applied to the order
+	Version int `json:"version" bson:"version"`
+	// CreatedAt is unset on documents written before it was recorded, and on
+	// those whose value cannot be read as a time
+	CreatedAt Timestamp `json:"created_at" bson:"createdAt,omitempty"`
+}
+// Order statuses set by the API itself
+const (
+	OrderStatusConfirmed = "confirmed"
+)
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Order event types
+const (
+	OrderEventCreated = "created"
+	OrderEventUpdated = "updated"
+	OrderEventDeleted = "deleted"
+)
+
+// OrderEvent is one change to an order. The events of an order are never
+// changed once stored; the order is the result of applying them in Version order.
+type OrderEvent struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrderID primitive.ObjectID `json:"order_id" bson:"order_id"`
+	// Version numbers the events of an order from 1, without gaps
+	Version int    `json:"version" bson:"version"`
+	Type    string `json:"type" bson:"type"`
+	// Data holds every field of a created order, or the fields an update set
+	Data       bson.M    `json:"data,omitempty" bson:"data,omitempty"`
+	OccurredAt time.Time `json:"occurred_at" bson:"occurred_at"`
+}
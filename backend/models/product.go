@@ -1,9 +1,16 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type Product struct {
 	ID primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	Name string `json:"name" bson:"name"`
 	Price float64 `json:"price" bson:"price"`
+	// Stock is nil for products whose stock is not tracked
+	Stock *int `json:"stock,omitempty" bson:"stock,omitempty"`
+	// CreatedAt is unset on documents written before it was recorded, and on
+	// those whose value cannot be read as a time
+	CreatedAt Timestamp `json:"created_at" bson:"createdAt,omitempty"`
 }
\ No newline at end of file
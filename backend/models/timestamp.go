@@ -0,0 +1,65 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Timestamp is a time stored as a BSON date. Documents written before the
+// API recorded creation times may hold a string, a number or another type
+// instead; Timestamp decodes those the way the statistics pipelines convert
+// them, and anything they cannot convert as the zero time, rather than failing
+// to decode the whole document.
+type Timestamp struct {
+	time.Time
+}
+
+// NewTimestamp returns t as a Timestamp, in UTC and to the millisecond a
+// BSON date keeps
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t.UTC().Truncate(time.Millisecond)}
+}
+
+// MarshalBSONValue stores the time as a BSON date
+func (t Timestamp) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bsontype.DateTime, bsoncore.AppendDateTime(nil, t.UnixMilli()), nil
+}
+
+// UnmarshalBSONValue decodes dates, RFC 3339 strings and plain dates,
+// milliseconds since the epoch and BSON timestamps; other values decode as the
+// zero time
+func (t *Timestamp) UnmarshalBSONValue(typ bsontype.Type, data []byte) error {
+	t.Time = time.Time{}
+	value := bsoncore.Value{Type: typ, Data: data}
+
+	switch typ {
+	case bsontype.DateTime:
+		if ms, ok := value.DateTimeOK(); ok {
+			t.Time = time.UnixMilli(ms).UTC()
+		}
+	case bsontype.String:
+		if s, ok := value.StringValueOK(); ok {
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+				if parsed, err := time.Parse(layout, s); err == nil {
+					t.Time = parsed.UTC()
+					break
+				}
+			}
+		}
+	case bsontype.Int64:
+		if ms, ok := value.Int64OK(); ok {
+			t.Time = time.UnixMilli(ms).UTC()
+		}
+	case bsontype.Double:
+		if ms, ok := value.DoubleOK(); ok {
+			t.Time = time.UnixMilli(int64(ms)).UTC()
+		}
+	case bsontype.Timestamp:
+		if seconds, _, ok := value.TimestampOK(); ok {
+			t.Time = time.Unix(int64(seconds), 0).UTC()
+		}
+	}
+	return nil
+}
@@ -1,9 +1,14 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type User struct {
 	ID    primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	Name string `json:"name" bson:"name"`
 	Email string `json:"email" bson:"email"`
+	// CreatedAt is unset on documents written before it was recorded, and on
+	// those whose value cannot be read as a time
+	CreatedAt Timestamp `json:"created_at" bson:"createdAt,omitempty"`
 }
\ No newline at end of file
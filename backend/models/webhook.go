@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook delivery statuses
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// WebhookSubscription asks for the events of EventTypes to be POSTed to URL,
+// signed with Secret
+type WebhookSubscription struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	URL         string             `json:"url" bson:"url"`
+	EventTypes  []string           `json:"event_types" bson:"event_types"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	// Secret is only returned when the subscription is created
+	Secret    string    `json:"secret,omitempty" bson:"secret"`
+	Active    bool      `json:"active" bson:"active"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// WebhookDelivery is one event to deliver to one subscription, with the log of
+// every attempt
+type WebhookDelivery struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SubscriptionID primitive.ObjectID `json:"subscription_id" bson:"subscription_id"`
+	EventID        string             `json:"event_id" bson:"event_id"`
+	EventType      string             `json:"event_type" bson:"event_type"`
+	// Payload is the request body, the event envelope as JSON
+	Payload string `json:"payload" bson:"payload"`
+	Status  string `json:"status" bson:"status"`
+	// Retries counts the failed attempts since the delivery was last requested
+	Retries       int              `json:"retries" bson:"retries"`
+	Attempts      []WebhookAttempt `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time        `json:"next_attempt_at" bson:"next_attempt_at"`
+	LockedUntil   time.Time        `json:"-" bson:"locked_until"`
+	CreatedAt     time.Time        `json:"created_at" bson:"created_at"`
+	DeliveredAt   *time.Time       `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+}
+
+// WebhookAttempt records one POST of a delivery
+type WebhookAttempt struct {
+	At         time.Time `json:"at" bson:"at"`
+	StatusCode int       `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms" bson:"duration_ms"`
+	// Response is the start of the response body
+	Response string `json:"response,omitempty" bson:"response,omitempty"`
+}
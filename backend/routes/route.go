@@ -2,16 +2,36 @@ package routes
 
 import (
 	"backend/controllers"
+	"backend/middleware"
+	"backend/services"
 
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
-) 
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
 
-func Setup(app *fiber.App) {
+func Setup(app *fiber.App, registry *services.Registry) {
 
 	// Initialize controller
-	userController := controllers.NewUserController()
-	productController := controllers.NewProductController()
-	orderController := controllers.NewOrderController()
+	userController := controllers.NewUserController(registry.Users)
+	productController := controllers.NewProductController(registry.Products)
+	orderController := controllers.NewOrderController(registry.Orders)
+	healthController := controllers.NewHealthController()
+	adminController := controllers.NewAdminController(registry.Users, registry.Products, registry.Orders, registry.Dashboard)
+	streamController := controllers.NewStreamController()
+	leaderboardController := controllers.NewLeaderboardController(registry.Orders)
+	webhookController := controllers.NewWebhookController(registry.Webhooks)
+	dashboardController := controllers.NewDashboardController(registry.Dashboard)
+	anomalyController := controllers.NewAnomalyController(registry.Anomalies)
+	forecastController := controllers.NewForecastController(registry.Orders)
+
+	//Health
+	app.Get("/health", healthController.GetHealth)
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+
+	//Dashboard
+	app.Get("/dashboard", dashboardController.GetDashboard)
 
 	//User
 	app.Post("/users", userController.CreateUser)
@@ -21,6 +41,7 @@ func Setup(app *fiber.App) {
 	app.Delete("/users/:id", userController.DeleteUser)
 	app.Get("/user-count", userController.GetUserCount)
 	app.Get("/user-statistics", userController.GetUserStatistics)
+	app.Get("/user-cohorts", userController.GetUserCohorts)
 
 	//Product
 	app.Post("/products", productController.CreateProduct)
@@ -34,8 +55,48 @@ func Setup(app *fiber.App) {
 	//Order
 	app.Post("/orders", orderController.CreateOrder)
 	app.Get("/orders/:id", orderController.GetOrderById)
+	app.Get("/orders/:id/events", orderController.GetOrderEvents)
 	app.Get("/orders", orderController.GetAllOrders)
 	app.Put("/orders/:id", orderController.UpdateOrder)
 	app.Delete("/orders/:id", orderController.DeleteOrder)
 	app.Get("/order-statistics", orderController.GetOrderStatistics)
-}
\ No newline at end of file
+	app.Get("/revenue-statistics", orderController.GetRevenueStatistics)
+
+	//Forecasts
+	app.Get("/forecast/orders", forecastController.ForecastOrders)
+	app.Get("/forecast/products/:id", forecastController.ForecastProduct)
+
+	//Leaderboards expose customer details, so they are for staff only
+	leaderboards := app.Group("/leaderboards", middleware.AdminOnly())
+	leaderboards.Get("/products", leaderboardController.TopProducts)
+	leaderboards.Get("/users", leaderboardController.TopUsers)
+
+	//Anomalies
+	anomalies := app.Group("/anomalies", middleware.AdminOnly())
+	anomalies.Get("/", anomalyController.ListAnomalies)
+	anomalies.Post("/detect", anomalyController.DetectAnomalies)
+
+	//Live updates
+	app.Get("/stream", middleware.Subscriber(), streamController.Stream)
+	app.Get("/ws", middleware.Subscriber(), streamController.UpgradeWebSocket, websocket.New(streamController.WebSocket))
+
+	//Admin
+	admin := app.Group("/admin", middleware.AdminOnly())
+	admin.Get("/cache/stats", adminController.GetCacheStats)
+	admin.Get("/cache/:namespace/:id", adminController.InspectCache)
+	admin.Delete("/cache", adminController.PurgeCachePattern)
+	admin.Delete("/cache/:namespace", adminController.PurgeCacheNamespace)
+	admin.Post("/cache/warmup", adminController.WarmUpCache)
+	admin.Post("/cache/check", adminController.CheckCache)
+	admin.Post("/stream-tokens", adminController.IssueStreamToken)
+
+	//Webhooks
+	webhooks := app.Group("/webhooks", middleware.AdminOnly())
+	webhooks.Post("/", webhookController.CreateSubscription)
+	webhooks.Get("/", webhookController.ListSubscriptions)
+	webhooks.Get("/:id", webhookController.GetSubscription)
+	webhooks.Put("/:id", webhookController.UpdateSubscription)
+	webhooks.Delete("/:id", webhookController.DeleteSubscription)
+	webhooks.Get("/:id/deliveries", webhookController.ListDeliveries)
+	webhooks.Post("/:id/deliveries/:deliveryId/redeliver", webhookController.Redeliver)
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"backend/config"
+	"backend/events"
+	"backend/models"
+	"backend/utils"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/montanaflynn/stats"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// anomalyLeaseID is the lease document that schedules anomaly detection
+const anomalyLeaseID = "anomaly-detection"
+
+// madScale makes the median absolute deviation comparable with the standard
+// deviation of normally distributed data
+const madScale = 0.6745
+
+// AnomalyService flags days of unusual order volume or revenue
+type AnomalyService struct {
+	collection *mongo.Collection
+	orders     *OrderService
+}
+
+// AnomalyQuery selects the days to check, [From, To) in whole days of
+// Location, and the scores at which a day is flagged. Record stores the days
+// flagged and reports them with events; it needs the configured thresholds.
+type AnomalyQuery struct {
+	From         time.Time
+	To           time.Time
+	Location     *time.Location
+	ZThreshold   float64
+	MADThreshold float64
+	Record       bool
+}
+
+// NewAnomalyService creates a new instance of AnomalyService
+func NewAnomalyService(collection *mongo.Collection, orders *OrderService) *AnomalyService {
+	return &AnomalyService{collection: collection, orders: orders}
+}
+
+// NewAnomalyQuery validates the query. Only complete days are checked, so to
+// is at most the start of today; without it that is where the range ends, and
+// without from it covers config.AnomalyLookbackDays days. Zero thresholds are
+// those of the config and a nil loc is config.StatsTimezone. Only days flagged
+// at the configured thresholds are recorded, so that what is stored, and
+// reported to subscribers, does not depend on who asked.
+func NewAnomalyQuery(from, to time.Time, zThreshold, madThreshold float64, loc *time.Location, record bool) (AnomalyQuery, error) {
+	if record && (zThreshold != 0 && zThreshold != config.AnomalyZThreshold ||
+		madThreshold != 0 && madThreshold != config.AnomalyMADThreshold) {
+		return AnomalyQuery{}, fmt.Errorf("%w: anomalies are only recorded at the configured thresholds", ErrInvalidInput)
+	}
+	if zThreshold == 0 {
+		zThreshold = config.AnomalyZThreshold
+	}
+	if madThreshold == 0 {
+		madThreshold = config.AnomalyMADThreshold
+	}
+	if zThreshold < 0 || madThreshold < 0 {
+		return AnomalyQuery{}, fmt.Errorf("%w: thresholds must be positive", ErrInvalidInput)
+	}
+
+	days, err := NewStatsQuery(GranularityDay, time.Time{}, time.Now(), loc)
+	if err != nil {
+		return AnomalyQuery{}, err
+	}
+	today := days.Truncate(time.Now())
+	if to.IsZero() || to.After(today) {
+		to = today
+	}
+	// A day that has not ended is left for the next check
+	to = days.Truncate(to)
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -config.AnomalyLookbackDays)
+	}
+
+	q := AnomalyQuery{
+		From:         days.Truncate(from),
+		To:           to,
+		Location:     days.Location,
+		ZThreshold:   zThreshold,
+		MADThreshold: madThreshold,
+		Record:       record,
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("%w: from must be before to, and to at most today", ErrInvalidInput)
+	}
+	return q, nil
+}
+
+// EnsureIndexes creates the index that keeps a day from being flagged twice in
+// a time zone. Anomalies recorded before the time zone was stored were
+// recorded in config.StatsTimezone, and are given it first; the index on the
+// metric and day alone that they had is dropped.
+func (s *AnomalyService) EnsureIndexes(ctx context.Context) error {
+	if _, err := s.collection.UpdateMany(ctx, bson.M{"timezone": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"timezone": config.StatsTimezone}}); err != nil {
+		return err
+	}
+	var cmdErr mongo.CommandError
+	if _, err := s.collection.Indexes().DropOne(ctx, "metric_1_day_1"); err != nil &&
+		!(errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound")) {
+		return err
+	}
+
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "metric", Value: 1}, {Key: "day", Value: 1}, {Key: "timezone", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Start checks the last config.AnomalyLookbackDays days every
+// config.AnomalyInterval until ctx is done, on one instance at a time
+func (s *AnomalyService) Start(ctx context.Context) {
+	if err := s.EnsureIndexes(ctx); err != nil {
+		utils.Logger.Warn("failed to create anomaly indexes", "error", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			if claimed, err := claimRun(ctx, anomalyLeaseID, config.AnomalyInterval); err != nil && ctx.Err() == nil {
+				utils.Logger.Warn("failed to schedule anomaly detection", "error", err)
+			} else if claimed {
+				q, err := NewAnomalyQuery(time.Time{}, time.Time{}, 0, 0, nil, true)
+				if err == nil {
+					_, err = s.Detect(ctx, q)
+				}
+				if err != nil {
+					utils.Logger.Error("anomaly detection failed", "error", err)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Detect compares the order count and revenue of every day of q with the
+// config.AnomalyBaselineDays days before it and flags those whose z-score or
+// MAD score reaches its threshold. Orders with one of the statuses of
+// config.AnomalyExcludeStatuses are not counted. When q.Record is set, newly
+// flagged days are stored and reported with an AnomalyDetected event, and days
+// flagged before are returned as stored.
+func (s *AnomalyService) Detect(ctx context.Context, q AnomalyQuery) (_ []models.Anomaly, err error) {
+	ctx, span := startSpan(ctx, "AnomalyService.Detect")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	days, err := NewStatsQuery(GranularityDay, q.From.AddDate(0, 0, -config.AnomalyBaselineDays), q.To, q.Location)
+	if err != nil {
+		return nil, err
+	}
+	series, err := s.orders.aggregateRevenue(ctx, days, anomalyStatusFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	found := []models.Anomaly{}
+	for i, day := range series {
+		if day.Start.Before(q.From) {
+			continue
+		}
+		baseline := series[max(0, i-config.AnomalyBaselineDays):i]
+		if len(baseline) < config.AnomalyMinBaselineDays {
+			continue
+		}
+
+		orders := make(stats.Float64Data, len(baseline))
+		revenue := make(stats.Float64Data, len(baseline))
+		for j, b := range baseline {
+			orders[j], revenue[j] = float64(b.Orders), b.Revenue
+		}
+		for _, a := range []*models.Anomaly{
+			score(models.AnomalyOrders, float64(day.Orders), orders, q),
+			score(models.AnomalyRevenue, day.Revenue, revenue, q),
+		} {
+			if a != nil {
+				a.Day, a.Timezone, a.Start = day.Period, q.Location.String(), day.Start
+				found = append(found, *a)
+			}
+		}
+	}
+
+	if !q.Record {
+		return found, nil
+	}
+	for i := range found {
+		if found[i], err = s.record(ctx, found[i]); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// anomalyStatusFilter leaves out the orders of config.AnomalyExcludeStatuses
+func anomalyStatusFilter() StatusFilter {
+	var exclude []string
+	for _, status := range strings.Split(config.AnomalyExcludeStatuses, ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			exclude = append(exclude, status)
+		}
+	}
+	return StatusFilter{Exclude: exclude}
+}
+
+// score compares value with baseline, returning the anomaly when either score
+// reaches its threshold of q and nil otherwise
+func score(metric string, value float64, baseline stats.Float64Data, q AnomalyQuery) *models.Anomaly {
+	mean, _ := stats.Mean(baseline)
+	sd, _ := stats.StandardDeviationSample(baseline)
+	median, _ := stats.Median(baseline)
+	mad, _ := stats.MedianAbsoluteDeviation(baseline)
+
+	a := &models.Anomaly{
+		Metric:         metric,
+		Value:          value,
+		BaselineDays:   len(baseline),
+		BaselineMean:   roundMoney(mean),
+		BaselineMedian: roundMoney(median),
+		Direction:      models.AnomalySpike,
+	}
+	flagged := false
+	if sd > 0 {
+		z := (value - mean) / sd
+		a.ZScore = roundScore(z)
+		flagged = math.Abs(z) >= q.ZThreshold
+	}
+	if mad > 0 {
+		m := madScale * (value - median) / mad
+		a.MADScore = roundScore(m)
+		flagged = flagged || math.Abs(m) >= q.MADThreshold
+	}
+	if !flagged {
+		return nil
+	}
+	if value < median {
+		a.Direction = models.AnomalyDrop
+	}
+	return a
+}
+
+func roundScore(score float64) *float64 {
+	score = math.Round(score*100) / 100
+	return &score
+}
+
+// record stores a newly flagged anomaly along with its event, or returns the
+// stored one when the day was flagged before
+func (s *AnomalyService) record(ctx context.Context, anomaly models.Anomaly) (models.Anomaly, error) {
+	anomaly.ID = primitive.NewObjectID()
+	anomaly.DetectedAt = time.Now().UTC()
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		if _, err := s.collection.InsertOne(ctx, anomaly); err != nil {
+			return err
+		}
+		return recordEvent(ctx, events.AnomalyDetected, anomaly.ID, events.AnomalyDetectedPayload{
+			AnomalyID:      anomaly.ID.Hex(),
+			Metric:         anomaly.Metric,
+			Day:            anomaly.Day,
+			Timezone:       anomaly.Timezone,
+			Value:          anomaly.Value,
+			BaselineMedian: anomaly.BaselineMedian,
+			ZScore:         anomaly.ZScore,
+			MADScore:       anomaly.MADScore,
+			Direction:      anomaly.Direction,
+		})
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		var stored models.Anomaly
+		err = s.collection.FindOne(ctx, bson.M{"metric": anomaly.Metric, "day": anomaly.Day, "timezone": anomaly.Timezone}).Decode(&stored)
+		if err != nil {
+			return anomaly, fmt.Errorf("failed to fetch anomaly: %w", err)
+		}
+		return stored, nil
+	} else if err != nil {
+		return anomaly, fmt.Errorf("failed to store anomaly: %w", err)
+	}
+
+	utils.LoggerFromContext(ctx).Warn("order anomaly detected",
+		"metric", anomaly.Metric, "day", anomaly.Day, "value", anomaly.Value, "direction", anomaly.Direction)
+	return anomaly, nil
+}
+
+// ListAnomalies returns a page of the flagged days, latest first, optionally
+// only those of metric
+func (s *AnomalyService) ListAnomalies(ctx context.Context, metric string, page Page) (_ []models.Anomaly, err error) {
+	ctx, span := startSpan(ctx, "AnomalyService.ListAnomalies")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	filter := bson.M{}
+	switch metric {
+	case "":
+	case models.AnomalyOrders, models.AnomalyRevenue:
+		filter["metric"] = metric
+	default:
+		return nil, fmt.Errorf("%w: metric must be orders or revenue", ErrInvalidInput)
+	}
+
+	opts := page.findOptions().SetSort(bson.D{{Key: "start", Value: -1}, {Key: "metric", Value: 1}})
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list anomalies: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	anomalies := []models.Anomaly{}
+	if err := cursor.All(ctx, &anomalies); err != nil {
+		return nil, fmt.Errorf("failed to decode anomalies: %w", err)
+	}
+	return anomalies, nil
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"backend/models"
+	"testing"
+
+	"github.com/montanaflynn/stats"
+)
+
+func TestScore(t *testing.T) {
+	// Mean and median 14, standard deviation √10 and MAD 2
+	even := stats.Float64Data{10, 12, 14, 16, 18}
+	// One outlier lifts the mean and standard deviation, not the median 11 or MAD 1
+	outlier := stats.Float64Data{10, 10, 11, 11, 12, 40}
+	// Most days the same, so the MAD is 0 while the standard deviation is not
+	flat := stats.Float64Data{10, 10, 10, 10, 10, 20}
+	thresholds := AnomalyQuery{ZThreshold: 3, MADThreshold: 3.5}
+
+	tests := []struct {
+		name     string
+		value    float64
+		baseline stats.Float64Data
+		q        AnomalyQuery
+		// want is false when the day is not flagged
+		want          bool
+		wantDirection string
+		wantZ         *float64
+		wantMAD       *float64
+	}{
+		{name: "typical day", value: 14, baseline: even, q: thresholds},
+		{name: "spike", value: 30, baseline: even, q: thresholds, want: true, wantDirection: models.AnomalySpike, wantZ: roundScore(5.06), wantMAD: roundScore(5.4)},
+		{name: "drop", value: 0, baseline: even, q: thresholds, want: true, wantDirection: models.AnomalyDrop, wantZ: roundScore(-4.43), wantMAD: roundScore(-4.72)},
+		{name: "below both thresholds", value: 19, baseline: even, q: AnomalyQuery{ZThreshold: 2, MADThreshold: 1.7}},
+		{name: "z-score threshold reached", value: 19, baseline: even, q: AnomalyQuery{ZThreshold: 1.5, MADThreshold: 1.7}, want: true, wantDirection: models.AnomalySpike, wantZ: roundScore(1.58), wantMAD: roundScore(1.69)},
+		{name: "MAD threshold reached", value: 19, baseline: even, q: AnomalyQuery{ZThreshold: 2, MADThreshold: 1.6}, want: true, wantDirection: models.AnomalySpike, wantZ: roundScore(1.58), wantMAD: roundScore(1.69)},
+		{name: "outlier hides a spike from the z-score only", value: 22, baseline: outlier, q: thresholds, want: true, wantDirection: models.AnomalySpike, wantZ: roundScore(0.53), wantMAD: roundScore(7.42)},
+		{name: "MAD of 0 leaves the z-score", value: 30, baseline: flat, q: thresholds, want: true, wantDirection: models.AnomalySpike, wantZ: roundScore(4.49)},
+		{name: "MAD of 0 with a drop", value: 5, baseline: flat, q: AnomalyQuery{ZThreshold: 1.5, MADThreshold: 3.5}, want: true, wantDirection: models.AnomalyDrop, wantZ: roundScore(-1.63)},
+		{name: "MAD of 0 on a typical day", value: 10, baseline: flat, q: thresholds},
+		{name: "baseline that does not vary", value: 50, baseline: stats.Float64Data{10, 10, 10, 10}, q: thresholds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := score("orders", tt.value, tt.baseline, tt.q)
+			if (a != nil) != tt.want {
+				t.Fatalf("score = %+v, want flagged %v", a, tt.want)
+			}
+			if a == nil {
+				return
+			}
+			if a.Direction != tt.wantDirection {
+				t.Errorf("Direction = %s, want %s", a.Direction, tt.wantDirection)
+			}
+			if !equalScores(a.ZScore, tt.wantZ) {
+				t.Errorf("ZScore = %v, want %v", formatScore(a.ZScore), formatScore(tt.wantZ))
+			}
+			if !equalScores(a.MADScore, tt.wantMAD) {
+				t.Errorf("MADScore = %v, want %v", formatScore(a.MADScore), formatScore(tt.wantMAD))
+			}
+			if a.Metric != "orders" || a.Value != tt.value || a.BaselineDays != len(tt.baseline) {
+				t.Errorf("anomaly = %s %v over %d days, want orders %v over %d days",
+					a.Metric, a.Value, a.BaselineDays, tt.value, len(tt.baseline))
+			}
+		})
+	}
+}
+
+func TestScoreBaseline(t *testing.T) {
+	a := score("revenue", 40, stats.Float64Data{10.004, 12, 14, 16, 18}, AnomalyQuery{ZThreshold: 3, MADThreshold: 3.5})
+	if a == nil {
+		t.Fatal("score = nil, want the day flagged")
+	}
+	if a.BaselineMean != 14 || a.BaselineMedian != 14 {
+		t.Errorf("baseline mean %v, median %v; want both 14", a.BaselineMean, a.BaselineMedian)
+	}
+}
+
+func equalScores(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func formatScore(score *float64) any {
+	if score == nil {
+		return nil
+	}
+	return *score
+}
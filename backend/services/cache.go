@@ -0,0 +1,82 @@
+package services
+
+import (
+	"backend/cache"
+	"backend/config"
+	"backend/utils"
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// invalidator broadcasts invalidations of in-process cache tiers to the other API instances
+var invalidator *cache.Invalidator
+
+// StartCacheInvalidation subscribes to invalidations from the other API
+// instances until ctx is done. Call it after utils.InitRedis and before any
+// service is created; services created without it get no in-process tier.
+func StartCacheInvalidation(ctx context.Context) {
+	invalidator = cache.NewInvalidator(utils.RedisClient, config.CacheInvalidationChannel)
+	invalidator.Start(ctx)
+}
+
+// newCache creates a cache in namespace with the configured negative caching and
+// stampede protection
+func newCache[T any](client *redis.Client, namespace string, ttl time.Duration, tags func(id string) []string) *cache.Cache[T] {
+	return cache.New[T](client, cacheOptions(namespace, ttl, tags))
+}
+
+// newTieredCache is newCache with a bounded in-process tier in front of Redis,
+// for lookups too hot for a network round-trip
+func newTieredCache[T any](client *redis.Client, namespace string, ttl time.Duration, tags func(id string) []string) *cache.Cache[T] {
+	opts := cacheOptions(namespace, ttl, tags)
+	opts.LocalSize = config.CacheLocalSize
+	opts.LocalTTL = config.CacheLocalTTL
+	opts.Invalidator = invalidator
+	return cache.New[T](client, opts)
+}
+
+func cacheOptions(namespace string, ttl time.Duration, tags func(id string) []string) cache.Options {
+	return cache.Options{
+		Namespace:        namespace,
+		Version:          1,
+		TTL:              ttl,
+		NegativeTTL:      config.CacheNegativeTTL,
+		EarlyRefreshBeta: config.CacheRefreshBeta,
+		LockTTL:          config.CacheLockTTL,
+		Tags:             tags,
+	}
+}
+
+// entityTags tags an entity's entry with "<kind>:<id>"
+func entityTags(kind string) func(id string) []string {
+	return func(id string) []string {
+		return []string{kind + ":" + id}
+	}
+}
+
+// collectionTags tags list pages and statistics with the collections they were computed from
+func collectionTags(tags ...string) func(id string) []string {
+	return func(string) []string {
+		return tags
+	}
+}
+
+// purger is implemented by every *cache.Cache
+type purger interface {
+	Namespace() string
+	Purge(ctx context.Context) (int64, error)
+}
+
+// purgeOnRecovery drops the entries of caches when Redis comes back after an
+// outage, since invalidations are skipped while it is down
+func purgeOnRecovery(caches ...purger) {
+	utils.OnRedisRecovered(func(ctx context.Context) {
+		for _, c := range caches {
+			if _, err := c.Purge(ctx); err != nil {
+				utils.Logger.Warn("failed to purge cache after Redis recovery", "namespace", c.Namespace(), "error", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"backend/cache"
+	"backend/config"
+	"backend/models"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CachedEntry is an entry as stored in Redis, for operators
+type CachedEntry struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Value     any    `json:"value,omitempty"`
+	NotFound  bool   `json:"not_found,omitempty"`
+	// TTLMs is the remaining time to live in milliseconds, -1 for none
+	TTLMs int64  `json:"ttl_ms"`
+	Error string `json:"error,omitempty"`
+}
+
+// WarmUpResult reports how many entries a warm-up preloaded
+type WarmUpResult struct {
+	Products   int   `json:"products"`
+	Orders     int   `json:"orders"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// cacheView is the untyped view of one cache used by CacheAdmin
+type cacheView struct {
+	namespace     string
+	pattern       string
+	inspect       func(ctx context.Context, id string) (CachedEntry, bool, error)
+	purgeMatching func(ctx context.Context, pattern string) (int64, error)
+}
+
+func viewOf[T any](c *cache.Cache[T]) cacheView {
+	return cacheView{
+		namespace: c.Namespace(),
+		pattern:   c.Pattern(),
+		inspect: func(ctx context.Context, id string) (CachedEntry, bool, error) {
+			e, ok, err := c.Inspect(ctx, id)
+			if !ok || err != nil {
+				return CachedEntry{}, ok, err
+			}
+
+			entry := CachedEntry{Namespace: c.Namespace(), Key: e.Key, NotFound: e.NotFound, TTLMs: -1}
+			if e.TTL >= 0 {
+				entry.TTLMs = e.TTL.Milliseconds()
+			}
+			if e.Err != nil {
+				entry.Error = e.Err.Error()
+			} else if !e.NotFound {
+				entry.Value = e.Value
+			}
+			return entry, true, nil
+		},
+		purgeMatching: c.PurgeMatching,
+	}
+}
+
+// CacheAdmin inspects, purges and warms the caches of the services
+type CacheAdmin struct {
+	views    map[string]cacheView
+	products *ProductService
+	orders   *OrderService
+}
+
+// NewCacheAdmin creates a CacheAdmin over every cache of the given services
+func NewCacheAdmin(users *UserService, products *ProductService, orders *OrderService, dashboard *DashboardService) *CacheAdmin {
+	a := &CacheAdmin{views: map[string]cacheView{}, products: products, orders: orders}
+	for _, views := range [][]cacheView{users.cacheViews(), products.cacheViews(), orders.cacheViews(), dashboard.cacheViews()} {
+		for _, v := range views {
+			a.views[v.namespace] = v
+		}
+	}
+	return a
+}
+
+// Namespaces returns the cache namespaces, sorted
+func (a *CacheAdmin) Namespaces() []string {
+	namespaces := make([]string, 0, len(a.views))
+	for ns := range a.views {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Inspect returns the entry cached for id in namespace
+func (a *CacheAdmin) Inspect(ctx context.Context, namespace, id string) (_ CachedEntry, err error) {
+	ctx, span := startSpan(ctx, "CacheAdmin.Inspect")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	view, err := a.view(namespace)
+	if err != nil {
+		return CachedEntry{}, err
+	}
+	entry, ok, err := view.inspect(ctx, id)
+	if err != nil {
+		return CachedEntry{}, fmt.Errorf("failed to read cache entry: %w", err)
+	}
+	if !ok {
+		return CachedEntry{}, fmt.Errorf("cache entry %w", ErrNotFound)
+	}
+	return entry, nil
+}
+
+// Purge removes every entry of namespace, all versions included
+func (a *CacheAdmin) Purge(ctx context.Context, namespace string) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "CacheAdmin.Purge")
+	defer endSpan(span, &err)
+
+	view, err := a.view(namespace)
+	if err != nil {
+		return 0, err
+	}
+	return a.purge(ctx, view, view.pattern)
+}
+
+// PurgePattern removes the entries whose keys match pattern. The pattern must
+// start with "<namespace>:" for one of the namespaces, so keys other than cache
+// entries cannot be purged.
+func (a *CacheAdmin) PurgePattern(ctx context.Context, pattern string) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "CacheAdmin.PurgePattern")
+	defer endSpan(span, &err)
+
+	namespace, _, ok := strings.Cut(pattern, ":")
+	if !ok {
+		return 0, fmt.Errorf("%w: pattern must start with a cache namespace followed by ':'", ErrInvalidInput)
+	}
+	view, err := a.view(namespace)
+	if err != nil {
+		return 0, err
+	}
+	return a.purge(ctx, view, pattern)
+}
+
+func (a *CacheAdmin) purge(ctx context.Context, view cacheView, pattern string) (int64, error) {
+	deleted, err := view.purgeMatching(ctx, pattern)
+	if err != nil {
+		return deleted, fmt.Errorf("failed to purge %s: %w", pattern, err)
+	}
+	return deleted, nil
+}
+
+// Stats returns the lookup counters of every namespace in this process
+func (a *CacheAdmin) Stats() []cache.Stats {
+	return cache.AllStats()
+}
+
+// WarmUp preloads the products with the most units ordered and the most recent
+// orders, up to products and orders of each
+func (a *CacheAdmin) WarmUp(ctx context.Context, products, orders int64) (_ WarmUpResult, err error) {
+	ctx, span := startSpan(ctx, "CacheAdmin.WarmUp")
+	defer endSpan(span, &err)
+
+	start := time.Now()
+	var result WarmUpResult
+
+	if products > 0 {
+		ids, err := a.orders.TopProductIDs(ctx, products)
+		if err != nil {
+			return result, err
+		}
+		if result.Products, err = a.products.WarmCache(ctx, ids); err != nil {
+			return result, err
+		}
+	}
+	if orders > 0 {
+		if result.Orders, err = a.orders.WarmCache(ctx, orders); err != nil {
+			return result, err
+		}
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+func (a *CacheAdmin) view(namespace string) (cacheView, error) {
+	view, ok := a.views[namespace]
+	if !ok {
+		return cacheView{}, fmt.Errorf("cache namespace %q %w", namespace, ErrNotFound)
+	}
+	return view, nil
+}
+
+func (s *UserService) cacheViews() []cacheView {
+	return []cacheView{viewOf(s.cache), viewOf(s.listCache), viewOf(s.countCache), viewOf(s.statsCache), viewOf(s.cohortCache)}
+}
+
+func (s *ProductService) cacheViews() []cacheView {
+	return []cacheView{viewOf(s.cache), viewOf(s.listCache), viewOf(s.countCache), viewOf(s.statsCache)}
+}
+
+func (s *OrderService) cacheViews() []cacheView {
+	return []cacheView{
+		viewOf(s.cache), viewOf(s.listCache), viewOf(s.statsCache), viewOf(s.revenueCache),
+		viewOf(s.productBoardCache), viewOf(s.userBoardCache), viewOf(s.forecastCache),
+	}
+}
+
+func (s *DashboardService) cacheViews() []cacheView {
+	return []cacheView{viewOf(s.cache)}
+}
+
+// WarmCache caches the products with ids, returning how many were found
+func (s *ProductService) WarmCache(ctx context.Context, ids []primitive.ObjectID) (_ int, err error) {
+	ctx, span := startSpan(ctx, "ProductService.WarmCache")
+	defer endSpan(span, &err)
+
+	products, err := findByIDs[models.Product](ctx, s.collection, ids)
+	if err != nil {
+		return 0, err
+	}
+	for _, product := range products {
+		s.cache.Set(ctx, product.ID.Hex(), product)
+	}
+	return len(products), nil
+}
+
+// TopProductIDs returns the IDs of the n products with the most units ordered
+func (s *OrderService) TopProductIDs(ctx context.Context, n int64) (_ []primitive.ObjectID, err error) {
+	ctx, span := startSpan(ctx, "OrderService.TopProductIDs")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$product_id"},
+			{Key: "units", Value: bson.D{{Key: "$sum", Value: "$quantity"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "units", Value: -1}}}},
+		{{Key: "$limit", Value: n}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank products by units ordered: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var ids []primitive.ObjectID
+	for cursor.Next(ctx) {
+		if id, ok := cursor.Current.Lookup("_id").ObjectIDOK(); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, cursor.Err()
+}
+
+// WarmCache caches the n most recent orders, returning how many were cached
+func (s *OrderService) WarmCache(ctx context.Context, n int64) (_ int, err error) {
+	ctx, span := startSpan(ctx, "OrderService.WarmCache")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	// ObjectIDs start with their creation time, so _id order is creation order
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(n)
+	cursor, err := s.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load recent orders: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var orders []models.Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return 0, fmt.Errorf("failed to decode orders: %w", err)
+	}
+	for _, order := range orders {
+		s.cache.Set(ctx, order.ID.Hex(), order)
+	}
+	return len(orders), nil
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"backend/cache"
+	"backend/config"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxReportedDrifts caps how many drifted entries a report lists per namespace;
+// the counts always cover every entry
+const maxReportedDrifts = 100
+
+// DriftKind classifies how a cache entry disagrees with MongoDB
+type DriftKind string
+
+const (
+	// DriftOutdated is an entry written under another version of the namespace
+	DriftOutdated DriftKind = "outdated_version"
+	// DriftInvalidID is an entry whose ID is not a usable ObjectID, such as the zero ID
+	DriftInvalidID DriftKind = "invalid_id"
+	// DriftUndecodable is an entry that cannot be decoded
+	DriftUndecodable DriftKind = "undecodable"
+	// DriftMissing is a cached value whose document no longer exists
+	DriftMissing DriftKind = "missing_in_db"
+	// DriftStaleNotFound is a cached not-found result for a document that exists
+	DriftStaleNotFound DriftKind = "stale_not_found"
+	// DriftMismatch is a cached value that differs from its document
+	DriftMismatch DriftKind = "mismatch"
+	// DriftNoTTL is an entry that never expires, so it is never refreshed
+	DriftNoTTL DriftKind = "no_ttl"
+)
+
+// Drift is one cache entry that disagrees with MongoDB
+type Drift struct {
+	Key  string    `json:"key"`
+	Kind DriftKind `json:"kind"`
+	// Repair is "evicted" or "rewritten" when the entry was repaired
+	Repair string `json:"repair,omitempty"`
+}
+
+// CacheCheckReport summarises the consistency check of one cache namespace
+type CacheCheckReport struct {
+	Namespace string            `json:"namespace"`
+	Scanned   int               `json:"scanned"`
+	Drifted   int               `json:"drifted"`
+	Repaired  int               `json:"repaired"`
+	ByKind    map[DriftKind]int `json:"by_kind"`
+	Drifts    []Drift           `json:"drifts"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// CacheCheckSummary is the result of checking several namespaces
+type CacheCheckSummary struct {
+	Repair     bool               `json:"repair"`
+	Scanned    int                `json:"scanned"`
+	Drifted    int                `json:"drifted"`
+	Repaired   int                `json:"repaired"`
+	DurationMs int64              `json:"duration_ms"`
+	Namespaces []CacheCheckReport `json:"namespaces"`
+}
+
+// CacheChecker compares the entity caches of the services with MongoDB
+type CacheChecker struct {
+	checks []func(ctx context.Context, repair bool) (CacheCheckReport, error)
+}
+
+// NewCacheChecker creates a checker for the entity caches of the given services.
+// List pages, counts and statistics are derived data with short TTLs and are
+// not checked.
+func NewCacheChecker(users *UserService, products *ProductService, orders *OrderService) *CacheChecker {
+	return &CacheChecker{checks: []func(context.Context, bool) (CacheCheckReport, error){
+		users.CheckCache,
+		products.CheckCache,
+		orders.CheckCache,
+	}}
+}
+
+// Check scans every entity cache and reports entries that disagree with MongoDB.
+// With repair, drifted entries are evicted or rewritten from MongoDB.
+func (cc *CacheChecker) Check(ctx context.Context, repair bool) (_ CacheCheckSummary, err error) {
+	ctx, span := startSpan(ctx, "CacheChecker.Check")
+	defer endSpan(span, &err)
+
+	start := time.Now()
+	summary := CacheCheckSummary{Repair: repair}
+	for _, check := range cc.checks {
+		report, err := check(ctx, repair)
+		if err != nil {
+			return summary, err
+		}
+		summary.Scanned += report.Scanned
+		summary.Drifted += report.Drifted
+		summary.Repaired += report.Repaired
+		summary.Namespaces = append(summary.Namespaces, report)
+	}
+	summary.DurationMs = time.Since(start).Milliseconds()
+
+	return summary, nil
+}
+
+// CheckCache compares the cached users with MongoDB
+func (s *UserService) CheckCache(ctx context.Context, repair bool) (_ CacheCheckReport, err error) {
+	ctx, span := startSpan(ctx, "UserService.CheckCache")
+	defer endSpan(span, &err)
+
+	return checkCache(ctx, s.cache, s.collection, repair)
+}
+
+// CheckCache compares the cached products with MongoDB
+func (s *ProductService) CheckCache(ctx context.Context, repair bool) (_ CacheCheckReport, err error) {
+	ctx, span := startSpan(ctx, "ProductService.CheckCache")
+	defer endSpan(span, &err)
+
+	return checkCache(ctx, s.cache, s.collection, repair)
+}
+
+// CheckCache compares the cached orders with MongoDB
+func (s *OrderService) CheckCache(ctx context.Context, repair bool) (_ CacheCheckReport, err error) {
+	ctx, span := startSpan(ctx, "OrderService.CheckCache")
+	defer endSpan(span, &err)
+
+	return checkCache(ctx, s.cache, s.collection, repair)
+}
+
+// checkCache scans the entries of c batch by batch, loading the matching
+// documents of collection with one query per batch
+func checkCache[T any](ctx context.Context, c *cache.Cache[T], collection *mongo.Collection, repair bool) (CacheCheckReport, error) {
+	report := CacheCheckReport{Namespace: c.Namespace(), ByKind: map[DriftKind]int{}}
+
+	record := func(key string, kind DriftKind, repaired string) {
+		report.Drifted++
+		report.ByKind[kind]++
+		if repaired != "" {
+			report.Repaired++
+		}
+		if len(report.Drifts) < maxReportedDrifts {
+			report.Drifts = append(report.Drifts, Drift{Key: key, Kind: kind, Repair: repaired})
+		} else {
+			report.Truncated = true
+		}
+	}
+
+	err := c.Scan(ctx, func(entries []cache.StoredEntry[T]) error {
+		report.Scanned += len(entries)
+
+		ids := make([]primitive.ObjectID, 0, len(entries))
+		for _, e := range entries {
+			if id, err := primitive.ObjectIDFromHex(e.ID); err == nil && !id.IsZero() {
+				ids = append(ids, id)
+			}
+		}
+		docs, err := findByIDs[T](ctx, collection, ids)
+		if err != nil {
+			return err
+		}
+
+		// Outdated keys have no ID in the current version and are deleted as raw
+		// keys; the others go through Delete so in-process tiers drop them too
+		var evictKeys, evictIDs []string
+		evictKey := func(e cache.StoredEntry[T], kind DriftKind) {
+			repaired := ""
+			if repair {
+				if e.Outdated {
+					evictKeys = append(evictKeys, e.Key)
+				} else {
+					evictIDs = append(evictIDs, e.ID)
+				}
+				repaired = "evicted"
+			}
+			record(e.Key, kind, repaired)
+		}
+
+		for _, e := range entries {
+			if e.Outdated {
+				evictKey(e, DriftOutdated)
+				continue
+			}
+			id, err := primitive.ObjectIDFromHex(e.ID)
+			if err != nil || id.IsZero() {
+				evictKey(e, DriftInvalidID)
+				continue
+			}
+			if e.Err != nil {
+				evictKey(e, DriftUndecodable)
+				continue
+			}
+
+			doc, exists := docs[id]
+			switch {
+			case e.NotFound && exists:
+				evictKey(e, DriftStaleNotFound)
+			case e.NotFound:
+				// Not-found results always carry the negative TTL
+			case !exists:
+				evictKey(e, DriftMissing)
+			case !reflect.DeepEqual(e.Value, doc):
+				rewriteEntry(ctx, c, e, doc, DriftMismatch, repair, record)
+			case e.TTL < 0:
+				rewriteEntry(ctx, c, e, doc, DriftNoTTL, repair, record)
+			}
+		}
+
+		c.Delete(ctx, evictIDs...)
+		if err := c.DeleteKeys(ctx, evictKeys...); err != nil {
+			return fmt.Errorf("failed to evict outdated entries: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to check %s cache: %w", c.Namespace(), err)
+	}
+
+	return report, nil
+}
+
+// rewriteEntry records a drifted value and, with repair, replaces it with doc
+func rewriteEntry[T any](ctx context.Context, c *cache.Cache[T], e cache.StoredEntry[T], doc T, kind DriftKind, repair bool, record func(string, DriftKind, string)) {
+	if !repair {
+		record(e.Key, kind, "")
+		return
+	}
+	c.Set(ctx, e.ID, doc)
+	record(e.Key, kind, "rewritten")
+}
+
+// findByIDs loads the documents with ids, keyed by _id
+func findByIDs[T any](ctx context.Context, collection *mongo.Collection, ids []primitive.ObjectID) (map[primitive.ObjectID]T, error) {
+	docs := make(map[primitive.ObjectID]T, len(ids))
+	if len(ids) == 0 {
+		return docs, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load documents: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc T
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode document: %w", err)
+		}
+		id, ok := cursor.Current.Lookup("_id").ObjectIDOK()
+		if !ok {
+			continue
+		}
+		docs[id] = doc
+	}
+	return docs, cursor.Err()
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"backend/config"
+	"backend/stream"
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// changeHub fans the change stream out to the live clients of this instance
+var changeHub *stream.Hub
+
+// StartChangeStream tails the change stream so clients of this instance receive
+// the changes made through every instance
+func StartChangeStream(ctx context.Context) {
+	changeHub = stream.NewHub(changeFeed(), config.StreamBuffer, int64(config.StreamReplayLimit))
+	changeHub.Start(ctx)
+}
+
+// SubscribeChanges returns a listener for the changes made from now on, preceded
+// by those made after the change with ID after when it is set
+func SubscribeChanges(ctx context.Context, after string) (_ *stream.Listener, err error) {
+	ctx, span := startSpan(ctx, "SubscribeChanges")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	if changeHub == nil || !utils.RedisAvailable() {
+		return nil, fmt.Errorf("%w: change stream unavailable", ErrUnavailable)
+	}
+	listener, err := changeHub.Subscribe(ctx, after)
+	if errors.Is(err, stream.ErrInvalidID) {
+		return nil, fmt.Errorf("%w: invalid Last-Event-ID", ErrInvalidInput)
+	}
+	return listener, err
+}
+
+// changeFeed returns the stream the services append their changes to
+func changeFeed() *stream.Feed {
+	return stream.NewFeed(utils.RedisClient, config.StreamKey, int64(config.StreamMaxLen))
+}
+
+// publishChange tells live clients that a document was created, updated or
+// deleted. doc is the document after the change, or before it for a delete, and
+// owner the user it belongs to. Like cache invalidation it is best effort: a
+// change that cannot be published is logged and skipped.
+func publishChange(ctx context.Context, resource, action string, id primitive.ObjectID, owner string, doc any) {
+	if !utils.RedisAvailable() {
+		return
+	}
+	logger := utils.LoggerFromContext(ctx)
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		logger.Warn("failed to encode change", "resource", resource, "id", id.Hex(), "error", err)
+		return
+	}
+	_, err = changeFeed().Append(ctx, stream.Change{
+		Resource:  resource,
+		Action:    action,
+		EntityID:  id.Hex(),
+		Owner:     owner,
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		logger.Warn("failed to publish change", "resource", resource, "action", action, "id", id.Hex(), "error", err)
+	}
+}
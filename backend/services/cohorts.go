@@ -0,0 +1,241 @@
+package services
+
+import (
+	"backend/config"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxCohortPeriods caps the number of periods after signup a cohort report
+// follows
+const maxCohortPeriods = 120
+
+// CohortQuery selects the cohorts of a report: the users who signed up in each
+// bucket of Stats, followed for Periods buckets after the one they signed up
+// in, counting the orders Status selects
+type CohortQuery struct {
+	Stats   StatsQuery
+	Periods int
+	Status  StatusFilter
+}
+
+// CohortReport is the retention matrix of the cohorts, one row per cohort
+type CohortReport struct {
+	Granularity string   `json:"granularity"`
+	Cohorts     []Cohort `json:"cohorts"`
+	// Users, RepeatPurchaseRate and TimeToSecondOrder cover every cohort
+	Users              int64              `json:"users"`
+	RepeatPurchaseRate float64            `json:"repeat_purchase_rate"`
+	TimeToSecondOrder  *TimeToSecondOrder `json:"time_to_second_order"`
+}
+
+// Cohort is the retention of the users who signed up in one bucket
+type Cohort struct {
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	Users  int64     `json:"users"`
+	// Active[n] counts the users of the cohort who ordered n periods after the
+	// one they signed up in, and Retention[n] is their share of the cohort.
+	// Periods that have not started yet are left out.
+	Active    []int64   `json:"active"`
+	Retention []float64 `json:"retention"`
+	// RepeatPurchaseRate is the share of the cohort that ordered at least twice
+	RepeatPurchaseRate float64 `json:"repeat_purchase_rate"`
+	// TimeToSecondOrder is nil when nobody in the cohort ordered twice
+	TimeToSecondOrder *TimeToSecondOrder `json:"time_to_second_order"`
+}
+
+// TimeToSecondOrder is how long users took to place their second order after
+// their first
+type TimeToSecondOrder struct {
+	Users       int64   `json:"users"`
+	MedianHours float64 `json:"median_hours"`
+	MeanHours   float64 `json:"mean_hours"`
+}
+
+// NewCohortQuery validates the query; periods defaults to the number of
+// buckets the statistics endpoints report by default
+func NewCohortQuery(q StatsQuery, periods int, status StatusFilter) (CohortQuery, error) {
+	if periods == 0 {
+		periods = defaultBuckets[q.Granularity]
+	}
+	if periods < 1 || periods > maxCohortPeriods {
+		return CohortQuery{}, fmt.Errorf("%w: periods must be between 1 and %d", ErrInvalidInput, maxCohortPeriods)
+	}
+	return CohortQuery{Stats: q, Periods: periods, Status: status}, nil
+}
+
+// cacheID identifies the query within the cohort cache
+func (q CohortQuery) cacheID() string {
+	return fmt.Sprintf("%s:periods=%d:%s", q.Stats.cacheID(), q.Periods, q.Status.cacheID())
+}
+
+// GetCohorts groups the users who signed up in the range of q by signup bucket
+// and reports, for each group, the share that ordered in each of the following
+// periods, the share that ordered more than once and how long they took to
+// order again
+func (s *UserService) GetCohorts(ctx context.Context, q CohortQuery) (_ *CohortReport, err error) {
+	ctx, span := startSpan(ctx, "UserService.GetCohorts")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	report, err := s.cohortCache.GetOrLoad(ctx, q.cacheID(), func(ctx context.Context) (CohortReport, error) {
+		return s.aggregateCohorts(ctx, q, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// cohortMember is a user with the times of their orders, earliest first
+type cohortMember struct {
+	SignedUp time.Time   `bson:"signed_up"`
+	Orders   []time.Time `bson:"orders"`
+}
+
+func (s *UserService) aggregateCohorts(ctx context.Context, q CohortQuery, now time.Time) (CohortReport, error) {
+	orderMatch := append(q.Status.match("status"),
+		bson.E{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{"$user_id", "$$user_id"}}}})
+	pipeline := mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.D{{Key: "_created_at", Value: createdAt}}}},
+		{{Key: "$match", Value: bson.D{{Key: "_created_at", Value: bson.D{{Key: "$gte", Value: q.Stats.From}, {Key: "$lt", Value: q.Stats.To}}}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "orders"},
+			{Key: "let", Value: bson.D{{Key: "user_id", Value: "$_id"}}},
+			{Key: "pipeline", Value: bson.A{
+				bson.D{{Key: "$match", Value: orderMatch}},
+				bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "at", Value: createdAt}}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "at", Value: 1}}}},
+			}},
+			{Key: "as", Value: "_orders"},
+		}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "signed_up", Value: "$_created_at"},
+			{Key: "orders", Value: "$_orders.at"},
+		}}},
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return CohortReport{}, fmt.Errorf("failed to aggregate cohorts: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var members []cohortMember
+	for cursor.Next(ctx) {
+		var member cohortMember
+		if err := cursor.Decode(&member); err != nil {
+			return CohortReport{}, fmt.Errorf("failed to decode cohort member: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err := cursor.Err(); err != nil {
+		return CohortReport{}, fmt.Errorf("failed to aggregate cohorts: %w", err)
+	}
+	return q.report(members, now), nil
+}
+
+// report builds the retention matrix of members as of now
+func (q CohortQuery) report(members []cohortMember, now time.Time) CohortReport {
+	starts := q.Stats.Buckets()
+	cohorts := make([]Cohort, len(starts))
+	// periods maps the start of each period a cohort is followed for to its
+	// index, per cohort
+	periods := make([]map[int64]int, len(starts))
+	byStart := make(map[int64]int, len(starts))
+	for i, start := range starts {
+		cohorts[i] = Cohort{Period: q.Stats.Label(start), Start: start, Active: []int64{}}
+		periods[i] = map[int64]int{}
+		for n, period := 0, start; n <= q.Periods && !period.After(now); n, period = n+1, q.Stats.next(period) {
+			periods[i][period.UnixMilli()] = n
+			cohorts[i].Active = append(cohorts[i].Active, 0)
+		}
+		byStart[start.UnixMilli()] = i
+	}
+
+	secondOrders := make([][]time.Duration, len(starts))
+	repeaters := make([]int64, len(starts))
+	for _, member := range members {
+		i, ok := byStart[q.Stats.Truncate(member.SignedUp).UnixMilli()]
+		if !ok {
+			continue
+		}
+		cohorts[i].Users++
+
+		seen := map[int]bool{}
+		for _, at := range member.Orders {
+			// Orders from before the signup of users migrated with their history
+			// fall outside every period
+			if n, ok := periods[i][q.Stats.Truncate(at).UnixMilli()]; ok && !seen[n] {
+				seen[n] = true
+				cohorts[i].Active[n]++
+			}
+		}
+		if len(member.Orders) >= 2 {
+			repeaters[i]++
+			secondOrders[i] = append(secondOrders[i], member.Orders[1].Sub(member.Orders[0]))
+		}
+	}
+
+	report := CohortReport{Granularity: q.Stats.Granularity, Cohorts: cohorts}
+	var allRepeaters int64
+	var allSecondOrders []time.Duration
+	for i := range cohorts {
+		c := &cohorts[i]
+		c.Retention = make([]float64, len(c.Active))
+		for n, active := range c.Active {
+			c.Retention[n] = share(active, c.Users)
+		}
+		c.RepeatPurchaseRate = share(repeaters[i], c.Users)
+		c.TimeToSecondOrder = timeToSecondOrder(secondOrders[i])
+
+		report.Users += c.Users
+		allRepeaters += repeaters[i]
+		allSecondOrders = append(allSecondOrders, secondOrders[i]...)
+	}
+	report.RepeatPurchaseRate = share(allRepeaters, report.Users)
+	report.TimeToSecondOrder = timeToSecondOrder(allSecondOrders)
+	return report
+}
+
+// share returns part as a fraction of whole, rounded to four places, or 0 for
+// an empty whole
+func share(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return math.Round(float64(part)/float64(whole)*10000) / 10000
+}
+
+// timeToSecondOrder summarises the gaps between first and second orders, or
+// returns nil when there are none
+func timeToSecondOrder(gaps []time.Duration) *TimeToSecondOrder {
+	if len(gaps) == 0 {
+		return nil
+	}
+	slices.Sort(gaps)
+
+	var total time.Duration
+	for _, gap := range gaps {
+		total += gap
+	}
+	median := gaps[len(gaps)/2]
+	if len(gaps)%2 == 0 {
+		median = (gaps[len(gaps)/2-1] + median) / 2
+	}
+	return &TimeToSecondOrder{
+		Users:       int64(len(gaps)),
+		MedianHours: math.Round(median.Hours()*100) / 100,
+		MeanHours:   math.Round(total.Hours()/float64(len(gaps))*100) / 100,
+	}
+}
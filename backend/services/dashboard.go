@@ -0,0 +1,325 @@
+package services
+
+import (
+	"backend/cache"
+	"backend/config"
+	"backend/models"
+	"backend/utils"
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/errgroup"
+)
+
+// DashboardService summarises users, products and orders for the landing page
+type DashboardService struct {
+	users    *UserService
+	products *ProductService
+	orders   *OrderService
+	cache    *cache.Cache[Dashboard]
+}
+
+// DashboardWindow is the period a dashboard reports on, [From, To). It is
+// compared with the period of the same length just before it.
+type DashboardWindow struct {
+	From time.Time
+	To   time.Time
+}
+
+// Dashboard is the summary of one window
+type Dashboard struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// PreviousFrom starts the period the window is compared with, which ends at From
+	PreviousFrom time.Time `json:"previous_from"`
+	// Users, Products and Orders are totals, at To and at From
+	Users    DashboardMetric `json:"users"`
+	Products DashboardMetric `json:"products"`
+	Orders   DashboardMetric `json:"orders"`
+	// NewUsers, NewOrders, Revenue and AverageOrderValue cover the window and
+	// the previous period
+	NewUsers          DashboardMetric  `json:"new_users"`
+	NewOrders         DashboardMetric  `json:"new_orders"`
+	Revenue           DashboardMetric  `json:"revenue"`
+	AverageOrderValue DashboardMetric  `json:"average_order_value"`
+	RecentOrders      []models.Order   `json:"recent_orders"`
+	LowStockProducts  []models.Product `json:"low_stock_products"`
+}
+
+// DashboardMetric is a figure for the window and for the previous period
+type DashboardMetric struct {
+	Current  float64 `json:"current"`
+	Previous float64 `json:"previous"`
+	// ChangePercent is nil when the previous figure is 0
+	ChangePercent *float64 `json:"change_percent"`
+}
+
+// NewDashboardService creates a new instance of DashboardService
+func NewDashboardService(users *UserService, products *ProductService, orders *OrderService) *DashboardService {
+	s := &DashboardService{
+		users:    users,
+		products: products,
+		orders:   orders,
+		cache:    newCache[Dashboard](utils.RedisClient, "dashboard", config.CacheTTLStats, collectionTags("users", "products", "orders")),
+	}
+	purgeOnRecovery(s.cache)
+
+	return s
+}
+
+// NewDashboardWindow validates the window. Without to it ends now, and without
+// from it starts at the start of the period of granularity, in loc, that to
+// falls in; right at the start of a period it covers the whole previous one.
+func NewDashboardWindow(granularity string, from, to time.Time, loc *time.Location) (DashboardWindow, error) {
+	if to.IsZero() {
+		// Rounded so the results of repeated requests can be cached
+		to = time.Now().Truncate(time.Minute)
+	}
+	if from.IsZero() {
+		q, err := NewStatsQuery(granularity, time.Time{}, to, loc)
+		if err != nil {
+			return DashboardWindow{}, err
+		}
+		if from = q.Truncate(to); from.Equal(to) {
+			from = q.previous(from)
+		}
+	}
+
+	w := DashboardWindow{From: from, To: to}
+	if !from.Before(to) {
+		return w, fmt.Errorf("%w: from must be before to", ErrInvalidInput)
+	}
+	return w, nil
+}
+
+// previousFrom returns the start of the period before the window
+func (w DashboardWindow) previousFrom() time.Time {
+	return w.From.Add(-w.To.Sub(w.From))
+}
+
+// GetDashboard summarises the window, running its queries concurrently
+func (s *DashboardService) GetDashboard(ctx context.Context, w DashboardWindow) (_ *Dashboard, err error) {
+	ctx, span := startSpan(ctx, "DashboardService.GetDashboard")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	id := fmt.Sprintf("from=%d:to=%d", w.From.Unix(), w.To.Unix())
+	dashboard, err := s.cache.GetOrLoad(ctx, id, func(ctx context.Context) (Dashboard, error) {
+		return s.summarise(ctx, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dashboard, nil
+}
+
+func (s *DashboardService) summarise(ctx context.Context, w DashboardWindow) (Dashboard, error) {
+	var (
+		users, products, orders, revenue windowTotals
+		recent                           []models.Order
+		lowStock                         []models.Product
+	)
+
+	// Each query writes only its own variables
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() (err error) {
+		users, err = totalWindows(ctx, s.users.collection, w)
+		return err
+	})
+	g.Go(func() (err error) {
+		products, err = totalWindows(ctx, s.products.collection, w)
+		return err
+	})
+	g.Go(func() (err error) {
+		orders, err = totalWindows(ctx, s.orders.collection, w)
+		return err
+	})
+	g.Go(func() (err error) {
+		revenue, err = s.revenueWindows(ctx, w)
+		return err
+	})
+	g.Go(func() (err error) {
+		recent, err = s.recentOrders(ctx)
+		return err
+	})
+	g.Go(func() (err error) {
+		lowStock, err = s.lowStockProducts(ctx)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return Dashboard{}, err
+	}
+
+	return Dashboard{
+		From:              w.From,
+		To:                w.To,
+		PreviousFrom:      w.previousFrom(),
+		Users:             newMetric(float64(users.total()), float64(users.total()-users.Current.Count)),
+		Products:          newMetric(float64(products.total()), float64(products.total()-products.Current.Count)),
+		Orders:            newMetric(float64(orders.total()), float64(orders.total()-orders.Current.Count)),
+		NewUsers:          newMetric(float64(users.Current.Count), float64(users.Previous.Count)),
+		NewOrders:         newMetric(float64(orders.Current.Count), float64(orders.Previous.Count)),
+		Revenue:           newMetric(roundMoney(revenue.Current.Revenue), roundMoney(revenue.Previous.Revenue)),
+		AverageOrderValue: newMetric(revenue.Current.averageValue(), revenue.Previous.averageValue()),
+		RecentOrders:      recent,
+		LowStockProducts:  lowStock,
+	}, nil
+}
+
+// windowTotal counts the documents created in a period and, for orders, what
+// they are worth
+type windowTotal struct {
+	Count   int64
+	Revenue float64
+}
+
+func (t windowTotal) averageValue() float64 {
+	if t.Count == 0 {
+		return 0
+	}
+	return roundMoney(t.Revenue / float64(t.Count))
+}
+
+// windowTotals is the total of the window, of the period before it and of
+// everything earlier
+type windowTotals struct {
+	Current  windowTotal
+	Previous windowTotal
+	Earlier  windowTotal
+}
+
+// total counts the documents created before the end of the window
+func (t windowTotals) total() int64 {
+	return t.Earlier.Count + t.Previous.Count + t.Current.Count
+}
+
+// totalWindows counts the documents of collection created before the end of
+// the window, split as windowTotals is. Deleted documents are not counted in
+// any period.
+func totalWindows(ctx context.Context, collection *mongo.Collection, w DashboardWindow) (windowTotals, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.D{{Key: "_created_at", Value: createdAt}}}},
+		{{Key: "$match", Value: bson.D{{Key: "_created_at", Value: bson.D{{Key: "$lt", Value: w.To}}}}}},
+		{{Key: "$addFields", Value: bson.D{{Key: "_period", Value: bson.D{{Key: "$switch", Value: bson.D{
+			{Key: "branches", Value: bson.A{
+				bson.D{{Key: "case", Value: bson.D{{Key: "$gte", Value: bson.A{"$_created_at", w.From}}}}, {Key: "then", Value: "current"}},
+				bson.D{{Key: "case", Value: bson.D{{Key: "$gte", Value: bson.A{"$_created_at", w.previousFrom()}}}}, {Key: "then", Value: "previous"}},
+			}},
+			{Key: "default", Value: "earlier"},
+		}}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$_period"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return windowTotals{}, fmt.Errorf("failed to aggregate %s: %w", collection.Name(), err)
+	}
+	var rows []struct {
+		Period string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return windowTotals{}, fmt.Errorf("failed to decode %s totals: %w", collection.Name(), err)
+	}
+
+	var totals windowTotals
+	for _, row := range rows {
+		switch row.Period {
+		case "current":
+			totals.Current.Count = row.Count
+		case "previous":
+			totals.Previous.Count = row.Count
+		default:
+			totals.Earlier.Count = row.Count
+		}
+	}
+	return totals, nil
+}
+
+// revenueWindows totals the orders created in the window and in the period
+// before it and what they are worth
+func (s *DashboardService) revenueWindows(ctx context.Context, w DashboardWindow) (windowTotals, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.D{{Key: "_created_at", Value: createdAt}}}},
+		{{Key: "$match", Value: bson.D{{Key: "_created_at", Value: bson.D{{Key: "$gte", Value: w.previousFrom()}, {Key: "$lt", Value: w.To}}}}}},
+	}
+	pipeline = append(pipeline, orderValueStages()...)
+	pipeline = append(pipeline, bson.D{{Key: "$group", Value: bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$gte", Value: bson.A{"$_created_at", w.From}}}},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		{Key: "revenue", Value: bson.D{{Key: "$sum", Value: "$_value"}}},
+	}}})
+
+	cursor, err := s.orders.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return windowTotals{}, fmt.Errorf("failed to aggregate revenue: %w", err)
+	}
+	var rows []struct {
+		Current bool    `bson:"_id"`
+		Count   int64   `bson:"count"`
+		Revenue float64 `bson:"revenue"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return windowTotals{}, fmt.Errorf("failed to decode revenue: %w", err)
+	}
+
+	var totals windowTotals
+	for _, row := range rows {
+		total := windowTotal{Count: row.Count, Revenue: row.Revenue}
+		if row.Current {
+			totals.Current = total
+		} else {
+			totals.Previous = total
+		}
+	}
+	return totals, nil
+}
+
+// recentOrders returns the latest config.DashboardRecentOrders orders, newest first
+func (s *DashboardService) recentOrders(ctx context.Context) ([]models.Order, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(config.DashboardRecentOrders))
+	cursor, err := s.orders.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recent orders from MongoDB: %w", err)
+	}
+	orders := []models.Order{}
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, fmt.Errorf("failed to decode recent orders: %w", err)
+	}
+	return orders, nil
+}
+
+// lowStockProducts returns up to config.LowStockLimit products whose tracked
+// stock is at most config.LowStockThreshold, lowest first
+func (s *DashboardService) lowStockProducts(ctx context.Context) ([]models.Product, error) {
+	filter := bson.M{"stock": bson.M{"$lte": config.LowStockThreshold}}
+	opts := options.Find().SetSort(bson.D{{Key: "stock", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(int64(config.LowStockLimit))
+	cursor, err := s.products.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch low-stock products from MongoDB: %w", err)
+	}
+	products := []models.Product{}
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, fmt.Errorf("failed to decode low-stock products: %w", err)
+	}
+	return products, nil
+}
+
+// newMetric compares current with previous
+func newMetric(current, previous float64) DashboardMetric {
+	m := DashboardMetric{Current: current, Previous: previous}
+	if previous != 0 {
+		change := math.Round((current-previous)/math.Abs(previous)*10000) / 100
+		m.ChangePercent = &change
+	}
+	return m
+}
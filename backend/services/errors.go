@@ -0,0 +1,41 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Error classes returned by the services. Errors wrapping one of these carry a
+// message written by us, which controllers may return to clients as-is.
+var (
+	// ErrNotFound is returned when the requested document does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidInput is returned when the caller supplied missing or malformed data
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrConflict is returned when the write would violate a uniqueness rule
+	ErrConflict = errors.New("already exists")
+	// ErrCanceled is returned when the caller's context was canceled mid-operation
+	ErrCanceled = errors.New("request canceled")
+	// ErrTimeout is returned when the operation ran past its deadline
+	ErrTimeout = errors.New("operation timed out")
+	// ErrUnavailable is returned when a store the operation depends on is down
+	ErrUnavailable = errors.New("service unavailable")
+)
+
+// classifyContextError wraps err in ErrCanceled or ErrTimeout when it was caused by
+// a context ending, so callers can tell it apart from a database failure
+func classifyContextError(err error) error {
+	switch {
+	case err == nil, errors.Is(err, ErrCanceled), errors.Is(err, ErrTimeout):
+		return err
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %w", ErrCanceled, err)
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	default:
+		return err
+	}
+}
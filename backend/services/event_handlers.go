@@ -0,0 +1,40 @@
+package services
+
+import (
+	"backend/events"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RegisterEventHandlers subscribes the services to the events they react to
+func RegisterEventHandlers(consumer *events.Consumer, orders *OrderService) {
+	events.Handle(consumer, events.PaymentSucceeded, orders.handlePaymentSucceeded)
+}
+
+// RegisterWebhookHandlers queues a webhook delivery for every event the API
+// publishes. Its consumer should use its own group, so webhooks neither hold up
+// nor are held up by the other handlers.
+func RegisterWebhookHandlers(consumer *events.Consumer, webhooks *WebhookService) {
+	for _, eventType := range events.Types() {
+		events.Handle(consumer, eventType, webhooks.handleEvent)
+	}
+}
+
+func (s *WebhookService) handleEvent(ctx context.Context, event events.Envelope, _ json.RawMessage) error {
+	_, err := s.Enqueue(ctx, event)
+	return err
+}
+
+// handlePaymentSucceeded confirms the paid order. An order that is not found
+// yet is retried, since the payment may have been processed before the order
+// write was replicated, and dead-lettered once retries run out.
+func (s *OrderService) handlePaymentSucceeded(ctx context.Context, _ events.Envelope, payment events.PaymentSucceededPayload) error {
+	id, err := primitive.ObjectIDFromHex(payment.OrderID)
+	if err != nil {
+		return events.Permanent(fmt.Errorf("invalid order ID %q in payment %s", payment.OrderID, payment.PaymentID))
+	}
+	return s.ConfirmOrder(ctx, id)
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"backend/config"
+	"backend/events"
+	"backend/utils"
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordEvent adds an event about entityID to the outbox. Call it inside
+// withTransaction so the event is committed together with the write.
+func recordEvent(ctx context.Context, eventType string, entityID primitive.ObjectID, payload any) error {
+	event, err := events.New(eventType, entityID.Hex(), payload)
+	if err != nil {
+		return fmt.Errorf("failed to build %s event: %w", eventType, err)
+	}
+	if err := eventOutbox().Add(ctx, event); err != nil {
+		return fmt.Errorf("failed to record %s event: %w", eventType, err)
+	}
+	return nil
+}
+
+// eventOutbox returns the outbox the services record their events in
+func eventOutbox() *events.Outbox {
+	return events.NewOutbox(utils.MongoDB.Collection(config.OutboxCollection))
+}
+
+// withTransaction runs fn in a MongoDB transaction, passing it the session
+// context every read and write must use. fn may run more than once when the
+// transaction is retried, so it must not have side effects outside MongoDB.
+// On a standalone server, which has no transactions, fn runs without one.
+func withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !utils.MongoTransactions() {
+		return fn(ctx)
+	}
+
+	session, err := utils.MongoClient.StartSession()
+	if err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// fixedFields are the fields no update may set: changing createdAt would move
+// a document to another statistics bucket without its rollups following
+var fixedFields = []string{"_id", "createdAt"}
+
+// checkSet rejects an update setting one of fixedFields
+func checkSet(set bson.M) error {
+	for field := range set {
+		for _, fixed := range fixedFields {
+			if field == fixed || strings.HasPrefix(field, fixed+".") {
+				return fmt.Errorf("%w: field %q cannot be updated", ErrInvalidInput, fixed)
+			}
+		}
+	}
+	return nil
+}
+
+// updateReturningBefore applies set to the document with id and returns it as it
+// was before the update, so callers can tell what changed. The UpdateResult
+// matches what UpdateOne would have returned.
+func updateReturningBefore(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, set bson.M) (*mongo.UpdateResult, bson.Raw, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	before, err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": set}, opts).Raw()
+	if err == mongo.ErrNoDocuments {
+		return &mongo.UpdateResult{}, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	result := &mongo.UpdateResult{MatchedCount: 1}
+	if changed(before, set) {
+		result.ModifiedCount = 1
+	}
+	return result, before, nil
+}
+
+// deleteReturning deletes the document with id and returns it, or nil when there
+// was none. The DeleteResult matches what DeleteOne would have returned.
+func deleteReturning(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID) (*mongo.DeleteResult, bson.Raw, error) {
+	doc, err := collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Raw()
+	if err == mongo.ErrNoDocuments {
+		return &mongo.DeleteResult{}, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return &mongo.DeleteResult{DeletedCount: 1}, doc, nil
+}
+
+// changed reports whether applying set to doc changes any field
+func changed(doc bson.Raw, set bson.M) bool {
+	for field, value := range set {
+		t, data, err := bson.MarshalValue(value)
+		if err != nil {
+			return true
+		}
+		old, err := doc.LookupErr(field)
+		if err != nil || !old.Equal(bson.RawValue{Type: t, Value: data}) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySet decodes before into old and returns it along with the result of
+// applying set to it
+func applySet[T any](before bson.Raw, set bson.M) (old, updated T, err error) {
+	if err := bson.Unmarshal(before, &old); err != nil {
+		return old, updated, err
+	}
+	data, err := bson.Marshal(set)
+	if err != nil {
+		return old, updated, err
+	}
+	if err := bson.Unmarshal(before, &updated); err != nil {
+		return old, updated, err
+	}
+	return old, updated, bson.Unmarshal(data, &updated)
+}
@@ -0,0 +1,31 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCheckSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     bson.M
+		wantErr bool
+	}{
+		{name: "other fields", set: bson.M{"name": "Ann", "price": 10}},
+		{name: "field named like a fixed one", set: bson.M{"createdAtNote": "x"}},
+		{name: "ID", set: bson.M{"name": "Ann", "_id": "x"}, wantErr: true},
+		{name: "creation time", set: bson.M{"createdAt": "2020-01-01T00:00:00Z"}, wantErr: true},
+		{name: "part of the creation time", set: bson.M{"createdAt.date": 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSet(tt.set)
+			if tt.wantErr != errors.Is(err, ErrInvalidInput) || (!tt.wantErr && err != nil) {
+				t.Errorf("checkSet = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"backend/config"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/montanaflynn/stats"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Forecast models
+const (
+	// ModelMovingAverage projects the mean of the last Window periods
+	ModelMovingAverage = "moving_average"
+	// ModelHoltWinters projects level, trend and seasonality, additive
+	ModelHoltWinters = "holt_winters"
+)
+
+// Forecast metrics
+const (
+	MetricOrders  = "orders"
+	MetricUnits   = "units"
+	MetricRevenue = "revenue"
+)
+
+// maxForecastHorizon caps the number of periods a forecast projects
+const maxForecastHorizon = 366
+
+// seasonLengths is the length of the cycle demand is assumed to repeat over,
+// in buckets of each granularity; years have none
+var seasonLengths = map[string]int{
+	GranularityHour:    24,
+	GranularityDay:     7,
+	GranularityWeek:    52,
+	GranularityMonth:   12,
+	GranularityQuarter: 4,
+	GranularityYear:    1,
+}
+
+// holtWintersGrid holds the smoothing factors tried when fitting Holt-Winters
+var holtWintersGrid = []float64{0.1, 0.3, 0.5, 0.7, 0.9}
+
+// ForecastQuery selects the history a forecast is fitted on and what it projects
+type ForecastQuery struct {
+	// Stats is the history, which ends before the current, incomplete bucket
+	// unless asked otherwise
+	Stats   StatsQuery
+	Horizon int
+	Metric  string
+	// Model is empty to use Holt-Winters when the history covers two seasons
+	// and a moving average otherwise
+	Model  string
+	Window int
+	// Confidence is the probability the interval around a forecast covers
+	Confidence float64
+	Status     StatusFilter
+}
+
+// Forecast is a history and its projection, one point per period, in the order
+// of the periods
+type Forecast struct {
+	Granularity string `json:"granularity"`
+	Metric      string `json:"metric"`
+	Model       string `json:"model"`
+	// SeasonLength is set for Holt-Winters and Window for moving averages
+	SeasonLength int     `json:"season_length,omitempty"`
+	Window       int     `json:"window,omitempty"`
+	Confidence   float64 `json:"confidence"`
+	// ProductID is set on the forecasts of one product
+	ProductID *primitive.ObjectID `json:"product_id,omitempty"`
+	Points    []ForecastPoint     `json:"points"`
+}
+
+// ForecastPoint is one period of a forecast. Past periods have Actual and,
+// once the model has enough history, Fitted, the model's estimate one period
+// ahead; future periods have Forecast between Lower and Upper. The other
+// fields are null.
+type ForecastPoint struct {
+	Period   string    `json:"period"`
+	Start    time.Time `json:"start"`
+	Actual   *float64  `json:"actual"`
+	Fitted   *float64  `json:"fitted"`
+	Forecast *float64  `json:"forecast"`
+	Lower    *float64  `json:"lower"`
+	Upper    *float64  `json:"upper"`
+}
+
+// NewForecastQuery validates the query. Without to the history ends where the
+// current bucket of granularity starts, and without from it covers three
+// seasons, or the number of buckets the statistics endpoints report by default
+// if that is more. Horizon defaults to one season, window to one season too,
+// confidence to 0.95 and metric to orders.
+func NewForecastQuery(granularity string, from, to time.Time, loc *time.Location, horizon int, metric, model string, window int, confidence float64, status StatusFilter) (ForecastQuery, error) {
+	if granularity == "" {
+		granularity = GranularityDay
+	}
+	current, err := NewStatsQuery(granularity, time.Time{}, time.Time{}, loc)
+	if err != nil {
+		return ForecastQuery{}, err
+	}
+	season := seasonLengths[granularity]
+	if to.IsZero() {
+		to = current.Truncate(time.Now())
+	}
+	if from.IsZero() {
+		from = current.shift(current.Truncate(to), -max(3*season, defaultBuckets[granularity]))
+	}
+	history, err := NewStatsQuery(granularity, from, to, loc)
+	if err != nil {
+		return ForecastQuery{}, err
+	}
+
+	q := ForecastQuery{
+		Stats:      history,
+		Horizon:    horizon,
+		Metric:     metric,
+		Model:      model,
+		Window:     window,
+		Confidence: confidence,
+		Status:     status,
+	}
+	if q.Horizon == 0 {
+		q.Horizon = max(season, defaultBuckets[granularity]/2)
+	}
+	if q.Metric == "" {
+		q.Metric = MetricOrders
+	}
+	if q.Window == 0 {
+		q.Window = max(season, 3)
+	}
+	if q.Confidence == 0 {
+		q.Confidence = 0.95
+	}
+
+	switch {
+	case q.Horizon < 1 || q.Horizon > maxForecastHorizon:
+		return q, fmt.Errorf("%w: horizon must be between 1 and %d", ErrInvalidInput, maxForecastHorizon)
+	case q.Metric != MetricOrders && q.Metric != MetricUnits && q.Metric != MetricRevenue:
+		return q, fmt.Errorf("%w: metric must be orders, units or revenue", ErrInvalidInput)
+	case q.Model != "" && q.Model != ModelMovingAverage && q.Model != ModelHoltWinters:
+		return q, fmt.Errorf("%w: model must be moving_average or holt_winters", ErrInvalidInput)
+	case q.Window < 1:
+		return q, fmt.Errorf("%w: window must be at least 1", ErrInvalidInput)
+	case q.Confidence <= 0 || q.Confidence >= 1:
+		return q, fmt.Errorf("%w: confidence must be between 0 and 1", ErrInvalidInput)
+	}
+	return q, nil
+}
+
+// cacheID identifies the query within the forecast cache
+func (q ForecastQuery) cacheID() string {
+	return fmt.Sprintf("%s:horizon=%d:metric=%s:model=%s:window=%d:confidence=%g:%s",
+		q.Stats.cacheID(), q.Horizon, q.Metric, q.Model, q.Window, q.Confidence, q.Status.cacheID())
+}
+
+// ForecastOrders projects the metric of q over all orders for the next
+// q.Horizon periods
+func (s *OrderService) ForecastOrders(ctx context.Context, q ForecastQuery) (_ *Forecast, err error) {
+	ctx, span := startSpan(ctx, "OrderService.ForecastOrders")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	forecast, err := s.forecastCache.GetOrLoad(ctx, "all:"+q.cacheID(), func(ctx context.Context) (Forecast, error) {
+		rows, err := bucketRows(ctx, rollupOrders, q.Stats, q.Status, func(ctx context.Context) ([]bucketCount, error) {
+			return s.orderRows(ctx, q.Stats, q.Status)
+		})
+		if err != nil {
+			return Forecast{}, err
+		}
+		return q.forecast(rows)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &forecast, nil
+}
+
+// ForecastProduct projects the metric of q over the orders of one product for
+// the next q.Horizon periods
+func (s *OrderService) ForecastProduct(ctx context.Context, productID primitive.ObjectID, q ForecastQuery) (_ *Forecast, err error) {
+	ctx, span := startSpan(ctx, "OrderService.ForecastProduct")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	forecast, err := s.forecastCache.GetOrLoad(ctx, productID.Hex()+":"+q.cacheID(), func(ctx context.Context) (Forecast, error) {
+		if err := s.products.FindOne(ctx, bson.M{"_id": productID}).Err(); errors.Is(err, mongo.ErrNoDocuments) {
+			return Forecast{}, fmt.Errorf("product %w", ErrNotFound)
+		} else if err != nil {
+			return Forecast{}, fmt.Errorf("failed to fetch product: %w", err)
+		}
+
+		match := append(q.Status.match("status"), bson.E{Key: "product_id", Value: productID})
+		rows, err := s.orderRowsMatching(ctx, q.Stats, match)
+		if err != nil {
+			return Forecast{}, err
+		}
+		forecast, err := q.forecast(rows)
+		forecast.ProductID = &productID
+		return forecast, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &forecast, nil
+}
+
+// forecast fits the model of q to the history in rows and projects it
+func (q ForecastQuery) forecast(rows []bucketCount) (Forecast, error) {
+	starts := q.Stats.Buckets()
+	totals := make(map[int64]float64, len(rows))
+	for _, row := range rows {
+		switch q.Metric {
+		case MetricUnits:
+			totals[row.Start.UnixMilli()] += float64(row.Units)
+		case MetricRevenue:
+			totals[row.Start.UnixMilli()] += row.Revenue
+		default:
+			totals[row.Start.UnixMilli()] += float64(row.Count)
+		}
+	}
+	history := make([]float64, len(starts))
+	for i, start := range starts {
+		history[i] = totals[start.UnixMilli()]
+	}
+
+	f := Forecast{Granularity: q.Stats.Granularity, Metric: q.Metric, Model: q.Model, Confidence: q.Confidence}
+	season := seasonLengths[q.Stats.Granularity]
+	canSeason := season > 1 && len(history) >= 2*season
+	if f.Model == "" {
+		f.Model = ModelMovingAverage
+		if canSeason {
+			f.Model = ModelHoltWinters
+		}
+	}
+
+	var fitted, projected []float64
+	switch f.Model {
+	case ModelHoltWinters:
+		if !canSeason {
+			return f, fmt.Errorf("%w: holt_winters needs a seasonal granularity and two seasons (%d periods) of history", ErrInvalidInput, 2*season)
+		}
+		f.SeasonLength = season
+		fitted, projected = holtWinters(history, season, q.Horizon)
+	default:
+		f.Window = min(q.Window, len(history))
+		fitted, projected = movingAverage(history, f.Window, q.Horizon)
+	}
+
+	// The interval is the spread of the one-step errors on the history, widened
+	// with the square root of the distance ahead
+	var errs stats.Float64Data
+	for i, fit := range fitted {
+		if !math.IsNaN(fit) {
+			errs = append(errs, history[i]-fit)
+		}
+	}
+	var sigma float64
+	if len(errs) > 1 {
+		sigma, _ = stats.StandardDeviationSample(errs)
+	}
+	z := stats.NormPpf(0.5+q.Confidence/2, 0, 1)
+
+	f.Points = make([]ForecastPoint, 0, len(history)+q.Horizon)
+	for i, start := range starts {
+		point := ForecastPoint{Period: q.Stats.Label(start), Start: start, Actual: roundPoint(history[i])}
+		if !math.IsNaN(fitted[i]) {
+			point.Fitted = roundPoint(math.Max(fitted[i], 0))
+		}
+		f.Points = append(f.Points, point)
+	}
+	start := q.Stats.To
+	for h, value := range projected {
+		width := z * sigma * math.Sqrt(float64(h+1))
+		f.Points = append(f.Points, ForecastPoint{
+			Period: q.Stats.Label(start),
+			Start:  start,
+			// Demand is never negative
+			Forecast: roundPoint(math.Max(value, 0)),
+			Lower:    roundPoint(math.Max(value-width, 0)),
+			Upper:    roundPoint(math.Max(value+width, 0)),
+		})
+		start = q.Stats.next(start)
+	}
+	return f, nil
+}
+
+// movingAverage returns the one-step estimate of each value of history, the
+// mean of the window values before it or NaN for the first window, and the
+// next horizon values, all the mean of the last window values
+func movingAverage(history []float64, window, horizon int) (fitted, projected []float64) {
+	fitted = make([]float64, len(history))
+	for i := range history {
+		if i < window {
+			fitted[i] = math.NaN()
+			continue
+		}
+		fitted[i], _ = stats.Mean(history[i-window : i])
+	}
+
+	next := 0.0
+	if len(history) > 0 {
+		next, _ = stats.Mean(history[len(history)-window:])
+	}
+	projected = make([]float64, horizon)
+	for h := range projected {
+		projected[h] = next
+	}
+	return fitted, projected
+}
+
+// holtWinters fits additive Holt-Winters with seasons of length season to
+// history, which must cover two seasons, choosing the smoothing factors from
+// holtWintersGrid that minimise the squared one-step errors. It returns the
+// one-step estimate of each value of history, NaN for the first season, and
+// the next horizon values.
+func holtWinters(history []float64, season, horizon int) (fitted, projected []float64) {
+	best := math.Inf(1)
+	for _, alpha := range holtWintersGrid {
+		for _, beta := range holtWintersGrid {
+			for _, gamma := range holtWintersGrid {
+				f, p, sse := holtWintersFit(history, season, horizon, alpha, beta, gamma)
+				if sse < best {
+					best, fitted, projected = sse, f, p
+				}
+			}
+		}
+	}
+	return fitted, projected
+}
+
+func holtWintersFit(history []float64, season, horizon int, alpha, beta, gamma float64) (fitted, projected []float64, sse float64) {
+	// The change between the first two seasons sets the trend, the first season
+	// the level at its end and the seasonal offsets from the trend line. The
+	// smoothing starts after it, so it does not count the first season twice.
+	first, _ := stats.Mean(history[:season])
+	second, _ := stats.Mean(history[season : 2*season])
+	trend := (second - first) / float64(season)
+	level := first + trend*float64(season-1)/2
+	seasonal := make([]float64, season)
+	for i := range seasonal {
+		seasonal[i] = history[i] - (level - trend*float64(season-1-i))
+	}
+
+	fitted = make([]float64, len(history))
+	for t := range fitted[:season] {
+		fitted[t] = math.NaN()
+	}
+	for t := season; t < len(history); t++ {
+		y, s := history[t], seasonal[t%season]
+		fitted[t] = level + trend + s
+		sse += (y - fitted[t]) * (y - fitted[t])
+
+		next := alpha*(y-s) + (1-alpha)*(level+trend)
+		trend = beta*(next-level) + (1-beta)*trend
+		level = next
+		seasonal[t%season] = gamma*(y-level) + (1-gamma)*s
+	}
+
+	projected = make([]float64, horizon)
+	for h := range projected {
+		projected[h] = level + float64(h+1)*trend + seasonal[(len(history)+h)%season]
+	}
+	return fitted, projected, sse
+}
+
+func roundPoint(value float64) *float64 {
+	value = math.Round(value*100) / 100
+	return &value
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"math"
+	"testing"
+)
+
+// closeTo reports whether got and want agree, NaN agreeing with NaN
+func closeTo(got, want float64) bool {
+	if math.IsNaN(want) {
+		return math.IsNaN(got)
+	}
+	return math.Abs(got-want) < 1e-9
+}
+
+func TestMovingAverage(t *testing.T) {
+	nan := math.NaN()
+
+	tests := []struct {
+		name          string
+		history       []float64
+		window        int
+		horizon       int
+		wantFitted    []float64
+		wantProjected []float64
+	}{
+		{
+			name:          "window of three",
+			history:       []float64{1, 2, 3, 4, 5, 6},
+			window:        3,
+			horizon:       2,
+			wantFitted:    []float64{nan, nan, nan, 2, 3, 4},
+			wantProjected: []float64{5, 5},
+		},
+		{
+			name:          "window of one repeats the last value",
+			history:       []float64{4, 8, 2},
+			window:        1,
+			horizon:       3,
+			wantFitted:    []float64{nan, 4, 8},
+			wantProjected: []float64{2, 2, 2},
+		},
+		{
+			name:          "window of the whole history",
+			history:       []float64{4, 8, 3},
+			window:        3,
+			horizon:       1,
+			wantFitted:    []float64{nan, nan, nan},
+			wantProjected: []float64{5},
+		},
+		{
+			name:          "no history",
+			history:       []float64{},
+			window:        0,
+			horizon:       2,
+			wantFitted:    []float64{},
+			wantProjected: []float64{0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fitted, projected := movingAverage(tt.history, tt.window, tt.horizon)
+			if len(fitted) != len(tt.wantFitted) || len(projected) != len(tt.wantProjected) {
+				t.Fatalf("movingAverage = %v, %v; want %v, %v", fitted, projected, tt.wantFitted, tt.wantProjected)
+			}
+			for i := range fitted {
+				if !closeTo(fitted[i], tt.wantFitted[i]) {
+					t.Errorf("fitted[%d] = %v, want %v", i, fitted[i], tt.wantFitted[i])
+				}
+			}
+			for i := range projected {
+				if !closeTo(projected[i], tt.wantProjected[i]) {
+					t.Errorf("projected[%d] = %v, want %v", i, projected[i], tt.wantProjected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHoltWinters(t *testing.T) {
+	tests := []struct {
+		name    string
+		season  int
+		pattern []float64
+		trend   float64
+		seasons int
+	}{
+		{name: "weekly pattern", season: 7, pattern: []float64{10, 12, 11, 13, 20, 30, 4}, seasons: 3},
+		{name: "quarterly pattern with a trend", season: 4, pattern: []float64{5, -2, 0, -3}, trend: 0.5, seasons: 3},
+		{name: "falling trend over two seasons", season: 12, pattern: []float64{3, 1, 4, 1, 5, 9, 2, 6, 5, 3, 5, 8}, trend: -0.25, seasons: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A series that is exactly a trend plus a repeating pattern is
+			// fitted and continued without error, whatever the smoothing
+			series := func(t int) float64 { return 100 + tt.trend*float64(t) + tt.pattern[t%tt.season] }
+			history := make([]float64, tt.seasons*tt.season)
+			for i := range history {
+				history[i] = series(i)
+			}
+
+			horizon := tt.season + 2
+			fitted, projected := holtWinters(history, tt.season, horizon)
+			for i, fit := range fitted {
+				want := history[i]
+				if i < tt.season {
+					want = math.NaN()
+				}
+				if !closeTo(fit, want) {
+					t.Errorf("fitted[%d] = %v, want %v", i, fit, want)
+				}
+			}
+			if len(projected) != horizon {
+				t.Fatalf("%d projected values, want %d", len(projected), horizon)
+			}
+			for h, value := range projected {
+				if want := series(len(history) + h); !closeTo(value, want) {
+					t.Errorf("projected[%d] = %v, want %v", h, value, want)
+				}
+			}
+		})
+	}
+}
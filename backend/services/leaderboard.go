@@ -0,0 +1,190 @@
+package services
+
+import (
+	"backend/config"
+	"backend/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Leaderboard rankings
+const (
+	// RankUnits and RankRevenue rank products
+	RankUnits   = "units"
+	RankRevenue = "revenue"
+	// RankOrders and RankSpend rank users
+	RankOrders = "orders"
+	RankSpend  = "spend"
+)
+
+// maxLeaderboardLimit caps the number of entries a leaderboard returns
+const maxLeaderboardLimit = 100
+
+// LeaderboardQuery selects the orders a leaderboard is computed from and how
+// its entries are ranked
+type LeaderboardQuery struct {
+	By string
+	// From and To bound when the orders were created: [From, To)
+	From   time.Time
+	To     time.Time
+	Limit  int64
+	Status StatusFilter
+}
+
+// ProductRanking is a product's place on the products leaderboard
+type ProductRanking struct {
+	Rank      int                `json:"rank" bson:"-"`
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	// Product is nil when the product was deleted
+	Product *models.Product `json:"product" bson:"product"`
+	Units   int64           `json:"units" bson:"units"`
+	Revenue float64         `json:"revenue" bson:"revenue"`
+	Orders  int64           `json:"orders" bson:"orders"`
+}
+
+// UserRanking is a user's place on the customers leaderboard
+type UserRanking struct {
+	Rank   int                `json:"rank" bson:"-"`
+	UserID primitive.ObjectID `json:"user_id" bson:"user_id"`
+	// User is nil when the user was deleted
+	User   *models.User `json:"user" bson:"user"`
+	Orders int64        `json:"orders" bson:"orders"`
+	Units  int64        `json:"units" bson:"units"`
+	Spend  float64      `json:"spend" bson:"spend"`
+}
+
+// NewLeaderboardQuery validates the query. Without to the window ends now, and
+// without from it spans config.LeaderboardWindow; limit defaults to 10.
+func NewLeaderboardQuery(by string, from, to time.Time, limit int64, status StatusFilter) (LeaderboardQuery, error) {
+	if to.IsZero() {
+		// Rounded so the results of repeated requests can be cached
+		to = time.Now().Truncate(time.Minute)
+	}
+	if from.IsZero() {
+		from = to.Add(-config.LeaderboardWindow)
+	}
+	if limit == 0 {
+		limit = 10
+	}
+
+	q := LeaderboardQuery{By: by, From: from, To: to, Limit: limit, Status: status}
+	if !from.Before(to) {
+		return q, fmt.Errorf("%w: from must be before to", ErrInvalidInput)
+	}
+	if limit < 1 || limit > maxLeaderboardLimit {
+		return q, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidInput, maxLeaderboardLimit)
+	}
+	return q, nil
+}
+
+// cacheID identifies the query within a leaderboard cache
+func (q LeaderboardQuery) cacheID() string {
+	return fmt.Sprintf("%s:from=%d:to=%d:limit=%d:%s", q.By, q.From.Unix(), q.To.Unix(), q.Limit, q.Status.cacheID())
+}
+
+// TopProducts ranks the products ordered in the window by units sold
+// (RankUnits, the default) or by revenue (RankRevenue)
+func (s *OrderService) TopProducts(ctx context.Context, q LeaderboardQuery) (_ []ProductRanking, err error) {
+	ctx, span := startSpan(ctx, "OrderService.TopProducts")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	switch q.By {
+	case "":
+		q.By = RankUnits
+	case RankUnits, RankRevenue:
+	default:
+		return nil, fmt.Errorf("%w: products are ranked by units or revenue", ErrInvalidInput)
+	}
+
+	return s.productBoardCache.GetOrLoad(ctx, q.cacheID(), func(ctx context.Context) ([]ProductRanking, error) {
+		rankings := []ProductRanking{}
+		if err := s.rank(ctx, q, "product_id", "products", "product", &rankings); err != nil {
+			return nil, err
+		}
+		for i := range rankings {
+			rankings[i].Rank = i + 1
+			rankings[i].Revenue = roundMoney(rankings[i].Revenue)
+		}
+		return rankings, nil
+	})
+}
+
+// TopUsers ranks the users who ordered in the window by number of orders
+// (RankOrders, the default) or by total spend (RankSpend)
+func (s *OrderService) TopUsers(ctx context.Context, q LeaderboardQuery) (_ []UserRanking, err error) {
+	ctx, span := startSpan(ctx, "OrderService.TopUsers")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	switch q.By {
+	case "":
+		q.By = RankOrders
+	case RankOrders, RankSpend:
+	default:
+		return nil, fmt.Errorf("%w: users are ranked by orders or spend", ErrInvalidInput)
+	}
+
+	return s.userBoardCache.GetOrLoad(ctx, q.cacheID(), func(ctx context.Context) ([]UserRanking, error) {
+		rankings := []UserRanking{}
+		if err := s.rank(ctx, q, "user_id", "users", "user", &rankings); err != nil {
+			return nil, err
+		}
+		for i := range rankings {
+			rankings[i].Rank = i + 1
+			rankings[i].Spend = roundMoney(rankings[i].Spend)
+		}
+		return rankings, nil
+	})
+}
+
+// rank totals the orders of the window per value of the field groupBy, sorts
+// the totals by q.By, highest first, and attaches the document of collection
+// the value refers to as as. Ties are broken by ID so the order is stable.
+func (s *OrderService) rank(ctx context.Context, q LeaderboardQuery, groupBy, collection, as string, rankings any) error {
+	match := append(q.Status.match("status"), bson.E{Key: "_created_at", Value: bson.D{{Key: "$gte", Value: q.From}, {Key: "$lt", Value: q.To}}})
+	pipeline := mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.D{{Key: "_created_at", Value: createdAt}}}},
+		{{Key: "$match", Value: match}},
+	}
+	pipeline = append(pipeline, orderValueStages()...)
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$" + groupBy},
+			{Key: "units", Value: bson.D{{Key: "$sum", Value: "$quantity"}}},
+			{Key: "orders", Value: bson.D{{Key: "$sum", Value: 1}}},
+			// Revenue for a product is spend for a user
+			{Key: "revenue", Value: bson.D{{Key: "$sum", Value: "$_value"}}},
+			{Key: "spend", Value: bson.D{{Key: "$sum", Value: "$_value"}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: q.By, Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: q.Limit}},
+		bson.D{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: collection},
+			{Key: "localField", Value: "_id"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: as},
+		}}},
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: groupBy, Value: "$_id"},
+			{Key: as, Value: bson.D{{Key: "$first", Value: "$" + as}}},
+		}}},
+	)
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("failed to rank %s: %w", collection, err)
+	}
+	if err := cursor.All(ctx, rankings); err != nil {
+		return fmt.Errorf("failed to decode %s leaderboard: %w", collection, err)
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package services
+
+import (
+	"backend/cache"
+	"backend/config"
+	"backend/models"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Orders are event-sourced: every change is appended to the order events
+// collection, and the orders collection is a projection of those events that
+// can be rebuilt from them at any time. Orders written before the event log
+// existed get a baseline event holding their state at the time, on their next
+// write or when the projections are rebuilt.
+
+// maxVersionConflicts is how many times a write is retried when another write
+// to the same order appended its event first
+const maxVersionConflicts = 3
+
+// errVersionConflict is returned when the event version was already taken
+var errVersionConflict = errors.New("order was changed concurrently")
+
+// orderHistory is the state of an order after applying its events
+type orderHistory struct {
+	Order models.Order
+	// Version is the version of the last event applied, 0 when there was none
+	Version int
+	Deleted bool
+	// At is when the last event applied occurred
+	At time.Time
+}
+
+// exists reports whether the order exists in this state
+func (h orderHistory) exists() bool {
+	return h.Version > 0 && !h.Deleted
+}
+
+// RebuildResult summarises a rebuild of the order projections
+type RebuildResult struct {
+	// Baselined counts the orders that had no events yet
+	Baselined  int   `json:"baselined"`
+	Rebuilt    int   `json:"rebuilt"`
+	Removed    int   `json:"removed"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// EnsureIndexes creates the index that keeps event versions unique per order,
+// which writes rely on to detect concurrent changes
+func (s *OrderService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "order_id", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// GetOrderAsOf returns the order as it was at the given time
+func (s *OrderService) GetOrderAsOf(ctx context.Context, id primitive.ObjectID, at time.Time) (_ *models.Order, err error) {
+	ctx, span := startSpan(ctx, "OrderService.GetOrderAsOf")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	history, err := s.replay(ctx, id, at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay order: %w", err)
+	}
+	if !history.exists() {
+		return nil, fmt.Errorf("order %w at %s", ErrNotFound, at.UTC().Format(time.RFC3339))
+	}
+	return &history.Order, nil
+}
+
+// GetOrderEvents returns the events of an order, oldest first
+func (s *OrderService) GetOrderEvents(ctx context.Context, id primitive.ObjectID) (_ []models.OrderEvent, err error) {
+	ctx, span := startSpan(ctx, "OrderService.GetOrderEvents")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	orderEvents, err := s.loadEvents(ctx, id, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load order events: %w", err)
+	}
+	if len(orderEvents) == 0 {
+		return nil, fmt.Errorf("order %w", ErrNotFound)
+	}
+	return orderEvents, nil
+}
+
+// RebuildProjections records a baseline event for every order that has none,
+// then rewrites every order from its events, removing deleted ones
+func (s *OrderService) RebuildProjections(ctx context.Context) (result RebuildResult, err error) {
+	ctx, span := startSpan(ctx, "OrderService.RebuildProjections")
+	defer endSpan(span, &err)
+	start := time.Now()
+
+	cursor, err := s.collection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return result, fmt.Errorf("failed to list orders: %w", err)
+	}
+	for cursor.Next(ctx) {
+		var order models.Order
+		if err := cursor.Decode(&order); err != nil {
+			cursor.Close(ctx)
+			return result, fmt.Errorf("failed to decode order: %w", err)
+		}
+		baselined, err := s.baseline(ctx, order.ID)
+		if err != nil {
+			cursor.Close(ctx)
+			return result, err
+		}
+		if baselined {
+			result.Baselined++
+		}
+	}
+	err = cursor.Err()
+	cursor.Close(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list orders: %w", err)
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$order_id"}}}}}
+	cursor, err = s.history.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return result, fmt.Errorf("failed to list order event streams: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var group struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return result, fmt.Errorf("failed to decode order event stream: %w", err)
+		}
+		exists, err := s.RebuildProjection(ctx, group.ID)
+		if err != nil {
+			return result, err
+		}
+		if exists {
+			result.Rebuilt++
+		} else {
+			result.Removed++
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return result, fmt.Errorf("failed to list order event streams: %w", err)
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// RebuildProjection rewrites one order from its events, recording a baseline
+// first when it has none, or removes it when it was deleted. It reports whether
+// the order exists.
+func (s *OrderService) RebuildProjection(ctx context.Context, id primitive.ObjectID) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "OrderService.RebuildProjection")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	history, err := s.currentHistory(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to rebuild order %s: %w", id.Hex(), err)
+	}
+	if history.exists() {
+		err = s.project(ctx, history.Order)
+	} else if history.Version > 0 {
+		_, err = s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to project order %s: %w", id.Hex(), err)
+	}
+
+	s.invalidate(ctx, id)
+	return history.exists(), nil
+}
+
+// currentHistory returns the current state of an order from its events,
+// recording a baseline event first when the order predates the event log
+func (s *OrderService) currentHistory(ctx context.Context, id primitive.ObjectID) (orderHistory, error) {
+	if _, err := s.baseline(ctx, id); err != nil {
+		return orderHistory{}, err
+	}
+	history, err := s.replay(ctx, id, time.Time{})
+	if err != nil {
+		return history, fmt.Errorf("failed to replay order: %w", err)
+	}
+	return history, nil
+}
+
+// baseline records the current state of an order that has no events as its
+// first event, dated when the order was created. It reports whether it did.
+func (s *OrderService) baseline(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	n, err := s.history.CountDocuments(ctx, bson.M{"order_id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("failed to count order events: %w", err)
+	}
+	if n > 0 {
+		return false, nil
+	}
+
+	order, err := s.findOrder(ctx, id)
+	if errors.Is(err, cache.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to fetch order: %w", err)
+	}
+	data, err := orderData(order)
+	if err != nil {
+		return false, err
+	}
+	event := models.OrderEvent{
+		ID:         primitive.NewObjectID(),
+		OrderID:    id,
+		Version:    1,
+		Type:       models.OrderEventCreated,
+		Data:       data,
+		OccurredAt: id.Timestamp().UTC(),
+	}
+	if _, err := s.history.InsertOne(ctx, event); mongo.IsDuplicateKeyError(err) {
+		// Recorded concurrently
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to record order baseline: %w", err)
+	}
+	return true, nil
+}
+
+// replay applies the events of an order that occurred up to at, or all of them
+// when at is zero
+func (s *OrderService) replay(ctx context.Context, id primitive.ObjectID, at time.Time) (orderHistory, error) {
+	orderEvents, err := s.loadEvents(ctx, id, at)
+	if err != nil {
+		return orderHistory{}, err
+	}
+	return replayEvents(id, orderEvents)
+}
+
+// replayEvents applies the events of an order, in version order
+func replayEvents(id primitive.ObjectID, orderEvents []models.OrderEvent) (orderHistory, error) {
+	var history orderHistory
+	for _, event := range orderEvents {
+		if err := history.apply(event); err != nil {
+			return history, fmt.Errorf("failed to apply event %d of order %s: %w", event.Version, id.Hex(), err)
+		}
+	}
+	return history, nil
+}
+
+func (s *OrderService) loadEvents(ctx context.Context, id primitive.ObjectID, at time.Time) ([]models.OrderEvent, error) {
+	cursor, err := s.history.Find(ctx, eventsFilter(id, at), options.Find().SetSort(bson.D{{Key: "version", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	orderEvents := []models.OrderEvent{}
+	if err := cursor.All(ctx, &orderEvents); err != nil {
+		return nil, err
+	}
+	return orderEvents, nil
+}
+
+// eventsFilter selects the events of an order that occurred up to at, or all
+// of them when at is zero
+func eventsFilter(id primitive.ObjectID, at time.Time) bson.M {
+	filter := bson.M{"order_id": id}
+	if !at.IsZero() {
+		filter["occurred_at"] = bson.M{"$lte": at}
+	}
+	return filter
+}
+
+// apply advances the state by event
+func (h *orderHistory) apply(event models.OrderEvent) error {
+	if event.Version != h.Version+1 {
+		return fmt.Errorf("expected version %d, got %d", h.Version+1, event.Version)
+	}
+
+	switch event.Type {
+	case models.OrderEventCreated:
+		data, err := bson.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		h.Order = models.Order{}
+		if err := bson.Unmarshal(data, &h.Order); err != nil {
+			return err
+		}
+		h.Order.ID = event.OrderID
+	case models.OrderEventUpdated:
+		before, err := bson.Marshal(h.Order)
+		if err != nil {
+			return err
+		}
+		if _, h.Order, err = applySet[models.Order](before, event.Data); err != nil {
+			return err
+		}
+	case models.OrderEventDeleted:
+		h.Deleted = true
+	default:
+		return fmt.Errorf("unknown event type %q", event.Type)
+	}
+
+	h.Version = event.Version
+	h.Order.Version = event.Version
+	h.At = event.OccurredAt
+	return nil
+}
+
+// appendEvent stores the event following history, failing with
+// errVersionConflict when another write stored it first
+func (s *OrderService) appendEvent(ctx context.Context, history orderHistory, id primitive.ObjectID, eventType string, data bson.M) (models.OrderEvent, error) {
+	event := nextEvent(history, id, eventType, data, time.Now())
+	_, err := s.history.InsertOne(ctx, event)
+	return event, appendError(err)
+}
+
+// nextEvent returns the event following history, occurring at now
+func nextEvent(history orderHistory, id primitive.ObjectID, eventType string, data bson.M, now time.Time) models.OrderEvent {
+	event := models.OrderEvent{
+		ID:         primitive.NewObjectID(),
+		OrderID:    id,
+		Version:    history.Version + 1,
+		Type:       eventType,
+		Data:       data,
+		OccurredAt: now.UTC(),
+	}
+	// Clocks of different instances may disagree; keep events in time order so
+	// replaying up to a time never skips one
+	if event.OccurredAt.Before(history.At) {
+		event.OccurredAt = history.At
+	}
+	return event
+}
+
+// appendError returns the error of storing an event: errVersionConflict when
+// its version was taken, which the unique index reports as a duplicate key
+func appendError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return errVersionConflict
+	} else if err != nil {
+		return fmt.Errorf("failed to record order event: %w", err)
+	}
+	return nil
+}
+
+// project writes an order to the orders collection, unless a newer version of
+// it is already there
+func (s *OrderService) project(ctx context.Context, order models.Order) error {
+	filter := bson.M{"_id": order.ID, "$or": bson.A{
+		bson.M{"version": bson.M{"$lte": order.Version}},
+		// Written before the event log existed
+		bson.M{"version": bson.M{"$exists": false}},
+	}}
+	_, err := s.collection.ReplaceOne(ctx, filter, order, options.Replace().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The upsert found a newer version
+		return nil
+	}
+	return err
+}
+
+// retryConflicts runs fn until it does not fail with errVersionConflict, at
+// most maxVersionConflicts times
+func retryConflicts(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxVersionConflicts; attempt++ {
+		if err = fn(); !errors.Is(err, errVersionConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrConflict, err)
+}
+
+// orderData returns the fields of order that a created event records
+func orderData(order models.Order) (bson.M, error) {
+	raw, err := bson.Marshal(order)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode order: %w", err)
+	}
+	var data bson.M
+	if err := bson.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("failed to encode order: %w", err)
+	}
+	delete(data, "_id")
+	delete(data, "version")
+	return data, nil
+}
@@ -0,0 +1,292 @@
+package services
+
+import (
+	"backend/models"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testOrderEvents returns the events of an order created at start, then
+// changed and deleted a minute apart each, as appendEvent stores them
+func testOrderEvents(t *testing.T, id primitive.ObjectID, start time.Time, changes ...bson.M) []models.OrderEvent {
+	t.Helper()
+	data, err := orderData(models.Order{
+		UserID:    primitive.NewObjectID(),
+		ProductID: primitive.NewObjectID(),
+		Quantity:  2,
+		Status:    "pending",
+		UnitPrice: 9.5,
+		CreatedAt: models.NewTimestamp(start),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var history orderHistory
+	var orderEvents []models.OrderEvent
+	add := func(eventType string, data bson.M) {
+		event := nextEvent(history, id, eventType, data, start.Add(time.Duration(len(orderEvents))*time.Minute))
+		if err := history.apply(event); err != nil {
+			t.Fatal(err)
+		}
+		orderEvents = append(orderEvents, event)
+	}
+	add(models.OrderEventCreated, data)
+	for _, change := range changes {
+		if change == nil {
+			add(models.OrderEventDeleted, nil)
+		} else {
+			add(models.OrderEventUpdated, change)
+		}
+	}
+	return orderEvents
+}
+
+func TestReplayEvents(t *testing.T) {
+	id := primitive.NewObjectID()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		changes []bson.M
+		// reorder rearranges the events before they are replayed
+		reorder    func([]models.OrderEvent) []models.OrderEvent
+		wantErr    bool
+		wantExists bool
+		wantOrder  models.Order
+	}{
+		{
+			name:       "created",
+			wantExists: true,
+			wantOrder:  models.Order{Quantity: 2, Status: "pending", UnitPrice: 9.5, Version: 1},
+		},
+		{
+			name:       "updates apply over the fields they leave alone",
+			changes:    []bson.M{{"status": "shipped"}, {"quantity": 3}},
+			wantExists: true,
+			wantOrder:  models.Order{Quantity: 3, Status: "shipped", UnitPrice: 9.5, Version: 3},
+		},
+		{
+			name:    "deleted",
+			changes: []bson.M{{"status": "cancelled"}, nil},
+		},
+		{
+			name:    "events out of order",
+			changes: []bson.M{{"status": "shipped"}},
+			reorder: func(e []models.OrderEvent) []models.OrderEvent { return []models.OrderEvent{e[1], e[0]} },
+			wantErr: true,
+		},
+		{
+			name:    "missing version",
+			changes: []bson.M{{"status": "shipped"}, {"quantity": 3}},
+			reorder: func(e []models.OrderEvent) []models.OrderEvent { return []models.OrderEvent{e[0], e[2]} },
+			wantErr: true,
+		},
+		{
+			name:    "unknown event type",
+			changes: []bson.M{{"status": "shipped"}},
+			reorder: func(e []models.OrderEvent) []models.OrderEvent {
+				e[1].Type = "archived"
+				return e
+			},
+			wantErr: true,
+		},
+		{
+			name: "no events",
+			reorder: func(e []models.OrderEvent) []models.OrderEvent {
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orderEvents := testOrderEvents(t, id, start, tt.changes...)
+			if tt.reorder != nil {
+				orderEvents = tt.reorder(orderEvents)
+			}
+
+			history, err := replayEvents(id, orderEvents)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("replayEvents error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if history.exists() != tt.wantExists {
+				t.Fatalf("exists = %v, want %v", history.exists(), tt.wantExists)
+			}
+			if history.Version != len(orderEvents) {
+				t.Errorf("Version = %d, want %d", history.Version, len(orderEvents))
+			}
+			if len(orderEvents) > 0 && !history.At.Equal(orderEvents[len(orderEvents)-1].OccurredAt) {
+				t.Errorf("At = %v, want when the last event occurred", history.At)
+			}
+			if !tt.wantExists {
+				return
+			}
+
+			got := history.Order
+			if got.ID != id {
+				t.Errorf("ID = %s, want %s", got.ID.Hex(), id.Hex())
+			}
+			if got.Quantity != tt.wantOrder.Quantity || got.Status != tt.wantOrder.Status ||
+				got.UnitPrice != tt.wantOrder.UnitPrice || got.Version != tt.wantOrder.Version {
+				t.Errorf("order = quantity %d, status %s, unit price %v, version %d; want %d, %s, %v, %d",
+					got.Quantity, got.Status, got.UnitPrice, got.Version,
+					tt.wantOrder.Quantity, tt.wantOrder.Status, tt.wantOrder.UnitPrice, tt.wantOrder.Version)
+			}
+			if !got.CreatedAt.Equal(start) {
+				t.Errorf("CreatedAt = %v, want %v", got.CreatedAt.Time, start)
+			}
+		})
+	}
+}
+
+func TestReplayAsOf(t *testing.T) {
+	id := primitive.NewObjectID()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Created at 12:00, shipped at 12:01, deleted at 12:02
+	orderEvents := testOrderEvents(t, id, start, bson.M{"status": "shipped"}, nil)
+
+	tests := []struct {
+		name       string
+		at         time.Time
+		wantExists bool
+		wantStatus string
+	}{
+		{name: "before it was created", at: start.Add(-time.Second)},
+		{name: "when it was created", at: start, wantExists: true, wantStatus: "pending"},
+		{name: "between events", at: start.Add(90 * time.Second), wantExists: true, wantStatus: "shipped"},
+		{name: "after it was deleted", at: start.Add(time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := eventsFilter(id, tt.at)
+			if filter["occurred_at"].(bson.M)["$lte"] != tt.at {
+				t.Fatalf("filter = %v, want the events up to %v", filter, tt.at)
+			}
+
+			// The events loadEvents selects with the filter
+			var selected []models.OrderEvent
+			for _, event := range orderEvents {
+				if !event.OccurredAt.After(tt.at) {
+					selected = append(selected, event)
+				}
+			}
+			history, err := replayEvents(id, selected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if history.exists() != tt.wantExists {
+				t.Fatalf("exists = %v, want %v", history.exists(), tt.wantExists)
+			}
+			if tt.wantExists && history.Order.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", history.Order.Status, tt.wantStatus)
+			}
+		})
+	}
+
+	if filter := eventsFilter(id, time.Time{}); len(filter) != 1 || filter["order_id"] != id {
+		t.Errorf("filter without a time = %v, want every event of the order", filter)
+	}
+}
+
+func TestNextEvent(t *testing.T) {
+	id := primitive.NewObjectID()
+	last := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	history := orderHistory{Version: 4, At: last}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{name: "after the last event", now: last.Add(time.Second), want: last.Add(time.Second)},
+		{name: "clock behind the last event", now: last.Add(-time.Minute), want: last},
+		{name: "same time as the last event", now: last, want: last},
+		{name: "other time zone", now: last.Add(time.Hour).In(time.FixedZone("+07", 7*3600)), want: last.Add(time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := nextEvent(history, id, models.OrderEventUpdated, bson.M{"status": "shipped"}, tt.now)
+			if !event.OccurredAt.Equal(tt.want) || event.OccurredAt.Location() != time.UTC {
+				t.Errorf("OccurredAt = %v, want %v in UTC", event.OccurredAt, tt.want)
+			}
+			if event.Version != 5 || event.OrderID != id || event.Type != models.OrderEventUpdated {
+				t.Errorf("event = version %d of %s, %s; want version 5 of %s, updated",
+					event.Version, event.OrderID.Hex(), event.Type, id.Hex())
+			}
+		})
+	}
+}
+
+func TestAppendError(t *testing.T) {
+	errFailed := errors.New("failed")
+	duplicate := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error"}}}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "stored", err: nil, want: nil},
+		{name: "version taken", err: duplicate, want: errVersionConflict},
+		{name: "other error", err: errFailed, want: errFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := appendError(tt.err); !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+				t.Errorf("appendError = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryConflicts(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name string
+		// results are what the attempts return, the last one repeated
+		results   []error
+		wantCalls int
+		wantErrs  []error
+	}{
+		{name: "no conflict", results: []error{nil}, wantCalls: 1},
+		{name: "conflicts then success", results: []error{errVersionConflict, errVersionConflict, nil}, wantCalls: 3},
+		{name: "conflicts every time", results: []error{errVersionConflict}, wantCalls: maxVersionConflicts, wantErrs: []error{ErrConflict, errVersionConflict}},
+		{name: "other error not retried", results: []error{errFailed}, wantCalls: 1, wantErrs: []error{errFailed}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryConflicts(func() error {
+				result := tt.results[min(calls, len(tt.results)-1)]
+				calls++
+				return result
+			})
+
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if (err == nil) != (len(tt.wantErrs) == 0) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErrs)
+			}
+			for _, want := range tt.wantErrs {
+				if !errors.Is(err, want) {
+					t.Errorf("error = %v, want %v", err, want)
+				}
+			}
+		})
+	}
+}
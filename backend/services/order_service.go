@@ -1,13 +1,19 @@
 package services
 
 import (
+	"backend/cache"
+	"backend/config"
+	"backend/events"
 	"backend/models"
+	"backend/stream"
 	"backend/utils"
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -15,138 +21,555 @@ import (
 )
 
 type OrderService struct {
-	collection  *mongo.Collection
-	redisClient *redis.Client
+	// collection holds the projection of the order events in history
+	collection   *mongo.Collection
+	history      *mongo.Collection
+	products     *mongo.Collection
+	cache        *cache.Cache[models.Order]
+	listCache    *cache.Cache[[]models.Order]
+	statsCache   *cache.Cache[[]OrderStatistics]
+	revenueCache *cache.Cache[[]RevenueStatistics]
+	// Leaderboards include product and user details
+	productBoardCache *cache.Cache[[]ProductRanking]
+	userBoardCache    *cache.Cache[[]UserRanking]
+	forecastCache     *cache.Cache[Forecast]
 }
 
+// OrderStatistics is the number of orders with one status created in a
+// bucket. It keeps the rows of the monthly report that predates granularities:
+// Month labels monthly buckets, the default, and is empty for the others.
 type OrderStatistics struct {
-	Month  string `json:"month"`
-	Count  int    `json:"count"`
+	Month  string `json:"month,omitempty"`
 	Status string `json:"status,omitempty"`
+	Count  int64  `json:"count"`
+	// Period and Start are those of the bucket, as in StatsBucket
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
 }
 
 func NewOrderService(collection *mongo.Collection) *OrderService {
-	return &OrderService{
-		collection:  collection,
-		redisClient: utils.RedisClient,
+	s := &OrderService{
+		collection: collection,
+		history:    utils.MongoDB.Collection(config.OrderEventsCollection),
+		products:   utils.MongoDB.Collection("products"),
+		cache:      newCache[models.Order](utils.RedisClient, "order", config.CacheTTLOrders, entityTags("order")),
+		listCache:  newCache[[]models.Order](utils.RedisClient, "order-list", config.CacheTTLLists, collectionTags("orders")),
+		statsCache: newCache[[]OrderStatistics](utils.RedisClient, "order-stats", config.CacheTTLStats, collectionTags("orders")),
+		// Orders without a price snapshot are valued at the current product price
+		revenueCache:      newCache[[]RevenueStatistics](utils.RedisClient, "order-revenue", config.CacheTTLStats, collectionTags("orders", "products")),
+		productBoardCache: newCache[[]ProductRanking](utils.RedisClient, "product-leaderboard", config.CacheTTLStats, collectionTags("orders", "products")),
+		userBoardCache:    newCache[[]UserRanking](utils.RedisClient, "user-leaderboard", config.CacheTTLStats, collectionTags("orders", "products", "users")),
+		forecastCache:     newCache[Forecast](utils.RedisClient, "order-forecast", config.CacheTTLStats, collectionTags("orders", "products")),
 	}
+	purgeOnRecovery(s.cache, s.listCache, s.statsCache, s.revenueCache, s.productBoardCache, s.userBoardCache, s.forecastCache)
+
+	return s
 }
 
-func (s *OrderService) CreateOrder(order *models.Order) (*mongo.InsertOneResult, error) {
-	order.ID = primitive.NewObjectID()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (s *OrderService) CreateOrder(ctx context.Context, order *models.Order) (result *mongo.InsertOneResult, err error) {
+	ctx, span := startSpan(ctx, "OrderService.CreateOrder")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
 	defer cancel()
 
-	result, err := s.collection.InsertOne(ctx, order)
-	if err == nil {
-		orderJson, _ := json.Marshal(order)
-		s.redisClient.Set(ctx, order.ID.Hex(), orderJson, 0)
+	order.ID = primitive.NewObjectID()
+	order.Version = 1
+	order.CreatedAt = models.NewTimestamp(time.Now())
+	if order.UnitPrice, err = s.productPrice(ctx, order.ProductID); err != nil {
+		return nil, err
+	}
+	data, err := orderData(*order)
+	if err != nil {
+		return nil, err
 	}
-	return result, err
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		if _, err := s.appendEvent(ctx, orderHistory{}, order.ID, models.OrderEventCreated, data); err != nil {
+			return err
+		}
+		if result, err = s.collection.InsertOne(ctx, order); err != nil {
+			return err
+		}
+		if err := applyRollups(ctx, orderDelta(*order, float64(order.Quantity)*order.UnitPrice)); err != nil {
+			return err
+		}
+		return recordEvent(ctx, events.OrderCreated, order.ID, events.OrderCreatedPayload{
+			OrderID:   order.ID.Hex(),
+			UserID:    order.UserID.Hex(),
+			ProductID: order.ProductID.Hex(),
+			Quantity:  order.Quantity,
+			Status:    order.Status,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.invalidate(ctx, order.ID)
+	s.cache.Set(ctx, order.ID.Hex(), *order)
+	publishChange(ctx, stream.Orders, stream.Created, order.ID, order.UserID.Hex(), order)
+	return result, nil
 }
 
-func (s *OrderService) GetOrderById(id primitive.ObjectID) (*models.Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (s *OrderService) GetOrderById(ctx context.Context, id primitive.ObjectID) (_ *models.Order, err error) {
+	ctx, span := startSpan(ctx, "OrderService.GetOrderById")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
 	defer cancel()
 
-	val, err := s.redisClient.Get(ctx, id.Hex()).Result()
-	if err == redis.Nil {
-		var order models.Order
-		err := s.collection.FindOne(ctx, bson.M{"id": id}).Decode(&order)
-		if err != nil {
-			return nil, err
-		}
-
-		orderJson, _ := json.Marshal(order)
-		s.redisClient.Set(ctx, id.Hex(), orderJson, 0)
-		return &order, nil
+	order, err := s.cache.GetOrLoad(ctx, id.Hex(), func(ctx context.Context) (models.Order, error) {
+		return s.findOrder(ctx, id)
+	})
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, fmt.Errorf("order %w", ErrNotFound)
 	} else if err != nil {
 		return nil, err
 	}
 
-	var order models.Order
-	json.Unmarshal([]byte(val), &order)
 	return &order, nil
 }
 
-func (s *OrderService) UpdateOrder(id primitive.ObjectID, update bson.M) (*mongo.UpdateResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// UpdateOrder records an event setting the fields of update and applies it to
+// the order. Only the user, product, quantity and status can be updated. An
+// update that changes nothing records no event.
+func (s *OrderService) UpdateOrder(ctx context.Context, id primitive.ObjectID, update bson.M) (result *mongo.UpdateResult, err error) {
+	ctx, span := startSpan(ctx, "OrderService.UpdateOrder")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
 	defer cancel()
 
-	result, err := s.collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": update})
-	if err == nil {
-		s.redisClient.Del(ctx, id.Hex())
+	set, err := orderChanges(update)
+	if err != nil {
+		return nil, err
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("%w: no data to update", ErrInvalidInput)
+	}
+
+	var updated models.Order
+	err = retryConflicts(func() error {
+		return withTransaction(ctx, func(ctx context.Context) error {
+			result = &mongo.UpdateResult{}
+			history, err := s.currentHistory(ctx, id)
+			if err != nil || !history.exists() {
+				return err
+			}
+			result.MatchedCount = 1
+
+			before, err := bson.Marshal(history.Order)
+			if err != nil {
+				return fmt.Errorf("failed to encode order: %w", err)
+			}
+			// Events are replayed on every later write, so only an update known
+			// to apply is recorded, in the form the order stores it
+			data, err := updatedOrderData(before, set)
+			if err != nil {
+				return err
+			}
+			if !changed(before, data) {
+				updated = history.Order
+				return nil
+			}
+			result.ModifiedCount = 1
+
+			old := history.Order
+			event, err := s.appendEvent(ctx, history, id, models.OrderEventUpdated, data)
+			if err != nil {
+				return err
+			}
+			if err := history.apply(event); err != nil {
+				return fmt.Errorf("failed to decode updated order: %w", err)
+			}
+			updated = history.Order
+			if err := s.project(ctx, updated); err != nil {
+				return err
+			}
+			if err := s.rollUpdate(ctx, old, updated); err != nil {
+				return err
+			}
+
+			if updated.Status == old.Status {
+				return nil
+			}
+			return recordEvent(ctx, events.OrderStatusChanged, id, events.OrderStatusChangedPayload{
+				OrderID:   id.Hex(),
+				OldStatus: old.Status,
+				NewStatus: updated.Status,
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.ModifiedCount > 0 {
+		s.invalidate(ctx, id)
+		publishChange(ctx, stream.Orders, stream.Updated, id, updated.UserID.Hex(), updated)
 	}
-	return result, err
+	return result, nil
 }
 
-func (s *OrderService) DeleteOrder(id primitive.ObjectID) (*mongo.DeleteResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// ConfirmOrder marks an order as paid. Confirming an order twice changes
+// nothing, so redelivered payment events are harmless.
+func (s *OrderService) ConfirmOrder(ctx context.Context, id primitive.ObjectID) (err error) {
+	ctx, span := startSpan(ctx, "OrderService.ConfirmOrder")
+	defer endSpan(span, &err)
 
-	result, err := s.collection.DeleteOne(ctx, bson.M{"id": id})
-	if err == nil {
-		s.redisClient.Del(ctx, id.Hex())
+	result, err := s.UpdateOrder(ctx, id, bson.M{"status": models.OrderStatusConfirmed})
+	if err != nil {
+		return fmt.Errorf("failed to confirm order: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("order %w", ErrNotFound)
 	}
-	return result, err
+	return nil
 }
 
-func (s *OrderService) GetAllOrders() ([]models.Order, error) {
-	var orders []models.Order
+// DeleteOrder records the deletion of an order and removes it from the
+// projection; its events are kept
+func (s *OrderService) DeleteOrder(ctx context.Context, id primitive.ObjectID) (result *mongo.DeleteResult, err error) {
+	ctx, span := startSpan(ctx, "OrderService.DeleteOrder")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
 
-	cursor, err := s.collection.Find(context.Background(), bson.M{})
+	var deleted models.Order
+	err = retryConflicts(func() error {
+		return withTransaction(ctx, func(ctx context.Context) error {
+			result = &mongo.DeleteResult{}
+			history, err := s.currentHistory(ctx, id)
+			if err != nil || !history.exists() {
+				return err
+			}
+			if _, err := s.appendEvent(ctx, history, id, models.OrderEventDeleted, nil); err != nil {
+				return err
+			}
+			if _, err := s.collection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+				return err
+			}
+			value, err := s.orderValue(ctx, history.Order)
+			if err != nil {
+				return err
+			}
+			if err := applyRollups(ctx, orderDelta(history.Order, value).negate()); err != nil {
+				return err
+			}
+			result.DeletedCount = 1
+			deleted = history.Order
+			return nil
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.Background())
 
-	for cursor.Next(context.Background()) {
-		var order models.Order
-		if err := cursor.Decode(&order); err != nil {
+	s.invalidate(ctx, id)
+	if result.DeletedCount > 0 {
+		publishChange(ctx, stream.Orders, stream.Deleted, id, deleted.UserID.Hex(), deleted)
+	}
+	return result, nil
+}
+
+func (s *OrderService) GetAllOrders(ctx context.Context, page Page) (_ []models.Order, err error) {
+	ctx, span := startSpan(ctx, "OrderService.GetAllOrders")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	return s.listCache.GetOrLoad(ctx, page.cacheID(), func(ctx context.Context) ([]models.Order, error) {
+		var orders []models.Order
+
+		cursor, err := s.collection.Find(ctx, bson.M{}, page.findOptions())
+		if err != nil {
 			return nil, err
 		}
-		orders = append(orders, order)
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			var order models.Order
+			if err := cursor.Decode(&order); err != nil {
+				return nil, err
+			}
+			orders = append(orders, order)
+		}
+
+		return orders, nil
+	})
+}
+
+func (s *OrderService) GetOrderStatistics(ctx context.Context, q StatsQuery) (_ []OrderStatistics, err error) {
+	ctx, span := startSpan(ctx, "OrderService.GetOrderStatistics")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	return s.statsCache.GetOrLoad(ctx, q.cacheID(), func(ctx context.Context) ([]OrderStatistics, error) {
+		return s.aggregateOrderStatistics(ctx, q)
+	})
+}
+
+// aggregateOrderStatistics counts orders per bucket and status, ordered by
+// bucket and then status. Every status seen in the range is reported in every
+// bucket; a bucket of a range without orders has one row without a status.
+func (s *OrderService) aggregateOrderStatistics(ctx context.Context, q StatsQuery) ([]OrderStatistics, error) {
+	counts, err := bucketRows(ctx, rollupOrders, q, StatusFilter{}, func(ctx context.Context) ([]bucketCount, error) {
+		return s.orderRows(ctx, q, StatusFilter{})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byStatus := map[int64]map[string]int64{}
+	seen := map[string]bool{}
+	for _, c := range counts {
+		start := c.Start.UnixMilli()
+		if byStatus[start] == nil {
+			byStatus[start] = map[string]int64{}
+		}
+		byStatus[start][c.Key] += c.Count
+		seen[c.Key] = true
 	}
+	statuses := make([]string, 0, len(seen))
+	for status := range seen {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	if len(statuses) == 0 {
+		statuses = []string{""}
+	}
+
+	buckets := q.Buckets()
+	results := make([]OrderStatistics, 0, len(buckets)*len(statuses))
+	for _, start := range buckets {
+		var month string
+		if q.Granularity == GranularityMonth {
+			month = q.Label(start)
+		}
+		for _, status := range statuses {
+			results = append(results, OrderStatistics{
+				Month:  month,
+				Status: status,
+				Count:  byStatus[start.UnixMilli()][status],
+				Period: q.Label(start),
+				Start:  start,
+			})
+		}
+	}
+	return results, nil
+}
 
-	return orders, nil
+// invalidate drops the cached order and every list and statistic derived from orders
+func (s *OrderService) invalidate(ctx context.Context, id primitive.ObjectID) {
+	s.cache.InvalidateTags(ctx, "order:"+id.Hex(), "orders")
 }
 
-func (s *OrderService) GetOrderStatistics() ([]OrderStatistics, error) {
-	pipeline := mongo.Pipeline{
-		{{Key: "$group", Value: bson.D{
-			{Key: "id", Value: bson.D{
-				{Key: "month", Value: bson.D{{Key: "$substr", Value: bson.A{"$createdAt", 0, 7}}}},
-				{Key: "status", Value: "$status"},
-			}},
-			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
-		}}},
-		{{Key: "$sort", Value: bson.D{
-			{Key: "id.month", Value: 1},
-			{Key: "id.status", Value: 1},
-		}}},
+// productPrice returns the current price of a product, or 0 when there is no
+// such product
+func (s *OrderService) productPrice(ctx context.Context, id primitive.ObjectID) (float64, error) {
+	var product models.Product
+	opts := options.FindOne().SetProjection(bson.M{"price": 1})
+	err := s.products.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to fetch product price: %w", err)
 	}
+	return product.Price, nil
+}
+
+// orderValue returns what an order is worth: its quantity times its price
+// snapshot, or its product's current price when it has none. RebuildRollups
+// gives every order whose product has a price a snapshot before the rollups
+// are first read, so what an update or delete takes back is what was counted.
+func (s *OrderService) orderValue(ctx context.Context, order models.Order) (float64, error) {
+	price := order.UnitPrice
+	if price == 0 {
+		var err error
+		if price, err = s.productPrice(ctx, order.ProductID); err != nil {
+			return 0, err
+		}
+	}
+	return float64(order.Quantity) * price, nil
+}
 
-	cursor, err := s.collection.Aggregate(context.Background(), pipeline, options.Aggregate())
+// snapshotPrices records the current price of their product as the price
+// snapshot of the orders that have none, returning how many it recorded
+func (s *OrderService) snapshotPrices(ctx context.Context) (int, error) {
+	cursor, err := s.collection.Find(ctx, bson.M{"unit_price": bson.M{"$in": bson.A{nil, 0}}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("failed to list orders without a price: %w", err)
+	}
+	var ids []primitive.ObjectID
+	for cursor.Next(ctx) {
+		ids = append(ids, cursor.Current.Lookup("_id").ObjectID())
+	}
+	err = cursor.Err()
+	cursor.Close(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list orders without a price: %w", err)
 	}
-	defer cursor.Close(context.Background())
 
-	var results []OrderStatistics
-	for cursor.Next(context.Background()) {
-		var result OrderStatistics
-		raw := cursor.Current
+	snapshotted := 0
+	for _, id := range ids {
+		ok, err := s.snapshotPrice(ctx, id)
+		if err != nil {
+			return snapshotted, err
+		}
+		if ok {
+			snapshotted++
+		}
+	}
+	return snapshotted, nil
+}
 
-		month := raw.Lookup("id").Document().Lookup("month").StringValue()
-		status := raw.Lookup("id").Document().Lookup("status").StringValue()
-		count := int(raw.Lookup("count").Int32())
+// snapshotPrice records the current price of an order's product as its price
+// snapshot, with an update event, unless it has one or the product has no
+// price. It reports whether it recorded one.
+func (s *OrderService) snapshotPrice(ctx context.Context, id primitive.ObjectID) (snapshotted bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
 
-		result.Month = month
-		result.Status = status
-		result.Count = count
+	err = retryConflicts(func() error {
+		return withTransaction(ctx, func(ctx context.Context) error {
+			snapshotted = false
+			history, err := s.currentHistory(ctx, id)
+			if err != nil || !history.exists() || history.Order.UnitPrice != 0 {
+				return err
+			}
+			price, err := s.productPrice(ctx, history.Order.ProductID)
+			if err != nil || price == 0 {
+				return err
+			}
 
-		results = append(results, result)
+			event, err := s.appendEvent(ctx, history, id, models.OrderEventUpdated, bson.M{"unit_price": price})
+			if err != nil {
+				return err
+			}
+			if err := history.apply(event); err != nil {
+				return fmt.Errorf("failed to decode updated order: %w", err)
+			}
+			if err := s.project(ctx, history.Order); err != nil {
+				return err
+			}
+			snapshotted = true
+			return nil
+		})
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to record the price of order %s: %w", id.Hex(), err)
 	}
+	if snapshotted {
+		s.invalidate(ctx, id)
+	}
+	return snapshotted, nil
+}
 
-	return results, nil
+// rollUpdate moves an order's contribution to the rollups from old to updated
+// when the update changed what it is counted under
+func (s *OrderService) rollUpdate(ctx context.Context, old, updated models.Order) error {
+	if updated.Status == old.Status && updated.Quantity == old.Quantity && updated.UnitPrice == old.UnitPrice &&
+		updated.ProductID == old.ProductID && updated.CreatedAt.Equal(old.CreatedAt.Time) {
+		return nil
+	}
+	oldValue, err := s.orderValue(ctx, old)
+	if err != nil {
+		return err
+	}
+	newValue, err := s.orderValue(ctx, updated)
+	if err != nil {
+		return err
+	}
+	return applyRollups(ctx, orderDelta(old, oldValue).negate(), orderDelta(updated, newValue))
+}
+
+// findOrder loads an order from MongoDB, reporting a missing document as cache.ErrNotFound
+func (s *OrderService) findOrder(ctx context.Context, id primitive.ObjectID) (models.Order, error) {
+	var order models.Order
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return order, cache.ErrNotFound
+	}
+	return order, err
+}
+
+// orderChanges converts the fields of update a client may change to the types
+// of models.Order, rejecting unknown fields. The ID, version, price snapshot
+// and creation time are not the client's to set; they are ignored, so that an
+// order can be sent back as it was read.
+func orderChanges(update bson.M) (bson.M, error) {
+	set := bson.M{}
+	for field, value := range update {
+		switch field {
+		case "_id", "id", "version", "unit_price", "created_at", "createdAt":
+		case "user_id", "product_id":
+			id, err := toObjectID(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s must be an ID", ErrInvalidInput, field)
+			}
+			set[field] = id
+		case "quantity":
+			quantity, ok := toInt(value)
+			if !ok {
+				return nil, fmt.Errorf("%w: quantity must be a whole number", ErrInvalidInput)
+			}
+			set[field] = quantity
+		case "status":
+			status, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: status must be a string", ErrInvalidInput)
+			}
+			set[field] = status
+		default:
+			return nil, fmt.Errorf("%w: order field %q cannot be updated", ErrInvalidInput, field)
+		}
+	}
+	return set, nil
+}
+
+// updatedOrderData applies set to the encoded order before and returns the
+// fields of set as the updated order encodes them
+func updatedOrderData(before bson.Raw, set bson.M) (bson.M, error) {
+	_, updated, err := applySet[models.Order](before, set)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	all, err := orderData(updated)
+	if err != nil {
+		return nil, err
+	}
+	data := make(bson.M, len(set))
+	for field := range set {
+		data[field] = all[field]
+	}
+	return data, nil
+}
+
+func toObjectID(value any) (primitive.ObjectID, error) {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		return v, nil
+	case string:
+		return primitive.ObjectIDFromHex(v)
+	default:
+		return primitive.NilObjectID, fmt.Errorf("unexpected %T", value)
+	}
+}
+
+// toInt converts the whole numbers JSON and BSON decode to int
+func toInt(value any) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+			return 0, false
+		}
+		return int(v), true
+	default:
+		return 0, false
+	}
 }
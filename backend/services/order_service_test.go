@@ -0,0 +1,110 @@
+package services
+
+import (
+	"backend/models"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOrderChanges(t *testing.T) {
+	userID := primitive.NewObjectID()
+
+	tests := []struct {
+		name    string
+		update  bson.M
+		want    bson.M
+		wantErr bool
+	}{
+		{
+			name:   "fields typed",
+			update: bson.M{"user_id": userID.Hex(), "quantity": float64(3), "status": "shipped"},
+			want:   bson.M{"user_id": userID, "quantity": 3, "status": "shipped"},
+		},
+		{
+			name:   "IDs already typed",
+			update: bson.M{"product_id": userID, "quantity": int32(1)},
+			want:   bson.M{"product_id": userID, "quantity": 1},
+		},
+		{
+			name:   "fields the API sets ignored",
+			update: bson.M{"_id": "x", "id": "x", "version": 7, "unit_price": 1, "created_at": "2024-05-01", "createdAt": "2024-05-01"},
+			want:   bson.M{},
+		},
+		{name: "invalid ID", update: bson.M{"user_id": "42"}, wantErr: true},
+		{name: "ID of another type", update: bson.M{"product_id": 42}, wantErr: true},
+		{name: "fractional quantity", update: bson.M{"quantity": 2.5}, wantErr: true},
+		{name: "quantity as a string", update: bson.M{"quantity": "3"}, wantErr: true},
+		{name: "quantity out of range", update: bson.M{"quantity": 1e12}, wantErr: true},
+		{name: "status not a string", update: bson.M{"status": 5}, wantErr: true},
+		{name: "unknown field", update: bson.M{"status": "shipped", "price": 10}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := orderChanges(tt.update)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidInput) {
+					t.Errorf("orderChanges error = %v, want ErrInvalidInput", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderChanges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdatedOrderData(t *testing.T) {
+	before, err := bson.Marshal(models.Order{
+		ID:        primitive.NewObjectID(),
+		UserID:    primitive.NewObjectID(),
+		ProductID: primitive.NewObjectID(),
+		Quantity:  2,
+		Status:    "pending",
+		UnitPrice: 9.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := orderChanges(bson.M{"quantity": float64(3), "status": "shipped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := updatedOrderData(before, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The event records only what changed, encoded as a created event would
+	// encode it, so replaying it gives the order the update wrote
+	if len(data) != 2 {
+		t.Errorf("data = %v, want only quantity and status", data)
+	}
+	var history orderHistory
+	created, _ := orderData(models.Order{Quantity: 2, Status: "pending", UnitPrice: 9.5})
+	for _, event := range []models.OrderEvent{
+		{Version: 1, Type: models.OrderEventCreated, Data: created},
+		{Version: 2, Type: models.OrderEventUpdated, Data: data},
+	} {
+		if err := history.apply(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if history.Order.Quantity != 3 || history.Order.Status != "shipped" || history.Order.UnitPrice != 9.5 {
+		t.Errorf("replayed order = quantity %d, status %s, unit price %v; want 3, shipped, 9.5",
+			history.Order.Quantity, history.Order.Status, history.Order.UnitPrice)
+	}
+
+	if _, err := updatedOrderData(before, bson.M{"quantity": "three"}); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("updatedOrderData with a mistyped field = %v, want ErrInvalidInput", err)
+	}
+}
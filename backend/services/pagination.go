@@ -0,0 +1,34 @@
+package services
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Page selects a slice of a list query. Pages are numbered from 1; a zero Limit
+// returns every document, as the list endpoints did before paging.
+type Page struct {
+	Page  int64
+	Limit int64
+}
+
+// cacheID identifies the page within a list cache
+func (p Page) cacheID() string {
+	return fmt.Sprintf("page=%d:limit=%d", p.Page, p.Limit)
+}
+
+// findOptions returns the sort, skip and limit for the page. Results are sorted
+// by _id so that pages are stable between requests.
+func (p Page) findOptions() *options.FindOptions {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if p.Limit > 0 {
+		page := p.Page
+		if page < 1 {
+			page = 1
+		}
+		opts.SetSkip((page - 1) * p.Limit).SetLimit(p.Limit)
+	}
+	return opts
+}
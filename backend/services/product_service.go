@@ -1,10 +1,15 @@
 package services
 
 import (
+	"backend/cache"
+	"backend/config"
+	"backend/events"
 	"backend/models"
+	"backend/stream"
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"go.mongodb.org/mongo-driver/bson"
@@ -13,156 +18,250 @@ import (
 )
 
 type ProductService struct {
-	collection  *mongo.Collection
-	redisClient *redis.Client
-}
-
-type ProductStatistics struct {
-	Month  string `json:"month"`
-	Count  int    `json:"count"`
-	Status string `json:"status,omitempty"`
+	collection *mongo.Collection
+	cache      *cache.Cache[models.Product]
+	listCache  *cache.Cache[[]models.Product]
+	countCache *cache.Cache[int64]
+	statsCache *cache.Cache[[]StatsBucket]
 }
 
 // NewProductService creates a new instance of ProductService
 func NewProductService(collection *mongo.Collection, redisClient *redis.Client) *ProductService {
-	return &ProductService{
-		collection:  collection,
-		redisClient: redisClient,
+	// The catalog page fetches dozens of products at once, so products are also
+	// kept in process in front of Redis
+	s := &ProductService{
+		collection: collection,
+		cache:      newTieredCache[models.Product](redisClient, "product", config.CacheTTLProducts, entityTags("product")),
+		listCache:  newCache[[]models.Product](redisClient, "product-list", config.CacheTTLLists, collectionTags("products")),
+		countCache: newCache[int64](redisClient, "product-count", config.CacheTTLLists, collectionTags("products")),
+		statsCache: newCache[[]StatsBucket](redisClient, "product-stats", config.CacheTTLStats, collectionTags("products")),
 	}
+	purgeOnRecovery(s.cache, s.listCache, s.countCache, s.statsCache)
+
+	return s
 }
 
-func (s *ProductService) CreateProduct(product models.Product) (*mongo.InsertOneResult, error) {
+func (s *ProductService) CreateProduct(ctx context.Context, product models.Product) (_ *mongo.InsertOneResult, err error) {
+	ctx, span := startSpan(ctx, "ProductService.CreateProduct")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
 	// Validate required fields
 	if product.Name == "" {
-		return nil, errors.New("missing required field: name")
+		return nil, fmt.Errorf("%w: missing required field: name", ErrInvalidInput)
 	}
 	if product.Price == 0 {
-		return nil, errors.New("missing required field: price")
+		return nil, fmt.Errorf("%w: missing required field: price", ErrInvalidInput)
 	}
-
-	// Insert product into MongoDB
-	result, err := s.collection.InsertOne(context.Background(), product)
-	if err != nil {
-		return nil, errors.New("failed to insert product into MongoDB: " + err.Error())
+	if product.Stock != nil && *product.Stock < 0 {
+		return nil, fmt.Errorf("%w: stock must not be negative", ErrInvalidInput)
 	}
 
-	// Cache the product in Redis
-	productData, err := json.Marshal(product)
-	if err != nil {
-		return nil, errors.New("failed to marshal product data: " + err.Error())
+	// Assign the ID up front so the cached copy matches the stored document
+	if product.ID.IsZero() {
+		product.ID = primitive.NewObjectID()
 	}
+	product.CreatedAt = models.NewTimestamp(time.Now())
 
-	cacheKey := "product:" + product.ID.Hex()
-	err = s.redisClient.Set(context.Background(), cacheKey, productData, 0).Err()
+	// Insert product into MongoDB along with its event
+	var result *mongo.InsertOneResult
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		if result, err = s.collection.InsertOne(ctx, product); err != nil {
+			return fmt.Errorf("failed to insert product into MongoDB: %w", err)
+		}
+		if err := applyRollups(ctx, rollupDelta{Metric: rollupProducts, At: product.CreatedAt.Time, Count: 1}); err != nil {
+			return err
+		}
+		return recordEvent(ctx, events.ProductCreated, product.ID, events.ProductCreatedPayload{
+			ProductID: product.ID.Hex(),
+			Name:      product.Name,
+			Price:     product.Price,
+		})
+	})
 	if err != nil {
-		return nil, errors.New("failed to cache product in Redis: " + err.Error())
+		return nil, err
 	}
 
+	// Cache the product in Redis
+	s.invalidate(ctx, product.ID)
+	s.cache.Set(ctx, product.ID.Hex(), product)
+	publishChange(ctx, stream.Products, stream.Created, product.ID, "", product)
+
 	return result, nil
 }
 
-func (s *ProductService) GetProduct(id primitive.ObjectID) (*models.Product, error) {
-	// Check Redis cache
-	cacheKey := "product:" + id.Hex()
-	cachedProduct, err := s.redisClient.Get(context.Background(), cacheKey).Result()
-	if err == redis.Nil {
-		// Product not found in Redis, check MongoDB
-		var product models.Product
-		err = s.collection.FindOne(context.Background(), bson.M{"id": id}).Decode(&product)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				return nil, errors.New("product not found")
-			}
-			return nil, errors.New("failed to fetch product from MongoDB: " + err.Error())
-		}
-
-		// Cache result in Redis
-		productData, err := json.Marshal(product)
-		if err != nil {
-			return nil, errors.New("failed to marshal product data: " + err.Error())
-		}
-		s.redisClient.Set(context.Background(), cacheKey, productData, 0)
+func (s *ProductService) GetProduct(ctx context.Context, id primitive.ObjectID) (_ *models.Product, err error) {
+	ctx, span := startSpan(ctx, "ProductService.GetProduct")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
 
-		return &product, nil
+	// Check Redis cache, falling back to MongoDB on a miss
+	product, err := s.cache.GetOrLoad(ctx, id.Hex(), func(ctx context.Context) (models.Product, error) {
+		return s.findProduct(ctx, id)
+	})
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, fmt.Errorf("product %w", ErrNotFound)
 	} else if err != nil {
-		return nil, errors.New("failed to retrieve product from Redis: " + err.Error())
-	}
-
-	var product models.Product
-	if err := json.Unmarshal([]byte(cachedProduct), &product); err != nil {
-		return nil, errors.New("failed to unmarshal cached product data: " + err.Error())
+		return nil, err
 	}
 
 	return &product, nil
 }
 
-func (s *ProductService) ListProduct() ([]models.Product, error) {
-	cursor, err := s.collection.Find(context.Background(), bson.M{})
-	if err != nil {
-		return nil, errors.New("failed to fetch products from MongoDB: " + err.Error())
-	}
-	defer cursor.Close(context.Background())
+func (s *ProductService) ListProduct(ctx context.Context, page Page) (_ []models.Product, err error) {
+	ctx, span := startSpan(ctx, "ProductService.ListProduct")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
 
-	var products []models.Product
-	if err := cursor.All(context.Background(), &products); err != nil {
-		return nil, errors.New("failed to decode products: " + err.Error())
-	}
-	return products, nil
+	return s.listCache.GetOrLoad(ctx, page.cacheID(), func(ctx context.Context) ([]models.Product, error) {
+		cursor, err := s.collection.Find(ctx, bson.M{}, page.findOptions())
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch products from MongoDB: %w", err)
+		}
+		defer cursor.Close(ctx)
+
+		var products []models.Product
+		if err := cursor.All(ctx, &products); err != nil {
+			return nil, fmt.Errorf("failed to decode products: %w", err)
+		}
+		return products, nil
+	})
 }
 
-func (s *ProductService) UpdateProduct(id primitive.ObjectID, updateData bson.M) (*mongo.UpdateResult, error) {
-	filter := bson.M{"id": id}
-	update := bson.M{"$set": updateData}
-	result, err := s.collection.UpdateOne(context.Background(), filter, update)
+func (s *ProductService) UpdateProduct(ctx context.Context, id primitive.ObjectID, updateData bson.M) (_ *mongo.UpdateResult, err error) {
+	ctx, span := startSpan(ctx, "ProductService.UpdateProduct")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	if err := checkSet(updateData); err != nil {
+		return nil, err
+	}
+
+	var result *mongo.UpdateResult
+	var updated models.Product
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		var before bson.Raw
+		result, before, err = updateReturningBefore(ctx, s.collection, id, updateData)
+		if err != nil {
+			return fmt.Errorf("failed to update product in MongoDB: %w", err)
+		}
+		if before == nil {
+			return nil
+		}
+
+		var old models.Product
+		old, updated, err = applySet[models.Product](before, updateData)
+		if err != nil {
+			return fmt.Errorf("failed to decode updated product: %w", err)
+		}
+		if updated.Price == old.Price {
+			return nil
+		}
+		return recordEvent(ctx, events.ProductPriceChanged, id, events.ProductPriceChangedPayload{
+			ProductID: id.Hex(),
+			OldPrice:  old.Price,
+			NewPrice:  updated.Price,
+		})
+	})
 	if err != nil {
-		return nil, errors.New("failed to update product in MongoDB: " + err.Error())
+		return nil, err
 	}
 
 	// Invalidate the cache
-	cacheKey := "product:" + id.Hex()
-	if err := s.redisClient.Del(context.Background(), cacheKey).Err(); err != nil {
-		return nil, errors.New("failed to invalidate cache: " + err.Error())
+	if result.MatchedCount > 0 {
+		s.invalidate(ctx, id)
+		publishChange(ctx, stream.Products, stream.Updated, id, "", updated)
 	}
 
 	return result, nil
 }
 
-func (s *ProductService) DeleteProduct(id primitive.ObjectID) (*mongo.DeleteResult, error) {
-	cacheKey := "product:" + id.Hex()
+func (s *ProductService) DeleteProduct(ctx context.Context, id primitive.ObjectID) (_ *mongo.DeleteResult, err error) {
+	ctx, span := startSpan(ctx, "ProductService.DeleteProduct")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
 
-	// Delete product from MongoDB
-	result, err := s.collection.DeleteOne(context.Background(), bson.M{"id": id})
+	// Delete product from MongoDB along with its count
+	var result *mongo.DeleteResult
+	var product models.Product
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		var deleted bson.Raw
+		if result, deleted, err = deleteReturning(ctx, s.collection, id); err != nil {
+			return fmt.Errorf("failed to delete product from MongoDB: %w", err)
+		}
+		if deleted == nil {
+			return nil
+		}
+		if err := bson.Unmarshal(deleted, &product); err != nil {
+			return fmt.Errorf("failed to decode deleted product: %w", err)
+		}
+		return applyRollups(ctx, rollupDelta{Metric: rollupProducts, At: createdTime(product.CreatedAt.Time, id), Count: -1})
+	})
 	if err != nil {
-		return nil, errors.New("failed to delete product from MongoDB: " + err.Error())
+		return nil, err
 	}
 
 	// Invalidate the cache
-	if err := s.redisClient.Del(context.Background(), cacheKey).Err(); err != nil {
-		return nil, errors.New("failed to invalidate cache: " + err.Error())
+	s.invalidate(ctx, id)
+
+	if result.DeletedCount > 0 {
+		publishChange(ctx, stream.Products, stream.Deleted, id, "", product)
 	}
 
 	return result, nil
 }
 
-func (s *ProductService) GetProductCount() (int64, error) {
-	count, err := s.collection.CountDocuments(context.Background(), bson.M{})
-	if err != nil {
-		return 0, errors.New("failed to count products in MongoDB: " + err.Error())
-	}
-	return count, nil
+func (s *ProductService) GetProductCount(ctx context.Context) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "ProductService.GetProductCount")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	return s.countCache.GetOrLoad(ctx, "all", func(ctx context.Context) (int64, error) {
+		count, err := s.collection.CountDocuments(ctx, bson.M{})
+		if err != nil {
+			return 0, fmt.Errorf("failed to count products in MongoDB: %w", err)
+		}
+		return count, nil
+	})
 }
 
-func (s *ProductService) AggregateProducts(pipeline mongo.Pipeline) ([]ProductStatistics, error) {
-	cursor, err := s.collection.Aggregate(context.Background(), pipeline)
-	if err != nil {
-		return nil, errors.New("failed to aggregate products in MongoDB: " + err.Error())
-	}
-	defer cursor.Close(context.Background())
+// GetProductStatistics counts products created per bucket of q for charts
+func (s *ProductService) GetProductStatistics(ctx context.Context, q StatsQuery) (_ []StatsBucket, err error) {
+	ctx, span := startSpan(ctx, "ProductService.GetProductStatistics")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
 
-	var statistics []ProductStatistics
-	if err := cursor.All(context.Background(), &statistics); err != nil {
-		return nil, errors.New("failed to decode aggregation results: " + err.Error())
+	return s.statsCache.GetOrLoad(ctx, q.cacheID(), func(ctx context.Context) ([]StatsBucket, error) {
+		counts, err := bucketRows(ctx, rollupProducts, q, StatusFilter{}, func(ctx context.Context) ([]bucketCount, error) {
+			return countByBucket(ctx, s.collection, q)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to aggregate products in MongoDB: %w", err)
+		}
+		return q.fill(counts), nil
+	})
+}
+
+// findProduct loads a product from MongoDB, reporting a missing document as cache.ErrNotFound
+func (s *ProductService) findProduct(ctx context.Context, id primitive.ObjectID) (models.Product, error) {
+	var product models.Product
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return product, cache.ErrNotFound
+	} else if err != nil {
+		return product, fmt.Errorf("failed to fetch product from MongoDB: %w", err)
 	}
+	return product, nil
+}
 
-	return statistics, nil
+// invalidate drops the cached product and every list and statistic derived from products
+func (s *ProductService) invalidate(ctx context.Context, id primitive.ObjectID) {
+	s.cache.InvalidateTags(ctx, "product:"+id.Hex(), "products")
 }
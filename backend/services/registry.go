@@ -0,0 +1,38 @@
+package services
+
+import (
+	"backend/config"
+	"backend/utils"
+)
+
+// Registry holds the services a process shares. Services own caches, whose
+// in-process tiers and recovery hooks stay registered for the life of the
+// process, so each is created once and handed to everything that needs it.
+type Registry struct {
+	Users     *UserService
+	Products  *ProductService
+	Orders    *OrderService
+	Dashboard *DashboardService
+	Anomalies *AnomalyService
+	Webhooks  *WebhookService
+}
+
+// NewRegistry creates the services on utils.MongoDB and utils.RedisClient.
+// Call it after StartCacheInvalidation.
+func NewRegistry() *Registry {
+	users := NewUserService(utils.MongoDB.Collection("users"))
+	products := NewProductService(utils.MongoDB.Collection("products"), utils.RedisClient)
+	orders := NewOrderService(utils.MongoDB.Collection("orders"))
+
+	return &Registry{
+		Users:     users,
+		Products:  products,
+		Orders:    orders,
+		Dashboard: NewDashboardService(users, products, orders),
+		Anomalies: NewAnomalyService(utils.MongoDB.Collection(config.AnomaliesCollection), orders),
+		Webhooks: NewWebhookService(
+			utils.MongoDB.Collection(config.WebhookSubscriptionsCollection),
+			utils.MongoDB.Collection(config.WebhookDeliveriesCollection),
+		),
+	}
+}
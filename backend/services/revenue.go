@@ -0,0 +1,176 @@
+package services
+
+import (
+	"backend/config"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StatusFilter selects orders by status: those with one of Include, when set,
+// and none of Exclude
+type StatusFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// RevenueStatistics is the revenue of the orders created in one bucket
+type RevenueStatistics struct {
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	// Revenue is the sum of quantity times unit price
+	Revenue float64 `json:"revenue"`
+	Units   int64   `json:"units"`
+	Orders  int64   `json:"orders"`
+	// AverageOrderValue is Revenue divided by Orders
+	AverageOrderValue float64 `json:"average_order_value"`
+}
+
+// match returns the $match conditions of the filter on the status held in field
+func (f StatusFilter) match(field string) bson.D {
+	var status bson.D
+	if len(f.Include) > 0 {
+		status = append(status, bson.E{Key: "$in", Value: f.Include})
+	}
+	if len(f.Exclude) > 0 {
+		status = append(status, bson.E{Key: "$nin", Value: f.Exclude})
+	}
+	if status == nil {
+		return bson.D{}
+	}
+	return bson.D{{Key: field, Value: status}}
+}
+
+// cacheID identifies the filter within a statistics cache
+func (f StatusFilter) cacheID() string {
+	include, exclude := slices.Clone(f.Include), slices.Clone(f.Exclude)
+	slices.Sort(include)
+	slices.Sort(exclude)
+	return fmt.Sprintf("status=%s:exclude=%s", strings.Join(include, ","), strings.Join(exclude, ","))
+}
+
+// GetRevenueStatistics reports gross revenue, units sold, order count and
+// average order value per bucket of q, over the orders filter selects. Orders
+// are valued at their price snapshot, or at their product's price when they
+// have none: the current one when the statistics come from the collection, the
+// one at the last write or reconciliation when they come from the rollups.
+func (s *OrderService) GetRevenueStatistics(ctx context.Context, q StatsQuery, filter StatusFilter) (_ []RevenueStatistics, err error) {
+	ctx, span := startSpan(ctx, "OrderService.GetRevenueStatistics")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	return s.revenueCache.GetOrLoad(ctx, q.cacheID()+":"+filter.cacheID(), func(ctx context.Context) ([]RevenueStatistics, error) {
+		return s.aggregateRevenue(ctx, q, filter)
+	})
+}
+
+func (s *OrderService) aggregateRevenue(ctx context.Context, q StatsQuery, filter StatusFilter) ([]RevenueStatistics, error) {
+	rows, err := bucketRows(ctx, rollupOrders, q, filter, func(ctx context.Context) ([]bucketCount, error) {
+		return s.orderRows(ctx, q, filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[int64]bucketCount, len(rows))
+	for _, row := range rows {
+		t := totals[row.Start.UnixMilli()]
+		t.Count += row.Count
+		t.Units += row.Units
+		t.Revenue += row.Revenue
+		totals[row.Start.UnixMilli()] = t
+	}
+	starts := q.Buckets()
+	results := make([]RevenueStatistics, len(starts))
+	for i, start := range starts {
+		t := totals[start.UnixMilli()]
+		results[i] = RevenueStatistics{
+			Period:  q.Label(start),
+			Start:   start,
+			Revenue: roundMoney(t.Revenue),
+			Units:   t.Units,
+			Orders:  t.Count,
+		}
+		if t.Count > 0 {
+			results[i].AverageOrderValue = roundMoney(t.Revenue / float64(t.Count))
+		}
+	}
+	return results, nil
+}
+
+// orderRows totals the orders filter selects per bucket of q and status,
+// straight from the orders collection. Empty buckets are not returned.
+func (s *OrderService) orderRows(ctx context.Context, q StatsQuery, filter StatusFilter) ([]bucketCount, error) {
+	return s.orderRowsMatching(ctx, q, filter.match("status"))
+}
+
+// orderRowsMatching is orderRows for the orders with the fields of match
+func (s *OrderService) orderRowsMatching(ctx context.Context, q StatsQuery, match bson.D) ([]bucketCount, error) {
+	match = append(match, bson.E{Key: "_created_at", Value: bson.D{{Key: "$gte", Value: q.From}, {Key: "$lt", Value: q.To}}})
+	pipeline := mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.D{{Key: "_created_at", Value: createdAt}}}},
+		{{Key: "$match", Value: match}},
+	}
+	pipeline = append(pipeline, orderValueStages()...)
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "start", Value: q.dateTrunc("$_created_at")},
+				{Key: "key", Value: "$status"},
+			}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "units", Value: bson.D{{Key: "$sum", Value: "$quantity"}}},
+			{Key: "revenue", Value: bson.D{{Key: "$sum", Value: "$_value"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "start", Value: "$_id.start"},
+			{Key: "key", Value: "$_id.key"},
+			{Key: "count", Value: 1},
+			{Key: "units", Value: 1},
+			{Key: "revenue", Value: 1},
+		}}},
+	)
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate orders: %w", err)
+	}
+	var rows []bucketCount
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, fmt.Errorf("failed to decode order statistics: %w", err)
+	}
+	return rows, nil
+}
+
+// orderValueStages returns the stages setting _value on each order to its
+// quantity times its unit price, taken from its snapshot or else from its
+// product. Orders whose product is gone and that have no snapshot are worth 0.
+func orderValueStages() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "products"},
+			{Key: "localField", Value: "product_id"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "pipeline", Value: bson.A{bson.D{{Key: "$project", Value: bson.D{{Key: "price", Value: 1}}}}}},
+			{Key: "as", Value: "_product"},
+		}}},
+		{{Key: "$addFields", Value: bson.D{{Key: "_value", Value: bson.D{{Key: "$multiply", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$quantity", 0}}},
+			bson.D{{Key: "$ifNull", Value: bson.A{"$unit_price", bson.D{{Key: "$first", Value: "$_product.price"}}, 0}}},
+		}}}}}}},
+	}
+}
+
+// roundMoney rounds an amount to cents
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,407 @@
+package services
+
+import (
+	"backend/config"
+	"backend/models"
+	"backend/utils"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The statistics endpoints read pre-aggregated counters instead of scanning
+// the users, products and orders collections. Every write adds its change to
+// the counters of the UTC hour the document was created in, split by a
+// dimension (the status, for orders), and a periodic reconciliation rebuilds
+// the counters from the collections to correct any drift. An order is counted
+// at its price snapshot, which the reconciliation records for orders placed
+// before prices were, so that updates and deletes take back exactly what was
+// counted however the product's price changed since. Hours are summed into
+// the buckets of a StatsQuery, so queries whose buckets do not start on a UTC
+// hour, as in time zones with a half-hour offset, still scan the collections.
+
+// Rollup metrics
+const (
+	rollupUsers    = "users"
+	rollupProducts = "products"
+	rollupOrders   = "orders"
+)
+
+// rollupLeaseID is the lease document that schedules reconciliations and
+// records the last one
+const rollupLeaseID = "rollup-reconciliation"
+
+// rollupDelta is a change to the counters of the hour At falls in
+type rollupDelta struct {
+	Metric string
+	At     time.Time
+	// Key is the dimension, the status for orders
+	Key     string
+	Count   int64
+	Units   int64
+	Revenue float64
+}
+
+// negate returns the delta that undoes d
+func (d rollupDelta) negate() rollupDelta {
+	d.Count, d.Units, d.Revenue = -d.Count, -d.Units, -d.Revenue
+	return d
+}
+
+// RollupResult summarises a reconciliation
+type RollupResult struct {
+	// Hours counts the counters written per metric
+	Hours map[string]int `json:"hours"`
+	// Removed counts the counters of hours that no longer have data
+	Removed int64 `json:"removed"`
+	// Snapshotted counts the orders given a price snapshot
+	Snapshotted int   `json:"snapshotted"`
+	DurationMs  int64 `json:"duration_ms"`
+}
+
+// rollupState caches whether the rollups were reconciled at least once, and so
+// can be read; until then statistics scan the collections
+var rollupState struct {
+	sync.Mutex
+	ready   bool
+	checked time.Time
+}
+
+// rollups returns the collection the counters are kept in
+func rollups() *mongo.Collection {
+	return utils.MongoDB.Collection(config.RollupsCollection)
+}
+
+// applyRollups adds deltas to their counters. Call it inside withTransaction
+// so the counters change together with the write.
+func applyRollups(ctx context.Context, deltas ...rollupDelta) error {
+	if !config.StatsRollups || len(deltas) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	writes := make([]mongo.WriteModel, 0, len(deltas))
+	for _, d := range deltas {
+		hour := d.At.UTC().Truncate(time.Hour)
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": rollupID(d.Metric, hour, d.Key)}).
+			SetUpdate(bson.M{
+				"$inc":         bson.M{"count": d.Count, "units": d.Units, "revenue": d.Revenue},
+				"$set":         bson.M{"updated_at": now},
+				"$setOnInsert": bson.M{"metric": d.Metric, "hour": hour, "key": d.Key},
+			}).
+			SetUpsert(true))
+	}
+	if _, err := rollups().BulkWrite(ctx, writes); err != nil {
+		return fmt.Errorf("failed to update statistics rollups: %w", err)
+	}
+	return nil
+}
+
+func rollupID(metric string, hour time.Time, key string) string {
+	return metric + "|" + hour.Format(time.RFC3339) + "|" + key
+}
+
+// createdTime returns when a document was created: createdAt, or the time in
+// its ID for documents written before it was recorded
+func createdTime(createdAt time.Time, id primitive.ObjectID) time.Time {
+	if createdAt.IsZero() {
+		return id.Timestamp()
+	}
+	return createdAt
+}
+
+// orderDelta returns the contribution of an order worth value to the rollups
+func orderDelta(order models.Order, value float64) rollupDelta {
+	return rollupDelta{
+		Metric:  rollupOrders,
+		At:      createdTime(order.CreatedAt.Time, order.ID),
+		Key:     order.Status,
+		Count:   1,
+		Units:   int64(order.Quantity),
+		Revenue: value,
+	}
+}
+
+// bucketRows returns the rows of metric for q, over the keys filter selects,
+// from the rollups when they can answer q, or else from live
+func bucketRows(ctx context.Context, metric string, q StatsQuery, filter StatusFilter, live func(context.Context) ([]bucketCount, error)) ([]bucketCount, error) {
+	if !rollupsAnswer(ctx, q) {
+		return live(ctx)
+	}
+
+	match := append(filter.match("key"),
+		bson.E{Key: "metric", Value: metric},
+		bson.E{Key: "hour", Value: bson.D{{Key: "$gte", Value: q.From}, {Key: "$lt", Value: q.To}}})
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "start", Value: q.dateTrunc("$hour")},
+				{Key: "key", Value: "$key"},
+			}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+			{Key: "units", Value: bson.D{{Key: "$sum", Value: "$units"}}},
+			{Key: "revenue", Value: bson.D{{Key: "$sum", Value: "$revenue"}}},
+		}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "start", Value: "$_id.start"},
+			{Key: "key", Value: "$_id.key"},
+			{Key: "count", Value: 1},
+			{Key: "units", Value: 1},
+			{Key: "revenue", Value: 1},
+		}}},
+	}
+
+	cursor, err := rollups().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read statistics rollups: %w", err)
+	}
+	var rows []bucketCount
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, fmt.Errorf("failed to decode statistics rollups: %w", err)
+	}
+	return rows, nil
+}
+
+// onUTCHours reports whether every bucket of q starts on a UTC hour, as the
+// hourly rollups do; days in zones such as +05:30 do not
+func onUTCHours(q StatsQuery) bool {
+	for _, start := range q.Buckets() {
+		if start.Unix()%3600 != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rollupsAnswer reports whether q can be answered from the rollups: they are
+// enabled and reconciled, and every bucket of q starts on a UTC hour
+func rollupsAnswer(ctx context.Context, q StatsQuery) bool {
+	if !config.StatsRollups || !onUTCHours(q) {
+		return false
+	}
+
+	// One request at a time checks, without holding up the others
+	rollupState.Lock()
+	ready, due := rollupState.ready, !rollupState.ready && time.Since(rollupState.checked) > 30*time.Second
+	if due {
+		rollupState.checked = time.Now()
+	}
+	rollupState.Unlock()
+	if !due {
+		return ready
+	}
+
+	n, err := utils.MongoDB.Collection("leases").CountDocuments(ctx,
+		bson.M{"_id": rollupLeaseID, "reconciled_at": bson.M{"$exists": true}})
+	if err != nil || n == 0 {
+		return false
+	}
+	rollupState.Lock()
+	rollupState.ready = true
+	rollupState.Unlock()
+	return true
+}
+
+// StartRollupReconciliation ensures the rollup index and reconciles the
+// rollups every config.RollupReconcileInterval until ctx is done, on one
+// instance at a time. The first reconciliation runs right away when there was
+// none yet.
+func StartRollupReconciliation(ctx context.Context, orders *OrderService) {
+	if !config.StatsRollups {
+		return
+	}
+	_, err := rollups().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "metric", Value: 1}, {Key: "hour", Value: 1}},
+	})
+	if err != nil {
+		utils.Logger.Warn("failed to create rollup index", "error", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			if claimed, err := claimRun(ctx, rollupLeaseID, config.RollupReconcileInterval); err != nil && ctx.Err() == nil {
+				utils.Logger.Warn("failed to schedule rollup reconciliation", "error", err)
+			} else if claimed {
+				result, err := RebuildRollups(ctx, orders)
+				if err != nil {
+					utils.Logger.Error("rollup reconciliation failed", "error", err)
+				} else {
+					utils.Logger.Info("rollups reconciled", "hours", result.Hours, "removed", result.Removed, "duration_ms", result.DurationMs)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// claimRun schedules the next run of the periodic job leaseID when the current
+// one is due, reporting whether this instance claimed it. The first run is due
+// right away.
+func claimRun(ctx context.Context, leaseID string, interval time.Duration) (bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id": leaseID,
+		"$or": bson.A{
+			bson.M{"next_run_at": bson.M{"$lte": now}},
+			bson.M{"next_run_at": bson.M{"$exists": false}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"next_run_at": now.Add(interval)}}
+
+	result, err := utils.MongoDB.Collection("leases").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0 || result.UpsertedCount > 0, nil
+}
+
+// RebuildRollups records the price snapshot of the orders that have none,
+// recomputes every counter from the users, products and orders collections
+// and removes those of hours left without data. Changes written while it runs
+// may be off until the next reconciliation.
+func RebuildRollups(ctx context.Context, orders *OrderService) (result RollupResult, err error) {
+	ctx, span := startSpan(ctx, "RebuildRollups")
+	defer endSpan(span, &err)
+
+	if result.Snapshotted, err = orders.snapshotPrices(ctx); err != nil {
+		return result, err
+	}
+	start := time.Now()
+
+	sources := []struct {
+		metric     string
+		collection string
+		splitBy    string
+		value      bool
+	}{
+		{rollupUsers, "users", "", false},
+		{rollupProducts, "products", "", false},
+		{rollupOrders, "orders", "status", true},
+	}
+
+	result.Hours = map[string]int{}
+	for _, source := range sources {
+		n, err := rebuildRollup(ctx, source.metric, utils.MongoDB.Collection(source.collection), source.splitBy, source.value)
+		if err != nil {
+			return result, err
+		}
+		result.Hours[source.metric] = n
+	}
+
+	// Counters written before the rebuild started, by it or by a write, belong to
+	// hours that no longer have data
+	deleted, err := rollups().DeleteMany(ctx, bson.M{"updated_at": bson.M{"$lt": start}})
+	if err != nil {
+		return result, fmt.Errorf("failed to remove stale rollups: %w", err)
+	}
+	result.Removed = deleted.DeletedCount
+
+	_, err = utils.MongoDB.Collection("leases").UpdateOne(ctx, bson.M{"_id": rollupLeaseID},
+		bson.M{"$set": bson.M{"reconciled_at": time.Now()}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return result, fmt.Errorf("failed to record rollup reconciliation: %w", err)
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// rebuildRollup overwrites the counters of metric with the totals of
+// collection per UTC hour and value of splitBy, valuing orders when value is
+// set. It returns the number of counters written.
+func rebuildRollup(ctx context.Context, metric string, collection *mongo.Collection, splitBy string, value bool) (int, error) {
+	key := any("")
+	if splitBy != "" {
+		key = bson.D{{Key: "$ifNull", Value: bson.A{"$" + splitBy, ""}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.D{{Key: "_created_at", Value: createdAt}, {Key: "_value", Value: 0}}}},
+	}
+	if value {
+		pipeline = append(pipeline, orderValueStages()...)
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$group", Value: bson.D{
+		{Key: "_id", Value: bson.D{
+			{Key: "hour", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{{Key: "date", Value: "$_created_at"}, {Key: "unit", Value: "hour"}}}}},
+			{Key: "key", Value: key},
+		}},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		{Key: "units", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$quantity", 0}}}}}},
+		{Key: "revenue", Value: bson.D{{Key: "$sum", Value: "$_value"}}},
+	}}})
+
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, fmt.Errorf("failed to aggregate %s rollups: %w", metric, err)
+	}
+	defer cursor.Close(ctx)
+
+	written := 0
+	var writes []mongo.WriteModel
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		if _, err := rollups().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			return fmt.Errorf("failed to write %s rollups: %w", metric, err)
+		}
+		written += len(writes)
+		writes = writes[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				Hour time.Time `bson:"hour"`
+				Key  string    `bson:"key"`
+			} `bson:"_id"`
+			Count   int64   `bson:"count"`
+			Units   int64   `bson:"units"`
+			Revenue float64 `bson:"revenue"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return written, fmt.Errorf("failed to decode %s rollup: %w", metric, err)
+		}
+		hour := row.ID.Hour.UTC()
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": rollupID(metric, hour, row.ID.Key)}).
+			SetReplacement(bson.M{
+				"metric":     metric,
+				"hour":       hour,
+				"key":        row.ID.Key,
+				"count":      row.Count,
+				"units":      row.Units,
+				"revenue":    row.Revenue,
+				"updated_at": time.Now(),
+			}).
+			SetUpsert(true))
+		if len(writes) == 1000 {
+			if err := flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return written, fmt.Errorf("failed to aggregate %s rollups: %w", metric, err)
+	}
+	return written, flush()
+}
@@ -0,0 +1,275 @@
+package services
+
+import (
+	"backend/config"
+	"context"
+	"fmt"
+	"time"
+	// Bucket boundaries depend on time zone rules, which slim images lack
+	_ "time/tzdata"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statistics granularities, the length of the buckets counts are reported in
+const (
+	GranularityHour    = "hour"
+	GranularityDay     = "day"
+	GranularityWeek    = "week"
+	GranularityMonth   = "month"
+	GranularityQuarter = "quarter"
+	GranularityYear    = "year"
+)
+
+// defaultBuckets is how many buckets, up to the current one, are reported
+// when no range is given
+var defaultBuckets = map[string]int{
+	GranularityHour:    24,
+	GranularityDay:     30,
+	GranularityWeek:    12,
+	GranularityMonth:   12,
+	GranularityQuarter: 8,
+	GranularityYear:    5,
+}
+
+// StatsQuery selects the buckets statistics are reported in: every bucket of
+// Granularity from From up to To, in the calendar of Location. Weeks start on
+// Monday.
+type StatsQuery struct {
+	Granularity string
+	// From is the start of the first bucket and To the end of the last
+	From time.Time
+	To   time.Time
+	// Location is the time zone buckets start and end in
+	Location *time.Location
+}
+
+// StatsBucket is the count of one bucket
+type StatsBucket struct {
+	// Period labels the bucket, e.g. 2024-05-01 for a day, 2024-W18 for a
+	// week or 2024-Q2 for a quarter
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	Count  int64     `json:"count"`
+}
+
+// NewStatsQuery validates the query and widens from and to to whole buckets.
+// Without to the range ends with the current bucket, and without from it
+// covers a default number of buckets. A nil loc is config.StatsTimezone.
+func NewStatsQuery(granularity string, from, to time.Time, loc *time.Location) (StatsQuery, error) {
+	if granularity == "" {
+		granularity = GranularityMonth
+	}
+	if _, ok := defaultBuckets[granularity]; !ok {
+		return StatsQuery{}, fmt.Errorf("%w: granularity must be hour, day, week, month, quarter or year", ErrInvalidInput)
+	}
+	if loc == nil {
+		var err error
+		if loc, err = StatsLocation(""); err != nil {
+			return StatsQuery{}, err
+		}
+	}
+
+	q := StatsQuery{Granularity: granularity, Location: loc}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if q.To = q.Truncate(to); !q.To.Equal(to) {
+		q.To = q.next(q.To)
+	}
+	if from.IsZero() {
+		q.From = q.To
+		for i := 0; i < defaultBuckets[granularity]; i++ {
+			q.From = q.previous(q.From)
+		}
+	} else {
+		q.From = q.Truncate(from)
+	}
+
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("%w: from must be before to", ErrInvalidInput)
+	}
+	n := 0
+	for start := q.From; start.Before(q.To); start = q.next(start) {
+		if n++; n > config.StatsMaxBuckets {
+			return q, fmt.Errorf("%w: the range spans more than %d %s buckets", ErrInvalidInput, config.StatsMaxBuckets, granularity)
+		}
+	}
+	return q, nil
+}
+
+// StatsLocation returns the time zone named tz, an IANA name such as
+// Asia/Bangkok, or config.StatsTimezone when tz is empty
+func StatsLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		tz = config.StatsTimezone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil || tz == "Local" {
+		return nil, fmt.Errorf("%w: unknown time zone %q", ErrInvalidInput, tz)
+	}
+	return loc, nil
+}
+
+// Truncate returns the start of the bucket t falls in
+func (q StatsQuery) Truncate(t time.Time) time.Time {
+	t = t.In(q.Location)
+	y, m, d := t.Date()
+	switch q.Granularity {
+	case GranularityHour:
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, q.Location)
+	case GranularityDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, q.Location)
+	case GranularityWeek:
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, q.Location)
+	case GranularityQuarter:
+		return time.Date(y, m-(m-1)%3, 1, 0, 0, 0, 0, q.Location)
+	case GranularityYear:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, q.Location)
+	default:
+		return time.Date(y, m, 1, 0, 0, 0, 0, q.Location)
+	}
+}
+
+// Buckets returns the start of every bucket in the range
+func (q StatsQuery) Buckets() []time.Time {
+	var starts []time.Time
+	for start := q.From; start.Before(q.To); start = q.next(start) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// Label returns the period label of the bucket starting at start
+func (q StatsQuery) Label(start time.Time) string {
+	start = start.In(q.Location)
+	switch q.Granularity {
+	case GranularityHour:
+		return start.Format("2006-01-02T15:00")
+	case GranularityDay:
+		return start.Format("2006-01-02")
+	case GranularityWeek:
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case GranularityQuarter:
+		return fmt.Sprintf("%d-Q%d", start.Year(), (int(start.Month())-1)/3+1)
+	case GranularityYear:
+		return start.Format("2006")
+	default:
+		return start.Format("2006-01")
+	}
+}
+
+// next returns the start of the bucket after the one starting at start
+func (q StatsQuery) next(start time.Time) time.Time {
+	return q.shift(start, 1)
+}
+
+// previous returns the start of the bucket before the one starting at start
+func (q StatsQuery) previous(start time.Time) time.Time {
+	return q.shift(start, -1)
+}
+
+func (q StatsQuery) shift(start time.Time, n int) time.Time {
+	y, m, d := start.Date()
+	switch q.Granularity {
+	case GranularityHour:
+		return start.Add(time.Duration(n) * time.Hour)
+	case GranularityDay:
+		return time.Date(y, m, d+n, 0, 0, 0, 0, q.Location)
+	case GranularityWeek:
+		return time.Date(y, m, d+7*n, 0, 0, 0, 0, q.Location)
+	case GranularityQuarter:
+		return time.Date(y, m+time.Month(3*n), 1, 0, 0, 0, 0, q.Location)
+	case GranularityYear:
+		return time.Date(y+n, 1, 1, 0, 0, 0, 0, q.Location)
+	default:
+		return time.Date(y, m+time.Month(n), 1, 0, 0, 0, 0, q.Location)
+	}
+}
+
+// cacheID identifies the query within a statistics cache
+func (q StatsQuery) cacheID() string {
+	return fmt.Sprintf("%s:from=%d:to=%d:tz=%s", q.Granularity, q.From.Unix(), q.To.Unix(), q.Location)
+}
+
+// dateTrunc returns the expression truncating the date expression date to the
+// start of its bucket, the way Truncate does
+func (q StatsQuery) dateTrunc(date any) bson.D {
+	trunc := bson.D{
+		{Key: "date", Value: date},
+		{Key: "unit", Value: q.Granularity},
+		{Key: "timezone", Value: q.Location.String()},
+	}
+	if q.Granularity == GranularityWeek {
+		trunc = append(trunc, bson.E{Key: "startOfWeek", Value: "monday"})
+	}
+	return bson.D{{Key: "$dateTrunc", Value: trunc}}
+}
+
+// createdAt is when a document was created: its createdAt field, or the time
+// in its ObjectID for documents written before they had one
+var createdAt = bson.D{{Key: "$ifNull", Value: bson.A{
+	bson.D{{Key: "$convert", Value: bson.D{
+		{Key: "input", Value: "$createdAt"},
+		{Key: "to", Value: "date"},
+		{Key: "onError", Value: nil},
+		{Key: "onNull", Value: nil},
+	}}},
+	bson.D{{Key: "$toDate", Value: "$_id"}},
+}}}
+
+// bucketCount is the number of documents created in one bucket, with one value
+// of the dimension they were split by. Units and Revenue total orders.
+type bucketCount struct {
+	Start   time.Time `bson:"start"`
+	Key     string    `bson:"key"`
+	Count   int64     `bson:"count"`
+	Units   int64     `bson:"units"`
+	Revenue float64   `bson:"revenue"`
+}
+
+// countByBucket counts the documents of collection created in each bucket of
+// q. Empty buckets are not returned.
+func countByBucket(ctx context.Context, collection *mongo.Collection, q StatsQuery) ([]bucketCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.D{{Key: "_created_at", Value: createdAt}}}},
+		{{Key: "$match", Value: bson.D{{Key: "_created_at", Value: bson.D{{Key: "$gte", Value: q.From}, {Key: "$lt", Value: q.To}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: q.dateTrunc("$_created_at")},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "start", Value: "$_id"},
+			{Key: "count", Value: 1},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate statistics: %w", err)
+	}
+	var counts []bucketCount
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, fmt.Errorf("failed to decode statistics: %w", err)
+	}
+	return counts, nil
+}
+
+// fill returns every bucket of q with its count, zero for those counts lacks
+func (q StatsQuery) fill(counts []bucketCount) []StatsBucket {
+	totals := make(map[int64]int64, len(counts))
+	for _, c := range counts {
+		totals[c.Start.UnixMilli()] += c.Count
+	}
+
+	starts := q.Buckets()
+	buckets := make([]StatsBucket, len(starts))
+	for i, start := range starts {
+		buckets[i] = StatsBucket{Period: q.Label(start), Start: start, Count: totals[start.UnixMilli()]}
+	}
+	return buckets
+}
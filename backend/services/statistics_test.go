@@ -0,0 +1,487 @@
+package services
+
+import (
+	"backend/config"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestNewStatsQuery(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	kolkata := loadLocation(t, "Asia/Kolkata")
+
+	tests := []struct {
+		name        string
+		granularity string
+		from, to    time.Time
+		loc         *time.Location
+		wantFrom    time.Time
+		wantTo      time.Time
+		wantBuckets int
+		wantErr     bool
+	}{
+		{
+			name:        "to widened to the end of its bucket",
+			granularity: GranularityDay,
+			from:        time.Date(2024, 5, 1, 9, 0, 0, 0, berlin),
+			to:          time.Date(2024, 5, 15, 10, 0, 0, 0, berlin),
+			loc:         berlin,
+			wantFrom:    time.Date(2024, 5, 1, 0, 0, 0, 0, berlin),
+			wantTo:      time.Date(2024, 5, 16, 0, 0, 0, 0, berlin),
+			wantBuckets: 15,
+		},
+		{
+			name:        "to on a bucket start kept",
+			granularity: GranularityDay,
+			from:        time.Date(2024, 5, 1, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 5, 15, 0, 0, 0, 0, berlin),
+			loc:         berlin,
+			wantFrom:    time.Date(2024, 5, 1, 0, 0, 0, 0, berlin),
+			wantTo:      time.Date(2024, 5, 15, 0, 0, 0, 0, berlin),
+			wantBuckets: 14,
+		},
+		{
+			name:        "default from",
+			granularity: GranularityDay,
+			to:          time.Date(2024, 4, 15, 10, 0, 0, 0, berlin),
+			loc:         berlin,
+			wantFrom:    time.Date(2024, 3, 17, 0, 0, 0, 0, berlin),
+			wantTo:      time.Date(2024, 4, 16, 0, 0, 0, 0, berlin),
+			wantBuckets: defaultBuckets[GranularityDay],
+		},
+		{
+			name:        "default granularity",
+			to:          time.Date(2024, 5, 15, 10, 0, 0, 0, berlin),
+			loc:         berlin,
+			wantFrom:    time.Date(2023, 6, 1, 0, 0, 0, 0, berlin),
+			wantTo:      time.Date(2024, 6, 1, 0, 0, 0, 0, berlin),
+			wantBuckets: defaultBuckets[GranularityMonth],
+		},
+		{
+			name:        "default hours across the start of summer time",
+			granularity: GranularityHour,
+			to:          time.Date(2024, 4, 1, 0, 0, 0, 0, berlin),
+			loc:         berlin,
+			wantFrom:    time.Date(2024, 3, 30, 23, 0, 0, 0, berlin),
+			wantTo:      time.Date(2024, 4, 1, 0, 0, 0, 0, berlin),
+			wantBuckets: defaultBuckets[GranularityHour],
+		},
+		{
+			name:        "days in a half-hour zone",
+			granularity: GranularityDay,
+			from:        time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC),
+			to:          time.Date(2024, 5, 3, 20, 0, 0, 0, time.UTC),
+			loc:         kolkata,
+			wantFrom:    time.Date(2024, 5, 2, 0, 0, 0, 0, kolkata),
+			wantTo:      time.Date(2024, 5, 5, 0, 0, 0, 0, kolkata),
+			wantBuckets: 3,
+		},
+		{
+			name:        "unknown granularity",
+			granularity: "minute",
+			loc:         berlin,
+			wantErr:     true,
+		},
+		{
+			name:        "from after to",
+			granularity: GranularityDay,
+			from:        time.Date(2024, 5, 15, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 5, 1, 0, 0, 0, 0, berlin),
+			loc:         berlin,
+			wantErr:     true,
+		},
+		{
+			name:        "from and to in one bucket start",
+			granularity: GranularityMonth,
+			from:        time.Date(2024, 5, 1, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 5, 1, 0, 0, 0, 0, berlin),
+			loc:         berlin,
+			wantErr:     true,
+		},
+		{
+			name:        "too many buckets",
+			granularity: GranularityHour,
+			from:        time.Date(2024, 1, 1, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 1, 1, 0, 0, 0, 0, berlin).Add(time.Duration(config.StatsMaxBuckets+1) * time.Hour),
+			loc:         berlin,
+			wantErr:     true,
+		},
+		{
+			name:        "as many buckets as allowed",
+			granularity: GranularityHour,
+			from:        time.Date(2024, 1, 1, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 1, 1, 0, 0, 0, 0, berlin).Add(time.Duration(config.StatsMaxBuckets) * time.Hour),
+			loc:         berlin,
+			wantFrom:    time.Date(2024, 1, 1, 0, 0, 0, 0, berlin),
+			wantTo:      time.Date(2024, 1, 1, 0, 0, 0, 0, berlin).Add(time.Duration(config.StatsMaxBuckets) * time.Hour),
+			wantBuckets: config.StatsMaxBuckets,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewStatsQuery(tt.granularity, tt.from, tt.to, tt.loc)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidInput) {
+					t.Errorf("NewStatsQuery error = %v, want ErrInvalidInput", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !q.From.Equal(tt.wantFrom) || !q.To.Equal(tt.wantTo) {
+				t.Errorf("range = %v to %v, want %v to %v", q.From, q.To, tt.wantFrom, tt.wantTo)
+			}
+			if n := len(q.Buckets()); n != tt.wantBuckets {
+				t.Errorf("%d buckets, want %d", n, tt.wantBuckets)
+			}
+		})
+	}
+}
+
+func TestNewStatsQueryDefaultRange(t *testing.T) {
+	before := time.Now()
+	q, err := NewStatsQuery(GranularityDay, time.Time{}, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Location.String() != config.StatsTimezone {
+		t.Errorf("Location = %s, want %s", q.Location, config.StatsTimezone)
+	}
+	// The range ends with the bucket of now
+	if !q.To.After(before) || q.To.Sub(before) > 25*time.Hour {
+		t.Errorf("To = %v, want the end of the day of %v", q.To, before)
+	}
+	if n := len(q.Buckets()); n != defaultBuckets[GranularityDay] {
+		t.Errorf("%d buckets, want %d", n, defaultBuckets[GranularityDay])
+	}
+}
+
+func TestStatsLocation(t *testing.T) {
+	tests := []struct {
+		tz      string
+		want    string
+		wantErr bool
+	}{
+		{tz: "", want: config.StatsTimezone},
+		{tz: "Europe/Berlin", want: "Europe/Berlin"},
+		{tz: "UTC", want: "UTC"},
+		{tz: "Local", wantErr: true},
+		{tz: "Mars/Olympus_Mons", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tz, func(t *testing.T) {
+			loc, err := StatsLocation(tt.tz)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidInput) {
+					t.Errorf("StatsLocation error = %v, want ErrInvalidInput", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loc.String() != tt.want {
+				t.Errorf("StatsLocation = %s, want %s", loc, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsQueryTruncate(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	kolkata := loadLocation(t, "Asia/Kolkata")
+
+	tests := []struct {
+		name        string
+		granularity string
+		loc         *time.Location
+		t           time.Time
+		want        time.Time
+		wantLabel   string
+	}{
+		{
+			name:        "hour",
+			granularity: GranularityHour,
+			loc:         berlin,
+			t:           time.Date(2024, 3, 31, 3, 45, 10, 0, berlin),
+			want:        time.Date(2024, 3, 31, 3, 0, 0, 0, berlin),
+			wantLabel:   "2024-03-31T03:00",
+		},
+		{
+			name:        "hour in a half-hour zone",
+			granularity: GranularityHour,
+			loc:         kolkata,
+			t:           time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC),
+			want:        time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC),
+			wantLabel:   "2024-05-01T15:00",
+		},
+		{
+			name:        "day of the zone, not of UTC",
+			granularity: GranularityDay,
+			loc:         berlin,
+			t:           time.Date(2024, 3, 31, 23, 30, 0, 0, time.UTC),
+			want:        time.Date(2024, 4, 1, 0, 0, 0, 0, berlin),
+			wantLabel:   "2024-04-01",
+		},
+		{
+			name:        "day starting before midnight UTC",
+			granularity: GranularityDay,
+			loc:         kolkata,
+			t:           time.Date(2024, 5, 1, 19, 0, 0, 0, time.UTC),
+			want:        time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC),
+			wantLabel:   "2024-05-02",
+		},
+		{
+			name:        "week from a Sunday",
+			granularity: GranularityWeek,
+			loc:         berlin,
+			t:           time.Date(2024, 3, 31, 12, 0, 0, 0, berlin),
+			want:        time.Date(2024, 3, 25, 0, 0, 0, 0, berlin),
+			wantLabel:   "2024-W13",
+		},
+		{
+			name:        "week from a Monday",
+			granularity: GranularityWeek,
+			loc:         berlin,
+			t:           time.Date(2024, 4, 1, 0, 0, 0, 0, berlin),
+			want:        time.Date(2024, 4, 1, 0, 0, 0, 0, berlin),
+			wantLabel:   "2024-W14",
+		},
+		{
+			name:        "week in the ISO year after",
+			granularity: GranularityWeek,
+			loc:         berlin,
+			t:           time.Date(2024, 12, 31, 12, 0, 0, 0, berlin),
+			want:        time.Date(2024, 12, 30, 0, 0, 0, 0, berlin),
+			wantLabel:   "2025-W01",
+		},
+		{
+			name:        "month",
+			granularity: GranularityMonth,
+			loc:         berlin,
+			t:           time.Date(2024, 3, 31, 23, 59, 0, 0, berlin),
+			want:        time.Date(2024, 3, 1, 0, 0, 0, 0, berlin),
+			wantLabel:   "2024-03",
+		},
+		{
+			name:        "quarter",
+			granularity: GranularityQuarter,
+			loc:         berlin,
+			t:           time.Date(2024, 6, 30, 12, 0, 0, 0, berlin),
+			want:        time.Date(2024, 4, 1, 0, 0, 0, 0, berlin),
+			wantLabel:   "2024-Q2",
+		},
+		{
+			name:        "year",
+			granularity: GranularityYear,
+			loc:         kolkata,
+			t:           time.Date(2023, 12, 31, 20, 0, 0, 0, time.UTC),
+			want:        time.Date(2024, 1, 1, 0, 0, 0, 0, kolkata),
+			wantLabel:   "2024",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := StatsQuery{Granularity: tt.granularity, Location: tt.loc}
+			got := q.Truncate(tt.t)
+			if !got.Equal(tt.want) {
+				t.Errorf("Truncate(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+			if label := q.Label(got); label != tt.wantLabel {
+				t.Errorf("Label = %s, want %s", label, tt.wantLabel)
+			}
+			if next := q.next(got); !q.previous(next).Equal(got) || !q.Truncate(next).Equal(next) {
+				t.Errorf("next = %v, want the start of the bucket after %v", next, got)
+			}
+		})
+	}
+}
+
+func TestStatsQueryBuckets(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	kolkata := loadLocation(t, "Asia/Kolkata")
+
+	tests := []struct {
+		name        string
+		granularity string
+		from, to    time.Time
+		wantLabels  []string
+		// wantLengths are the real lengths of the buckets
+		wantLengths []time.Duration
+	}{
+		{
+			name:        "hours skip the hour summer time leaves out",
+			granularity: GranularityHour,
+			from:        time.Date(2024, 3, 31, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 3, 31, 4, 0, 0, 0, berlin),
+			wantLabels:  []string{"2024-03-31T00:00", "2024-03-31T01:00", "2024-03-31T03:00"},
+			wantLengths: []time.Duration{time.Hour, time.Hour, time.Hour},
+		},
+		{
+			name:        "day summer time starts is 23 hours",
+			granularity: GranularityDay,
+			from:        time.Date(2024, 3, 30, 12, 0, 0, 0, berlin),
+			to:          time.Date(2024, 4, 1, 12, 0, 0, 0, berlin),
+			wantLabels:  []string{"2024-03-30", "2024-03-31", "2024-04-01"},
+			wantLengths: []time.Duration{24 * time.Hour, 23 * time.Hour, 24 * time.Hour},
+		},
+		{
+			name:        "day summer time ends is 25 hours",
+			granularity: GranularityDay,
+			from:        time.Date(2024, 10, 27, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 10, 28, 0, 0, 0, 0, berlin),
+			wantLabels:  []string{"2024-10-27"},
+			wantLengths: []time.Duration{25 * time.Hour},
+		},
+		{
+			name:        "week summer time starts in",
+			granularity: GranularityWeek,
+			from:        time.Date(2024, 3, 25, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 4, 8, 0, 0, 0, 0, berlin),
+			wantLabels:  []string{"2024-W13", "2024-W14"},
+			wantLengths: []time.Duration{7*24*time.Hour - time.Hour, 7 * 24 * time.Hour},
+		},
+		{
+			name:        "months across summer time",
+			granularity: GranularityMonth,
+			from:        time.Date(2024, 2, 1, 0, 0, 0, 0, berlin),
+			to:          time.Date(2024, 5, 1, 0, 0, 0, 0, berlin),
+			wantLabels:  []string{"2024-02", "2024-03", "2024-04"},
+			wantLengths: []time.Duration{29 * 24 * time.Hour, 31*24*time.Hour - time.Hour, 30 * 24 * time.Hour},
+		},
+		{
+			name:        "days in a half-hour zone",
+			granularity: GranularityDay,
+			from:        time.Date(2024, 3, 30, 0, 0, 0, 0, kolkata),
+			to:          time.Date(2024, 4, 2, 0, 0, 0, 0, kolkata),
+			wantLabels:  []string{"2024-03-30", "2024-03-31", "2024-04-01"},
+			wantLengths: []time.Duration{24 * time.Hour, 24 * time.Hour, 24 * time.Hour},
+		},
+		{
+			name:        "quarters across a year",
+			granularity: GranularityQuarter,
+			from:        time.Date(2023, 11, 15, 0, 0, 0, 0, kolkata),
+			to:          time.Date(2024, 4, 1, 0, 0, 0, 0, kolkata),
+			wantLabels:  []string{"2023-Q4", "2024-Q1"},
+			wantLengths: []time.Duration{92 * 24 * time.Hour, 91 * 24 * time.Hour},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewStatsQuery(tt.granularity, tt.from, tt.to, tt.from.Location())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			starts := q.Buckets()
+			if len(starts) != len(tt.wantLabels) {
+				t.Fatalf("%d buckets, want %d", len(starts), len(tt.wantLabels))
+			}
+			for i, start := range starts {
+				if label := q.Label(start); label != tt.wantLabels[i] {
+					t.Errorf("bucket %d = %s, want %s", i, label, tt.wantLabels[i])
+				}
+				if length := q.next(start).Sub(start); length != tt.wantLengths[i] {
+					t.Errorf("bucket %s lasts %v, want %v", q.Label(start), length, tt.wantLengths[i])
+				}
+			}
+			if end := q.next(starts[len(starts)-1]); !end.Equal(q.To) {
+				t.Errorf("last bucket ends at %v, want To %v", end, q.To)
+			}
+		})
+	}
+}
+
+func TestStatsQueryFill(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	q, err := NewStatsQuery(GranularityDay, time.Date(2024, 3, 30, 0, 0, 0, 0, berlin), time.Date(2024, 4, 2, 0, 0, 0, 0, berlin), berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts come back from MongoDB in UTC, split by key
+	counts := []bucketCount{
+		{Start: time.Date(2024, 3, 29, 23, 0, 0, 0, time.UTC), Key: "pending", Count: 2},
+		{Start: time.Date(2024, 3, 29, 23, 0, 0, 0, time.UTC), Key: "shipped", Count: 3},
+		{Start: time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC), Key: "pending", Count: 4},
+	}
+	want := []StatsBucket{
+		{Period: "2024-03-30", Start: time.Date(2024, 3, 30, 0, 0, 0, 0, berlin), Count: 5},
+		{Period: "2024-03-31", Start: time.Date(2024, 3, 31, 0, 0, 0, 0, berlin), Count: 0},
+		{Period: "2024-04-01", Start: time.Date(2024, 4, 1, 0, 0, 0, 0, berlin), Count: 4},
+	}
+
+	got := q.fill(counts)
+	if len(got) != len(want) {
+		t.Fatalf("fill = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].Period != want[i].Period || !got[i].Start.Equal(want[i].Start) || got[i].Count != want[i].Count {
+			t.Errorf("bucket %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBucketRowsUnalignedBuckets(t *testing.T) {
+	tests := []struct {
+		name        string
+		tz          string
+		granularity string
+		want        bool
+	}{
+		{name: "UTC hours", tz: "UTC", granularity: GranularityHour, want: true},
+		{name: "days across summer time", tz: "Europe/Berlin", granularity: GranularityDay, want: true},
+		{name: "weeks in a whole-hour zone", tz: "Asia/Bangkok", granularity: GranularityWeek, want: true},
+		{name: "days in a half-hour zone", tz: "Asia/Kolkata", granularity: GranularityDay, want: false},
+		{name: "hours in a half-hour zone", tz: "Asia/Kolkata", granularity: GranularityHour, want: false},
+		{name: "months in a quarter-hour zone", tz: "Asia/Kathmandu", granularity: GranularityMonth, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := loadLocation(t, tt.tz)
+			q, err := NewStatsQuery(tt.granularity, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 4, 1, 0, 0, 0, 0, loc), loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := onUTCHours(q); got != tt.want {
+				t.Errorf("onUTCHours = %v, want %v", got, tt.want)
+			}
+			if tt.want {
+				return
+			}
+
+			// The hourly rollups cannot answer, so the rows are aggregated
+			// live, without a query against the rollups
+			rows := []bucketCount{{Start: q.From, Count: 7}}
+			calls := 0
+			got, err := bucketRows(context.Background(), "orders", q, StatusFilter{}, func(context.Context) ([]bucketCount, error) {
+				calls++
+				return rows, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calls != 1 || len(got) != 1 || got[0].Count != 7 {
+				t.Errorf("bucketRows = %v after %d live aggregations, want the live rows", got, calls)
+			}
+		})
+	}
+}
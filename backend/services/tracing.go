@@ -0,0 +1,27 @@
+package services
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("backend/services")
+
+// startSpan opens a span named after the service method being called
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name)
+}
+
+// endSpan classifies the method's returned error, marks the span as failed when
+// it is set and ends the span. It is deferred with a pointer to the named result.
+func endSpan(span trace.Span, errp *error) {
+	if err := classifyContextError(*errp); err != nil {
+		*errp = err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,10 +1,16 @@
 package services
 
 import (
+	"backend/cache"
+	"backend/config"
+	"backend/events"
 	"backend/models"
+	"backend/stream"
+	"backend/utils"
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -12,17 +18,38 @@ import (
 )
 
 type UserService struct {
-    collection *mongo.Collection
+	collection *mongo.Collection
+	cache      *cache.Cache[models.User]
+	listCache  *cache.Cache[[]models.User]
+	countCache *cache.Cache[int64]
+	statsCache *cache.Cache[[]StatsBucket]
+	// Cohorts follow the orders of the users
+	cohortCache *cache.Cache[CohortReport]
 }
 
 func NewUserService(collection *mongo.Collection) *UserService {
-    return &UserService{collection: collection}
+	s := &UserService{
+		collection:  collection,
+		cache:       newCache[models.User](utils.RedisClient, "user", config.CacheTTLUsers, entityTags("user")),
+		listCache:   newCache[[]models.User](utils.RedisClient, "user-list", config.CacheTTLLists, collectionTags("users")),
+		countCache:  newCache[int64](utils.RedisClient, "user-count", config.CacheTTLLists, collectionTags("users")),
+		statsCache:  newCache[[]StatsBucket](utils.RedisClient, "user-stats", config.CacheTTLStats, collectionTags("users")),
+		cohortCache: newCache[CohortReport](utils.RedisClient, "user-cohorts", config.CacheTTLStats, collectionTags("users", "orders")),
+	}
+	purgeOnRecovery(s.cache, s.listCache, s.countCache, s.statsCache, s.cohortCache)
+
+	return s
 }
 
 // FindUserByEmail finds a user by their email address
-func (s *UserService) FindUserByEmail(email string) (*models.User, error) {
+func (s *UserService) FindUserByEmail(ctx context.Context, email string) (_ *models.User, err error) {
+	ctx, span := startSpan(ctx, "UserService.FindUserByEmail")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
 	var user models.User
-	err := s.collection.FindOne(context.Background(), bson.M{"email": email}).Decode(&user)
+	err = s.collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
@@ -32,92 +59,191 @@ func (s *UserService) FindUserByEmail(email string) (*models.User, error) {
 	return &user, nil
 }
 
-func (s *UserService) CreateUser(user models.User) (primitive.ObjectID, error) {
+func (s *UserService) CreateUser(ctx context.Context, user models.User) (_ primitive.ObjectID, err error) {
+	ctx, span := startSpan(ctx, "UserService.CreateUser")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
 
-    if user.Email == "" || user.Name == "" {
-        return primitive.NilObjectID, errors.New("missing required fields: email and name")
-    }
+	if user.Email == "" || user.Name == "" {
+		return primitive.NilObjectID, fmt.Errorf("%w: missing required fields: email and name", ErrInvalidInput)
+	}
 
-    // Check if the email already exists
-	existingUser, err := s.FindUserByEmail(user.Email)
+	// Check if the email already exists
+	existingUser, err := s.FindUserByEmail(ctx, user.Email)
 	if err != nil && err != mongo.ErrNoDocuments {
-		return primitive.NilObjectID, fmt.Errorf("error checking email existence: %v", err)
+		return primitive.NilObjectID, fmt.Errorf("error checking email existence: %w", err)
 	}
 	if existingUser != nil {
-		return primitive.NilObjectID, errors.New("email already exists")
+		return primitive.NilObjectID, fmt.Errorf("email %w", ErrConflict)
 	}
 
-    // Insert the new user into the database
-	result, err := s.collection.InsertOne(context.Background(), user)
+	// Insert the new user into the database
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	user.CreatedAt = models.NewTimestamp(time.Now())
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		if _, err := s.collection.InsertOne(ctx, user); err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+		if err := applyRollups(ctx, rollupDelta{Metric: rollupUsers, At: user.CreatedAt.Time, Count: 1}); err != nil {
+			return err
+		}
+		return recordEvent(ctx, events.UserRegistered, user.ID, events.UserRegisteredPayload{
+			UserID: user.ID.Hex(),
+		})
+	})
 	if err != nil {
-		return primitive.NilObjectID, fmt.Errorf("failed to create user: %v", err)
+		return primitive.NilObjectID, err
 	}
+	s.invalidate(ctx, user.ID)
+	s.cache.Set(ctx, user.ID.Hex(), user)
+	publishChange(ctx, stream.Users, stream.Created, user.ID, user.ID.Hex(), user)
 
-    return result.InsertedID.(primitive.ObjectID), nil
+	return user.ID, nil
 }
 
-func (s *UserService) GetUser(id primitive.ObjectID) (*models.User, error) {
-    var user models.User
-    err := s.collection.FindOne(context.Background(), bson.M{"id": id}).Decode(&user)
-    if err != nil {
-        return nil, err
-    }
-    return &user, nil
+func (s *UserService) GetUser(ctx context.Context, id primitive.ObjectID) (_ *models.User, err error) {
+	ctx, span := startSpan(ctx, "UserService.GetUser")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	user, err := s.cache.GetOrLoad(ctx, id.Hex(), func(ctx context.Context) (models.User, error) {
+		return s.findUser(ctx, id)
+	})
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, fmt.Errorf("user %w", ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-func (s *UserService) UpdateUser(id primitive.ObjectID, updateData bson.M) (*mongo.UpdateResult, error) {
+func (s *UserService) UpdateUser(ctx context.Context, id primitive.ObjectID, updateData bson.M) (_ *mongo.UpdateResult, err error) {
+	ctx, span := startSpan(ctx, "UserService.UpdateUser")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	if len(updateData) == 0 {
+		return nil, fmt.Errorf("%w: no data to update", ErrInvalidInput)
+	}
+	if err := checkSet(updateData); err != nil {
+		return nil, err
+	}
+
+	result, before, err := updateReturningBefore(ctx, s.collection, id, updateData)
+	if err != nil {
+		return nil, err
+	}
+	s.invalidate(ctx, id)
+
+	if before != nil {
+		if _, updated, err := applySet[models.User](before, updateData); err == nil {
+			publishChange(ctx, stream.Users, stream.Updated, id, id.Hex(), updated)
+		}
+	}
 
-    if len(updateData) == 0 {
-        return nil, errors.New("no data to update")
-    }
+	return result, nil
+}
 
-    filter := bson.M{"id": id}
-	update := bson.M{"$set": updateData}
-	result, err := s.collection.UpdateOne(context.Background(), filter, update)
+func (s *UserService) DeleteUser(ctx context.Context, id primitive.ObjectID) (_ *mongo.DeleteResult, err error) {
+	ctx, span := startSpan(ctx, "UserService.DeleteUser")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	var result *mongo.DeleteResult
+	var user models.User
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		var deleted bson.Raw
+		if result, deleted, err = deleteReturning(ctx, s.collection, id); err != nil || deleted == nil {
+			return err
+		}
+		if err := bson.Unmarshal(deleted, &user); err != nil {
+			return fmt.Errorf("failed to decode deleted user: %w", err)
+		}
+		return applyRollups(ctx, rollupDelta{Metric: rollupUsers, At: createdTime(user.CreatedAt.Time, id), Count: -1})
+	})
 	if err != nil {
 		return nil, err
 	}
+	s.invalidate(ctx, id)
+
+	if result.DeletedCount == 0 {
+		return nil, fmt.Errorf("user %w", ErrNotFound)
+	}
+	publishChange(ctx, stream.Users, stream.Deleted, id, id.Hex(), user)
 
 	return result, nil
 }
 
-func (s *UserService) DeleteUser(id primitive.ObjectID) (*mongo.DeleteResult, error) {
-    filter := bson.M{"id": id}
-    result, err :=  s.collection.DeleteOne(context.Background(), filter)
-    
-    if err != nil {
-        return nil, err
-    }
+func (s *UserService) GetUserCount(ctx context.Context) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "UserService.GetUserCount")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
 
-    if result.DeletedCount == 0 {
-        return nil, errors.New("user not found")
-    }
+	return s.countCache.GetOrLoad(ctx, "all", func(ctx context.Context) (int64, error) {
+		return s.collection.CountDocuments(ctx, bson.M{})
+	})
+}
 
-    return result, nil
+func (s *UserService) ListUser(ctx context.Context, page Page) (_ []models.User, err error) {
+	ctx, span := startSpan(ctx, "UserService.ListUser")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	return s.listCache.GetOrLoad(ctx, page.cacheID(), func(ctx context.Context) ([]models.User, error) {
+		var users []models.User
+		cursor, err := s.collection.Find(ctx, bson.M{}, page.findOptions())
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			var user models.User
+			if err := cursor.Decode(&user); err != nil {
+				return nil, err
+			}
+			users = append(users, user)
+		}
+		return users, nil
+	})
 }
 
-func (s *UserService) GetUserCount() (int64, error) {
-    count, err :=  s.collection.CountDocuments(context.Background(), bson.M{})
-    if err != nil {
-        return 0, err
-    }
+// invalidate drops the cached user and every list and statistic derived from users
+func (s *UserService) invalidate(ctx context.Context, id primitive.ObjectID) {
+	s.cache.InvalidateTags(ctx, "user:"+id.Hex(), "users")
+}
 
-    return count, nil
+// findUser loads a user from MongoDB, reporting a missing document as cache.ErrNotFound
+func (s *UserService) findUser(ctx context.Context, id primitive.ObjectID) (models.User, error) {
+	var user models.User
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, cache.ErrNotFound
+	}
+	return user, err
 }
 
-func (s *UserService) ListUser() ([]models.User, error) {
-    var users []models.User
-    cursor, err := s.collection.Find(context.Background(), bson.M{})
-    if err != nil {
-        return nil, err
-    }
-    defer cursor.Close(context.Background())
-    for cursor.Next(context.Background()) {
-        var user models.User
-        if err := cursor.Decode(&user); err != nil {
-            return nil, err
-        }
-        users = append(users, user)
-    }
-    return users, nil
+// GetUserStatistics counts user sign-ups per bucket of q for charts
+func (s *UserService) GetUserStatistics(ctx context.Context, q StatsQuery) (_ []StatsBucket, err error) {
+	ctx, span := startSpan(ctx, "UserService.GetUserStatistics")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.AggregateTimeout)
+	defer cancel()
+
+	return s.statsCache.GetOrLoad(ctx, q.cacheID(), func(ctx context.Context) ([]StatsBucket, error) {
+		counts, err := bucketRows(ctx, rollupUsers, q, StatusFilter{}, func(ctx context.Context) ([]bucketCount, error) {
+			return countByBucket(ctx, s.collection, q)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return q.fill(counts), nil
+	})
 }
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"backend/config"
+	"backend/events"
+	"backend/models"
+	"backend/webhooks"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AllEventTypes subscribes a webhook to every event type
+const AllEventTypes = "*"
+
+// WebhookService manages webhook subscriptions and queues their deliveries,
+// which a webhooks.Dispatcher then sends
+type WebhookService struct {
+	subscriptions *mongo.Collection
+	deliveries    *mongo.Collection
+}
+
+// WebhookSubscriptionUpdate changes the fields of a subscription that are set
+type WebhookSubscriptionUpdate struct {
+	URL         *string   `json:"url"`
+	EventTypes  *[]string `json:"event_types"`
+	Description *string   `json:"description"`
+	Active      *bool     `json:"active"`
+}
+
+func NewWebhookService(subscriptions, deliveries *mongo.Collection) *WebhookService {
+	return &WebhookService{subscriptions: subscriptions, deliveries: deliveries}
+}
+
+// CreateSubscription registers a subscription and returns it with the secret
+// its deliveries are signed with. The secret is not returned again.
+func (s *WebhookService) CreateSubscription(ctx context.Context, subscription models.WebhookSubscription) (_ *models.WebhookSubscription, err error) {
+	ctx, span := startSpan(ctx, "WebhookService.CreateSubscription")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	if err := validateWebhook(subscription.URL, subscription.EventTypes); err != nil {
+		return nil, err
+	}
+	if subscription.Secret, err = webhooks.NewSecret(); err != nil {
+		return nil, fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	subscription.ID = primitive.NewObjectID()
+	subscription.Active = true
+	subscription.CreatedAt = time.Now().UTC()
+
+	if _, err := s.subscriptions.InsertOne(ctx, subscription); err != nil {
+		return nil, fmt.Errorf("failed to create webhook subscription: %w", err)
+	}
+	return &subscription, nil
+}
+
+// ListSubscriptions returns a page of subscriptions, without their secrets
+func (s *WebhookService) ListSubscriptions(ctx context.Context, page Page) (_ []models.WebhookSubscription, err error) {
+	ctx, span := startSpan(ctx, "WebhookService.ListSubscriptions")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	cursor, err := s.subscriptions.Find(ctx, bson.M{}, page.findOptions().SetProjection(bson.M{"secret": 0}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	subscriptions := []models.WebhookSubscription{}
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook subscriptions: %w", err)
+	}
+	return subscriptions, nil
+}
+
+// GetSubscription returns a subscription without its secret
+func (s *WebhookService) GetSubscription(ctx context.Context, id primitive.ObjectID) (_ *models.WebhookSubscription, err error) {
+	ctx, span := startSpan(ctx, "WebhookService.GetSubscription")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	var subscription models.WebhookSubscription
+	opts := options.FindOne().SetProjection(bson.M{"secret": 0})
+	err = s.subscriptions.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&subscription)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("webhook subscription %w", ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch webhook subscription: %w", err)
+	}
+	return &subscription, nil
+}
+
+// UpdateSubscription changes a subscription. The deliveries still queued for a
+// disabled subscription fail when they come due, unless it is enabled again
+// first.
+func (s *WebhookService) UpdateSubscription(ctx context.Context, id primitive.ObjectID, update WebhookSubscriptionUpdate) (_ *models.WebhookSubscription, err error) {
+	ctx, span := startSpan(ctx, "WebhookService.UpdateSubscription")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	set := bson.M{}
+	if update.URL != nil {
+		set["url"] = *update.URL
+	}
+	if update.EventTypes != nil {
+		set["event_types"] = *update.EventTypes
+	}
+	if update.Description != nil {
+		set["description"] = *update.Description
+	}
+	if update.Active != nil {
+		set["active"] = *update.Active
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("%w: no data to update", ErrInvalidInput)
+	}
+
+	current, err := s.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if update.URL != nil {
+		current.URL = *update.URL
+	}
+	if update.EventTypes != nil {
+		current.EventTypes = *update.EventTypes
+	}
+	if err := validateWebhook(current.URL, current.EventTypes); err != nil {
+		return nil, err
+	}
+
+	result, err := s.subscriptions.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update webhook subscription: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return nil, fmt.Errorf("webhook subscription %w", ErrNotFound)
+	}
+	return s.GetSubscription(ctx, id)
+}
+
+// DeleteSubscription removes a subscription. Its delivery log is kept; queued
+// deliveries fail when they come due.
+func (s *WebhookService) DeleteSubscription(ctx context.Context, id primitive.ObjectID) (err error) {
+	ctx, span := startSpan(ctx, "WebhookService.DeleteSubscription")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	result, err := s.subscriptions.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook subscription: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("webhook subscription %w", ErrNotFound)
+	}
+	return nil
+}
+
+// ListDeliveries returns a page of a subscription's deliveries, newest first,
+// optionally only those with status
+func (s *WebhookService) ListDeliveries(ctx context.Context, subscriptionID primitive.ObjectID, status string, page Page) (_ []models.WebhookDelivery, err error) {
+	ctx, span := startSpan(ctx, "WebhookService.ListDeliveries")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+	defer cancel()
+
+	filter := bson.M{"subscription_id": subscriptionID}
+	switch status {
+	case "":
+	case models.WebhookPending, models.WebhookDelivered, models.WebhookFailed:
+		filter["status"] = status
+	default:
+		return nil, fmt.Errorf("%w: unknown delivery status %q", ErrInvalidInput, status)
+	}
+
+	opts := page.findOptions().SetSort(bson.D{{Key: "_id", Value: -1}})
+	cursor, err := s.deliveries.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []models.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// Redeliver queues a delivery to be sent again right away with a fresh set of
+// retries, whatever its status. A delivery being sent keeps its lock, so it is
+// not sent a second time before that attempt is recorded; an attempt that then
+// succeeds counts as the redelivery.
+func (s *WebhookService) Redeliver(ctx context.Context, subscriptionID, deliveryID primitive.ObjectID) (_ *models.WebhookDelivery, err error) {
+	ctx, span := startSpan(ctx, "WebhookService.Redeliver")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"status":          models.WebhookPending,
+		"retries":         0,
+		"next_attempt_at": time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var delivery models.WebhookDelivery
+	filter := bson.M{"_id": deliveryID, "subscription_id": subscriptionID}
+	err = s.deliveries.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("webhook delivery %w", ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to queue webhook redelivery: %w", err)
+	}
+	return &delivery, nil
+}
+
+// Enqueue queues a delivery of event to every active subscription to its type.
+// Enqueuing an event again adds no deliveries.
+func (s *WebhookService) Enqueue(ctx context.Context, event events.Envelope) (_ int, err error) {
+	ctx, span := startSpan(ctx, "WebhookService.Enqueue")
+	defer endSpan(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, config.WriteTimeout)
+	defer cancel()
+
+	filter := bson.M{"active": true, "event_types": bson.M{"$in": bson.A{event.Type, AllEventTypes}}}
+	cursor, err := s.subscriptions.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find webhook subscriptions: %w", err)
+	}
+	var subscriptions []models.WebhookSubscription
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return 0, fmt.Errorf("failed to decode webhook subscriptions: %w", err)
+	}
+	if len(subscriptions) == 0 {
+		return 0, nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode %s event: %w", event.Type, err)
+	}
+	now := time.Now().UTC()
+	deliveries := make([]any, len(subscriptions))
+	for i, subscription := range subscriptions {
+		deliveries[i] = models.WebhookDelivery{
+			ID:             primitive.NewObjectID(),
+			SubscriptionID: subscription.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Payload:        string(payload),
+			Status:         models.WebhookPending,
+			Attempts:       []models.WebhookAttempt{},
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		}
+	}
+
+	result, err := s.deliveries.InsertMany(ctx, deliveries, options.InsertMany().SetOrdered(false))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return 0, fmt.Errorf("failed to queue webhook deliveries: %w", err)
+	}
+	if result == nil {
+		return 0, nil
+	}
+	return len(result.InsertedIDs), nil
+}
+
+// validateWebhook checks that url is an absolute http(s) URL and eventTypes
+// names known event types
+func validateWebhook(rawURL string, eventTypes []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidInput)
+	}
+	if len(eventTypes) == 0 {
+		return fmt.Errorf("%w: event_types must not be empty", ErrInvalidInput)
+	}
+	known := events.Types()
+	for _, t := range eventTypes {
+		if t != AllEventTypes && !slices.Contains(known, t) {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidInput, t)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Package stream pushes changes to users, products and orders to live clients.
+//
+// Every write appends a Change to a Redis stream shared by all instances. Each
+// instance runs a Hub that tails the stream and fans changes out to its
+// subscribers. Redis stream IDs grow monotonically, so a client that reconnects
+// with the ID of the last change it saw is sent what it missed.
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Resources
+const (
+	Users    = "users"
+	Products = "products"
+	Orders   = "orders"
+)
+
+// Actions
+const (
+	Created = "created"
+	Updated = "updated"
+	Deleted = "deleted"
+)
+
+// ErrInvalidID is returned for a resume ID that is not a stream ID
+var ErrInvalidID = errors.New("stream: invalid event ID")
+
+// Change is a create, update or delete of one document
+type Change struct {
+	// ID is the stream ID, sent to clients as the event ID to resume from
+	ID       string `json:"id"`
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+	EntityID string `json:"entity_id"`
+	// Owner is the hex ID of the user the document belongs to, if any
+	Owner string `json:"-"`
+	// Data is the document after the change, or before it for a delete
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// Feed is the Redis stream changes are appended to, capped at about maxLen entries
+type Feed struct {
+	client *redis.Client
+	key    string
+	maxLen int64
+}
+
+// NewFeed creates a Feed on the stream at key
+func NewFeed(client *redis.Client, key string, maxLen int64) *Feed {
+	return &Feed{client: client, key: key, maxLen: maxLen}
+}
+
+// Append adds change to the stream, returning its ID
+func (f *Feed) Append(ctx context.Context, change Change) (string, error) {
+	return f.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: f.key,
+		MaxLen: f.maxLen,
+		Approx: true,
+		Values: map[string]any{
+			"resource":  change.Resource,
+			"action":    change.Action,
+			"entity_id": change.EntityID,
+			"owner":     change.Owner,
+			"data":      string(change.Data),
+			"timestamp": change.Timestamp.UTC().Format(time.RFC3339Nano),
+		},
+	}).Result()
+}
+
+// Since returns up to limit changes appended after the change with ID after
+func (f *Feed) Since(ctx context.Context, after string, limit int64) ([]Change, error) {
+	messages, err := f.client.XRangeN(ctx, f.key, after, "+", limit+1).Result()
+	if err != nil {
+		return nil, err
+	}
+	// The range is inclusive
+	if len(messages) > 0 && messages[0].ID == after {
+		messages = messages[1:]
+	}
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+	}
+	return decodeAll(messages), nil
+}
+
+// Oldest returns the ID of the oldest change still in the stream, or "" when
+// it is empty
+func (f *Feed) Oldest(ctx context.Context) (string, error) {
+	messages, err := f.client.XRangeN(ctx, f.key, "-", "+", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return "", err
+	}
+	return messages[0].ID, nil
+}
+
+// latest returns the ID of the newest change, or "0-0" when the stream is empty
+func (f *Feed) latest(ctx context.Context) (string, error) {
+	messages, err := f.client.XRevRangeN(ctx, f.key, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+	return messages[0].ID, nil
+}
+
+// read waits up to block for changes appended after the change with ID after
+func (f *Feed) read(ctx context.Context, after string, block time.Duration) ([]Change, error) {
+	streams, err := f.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{f.key, after},
+		Count:   100,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for _, s := range streams {
+		changes = append(changes, decodeAll(s.Messages)...)
+	}
+	return changes, nil
+}
+
+func decodeAll(messages []redis.XMessage) []Change {
+	changes := make([]Change, 0, len(messages))
+	for _, m := range messages {
+		changes = append(changes, decode(m))
+	}
+	return changes
+}
+
+func decode(m redis.XMessage) Change {
+	field := func(name string) string {
+		s, _ := m.Values[name].(string)
+		return s
+	}
+
+	change := Change{
+		ID:       m.ID,
+		Resource: field("resource"),
+		Action:   field("action"),
+		EntityID: field("entity_id"),
+		Owner:    field("owner"),
+	}
+	if data := field("data"); data != "" {
+		change.Data = json.RawMessage(data)
+	}
+	change.Timestamp, _ = time.Parse(time.RFC3339Nano, field("timestamp"))
+	return change
+}
+
+// ParseID validates a stream ID of the form "<milliseconds>-<sequence>"
+func ParseID(id string) (ms, seq uint64, err error) {
+	msPart, seqPart, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	if ms, err = strconv.ParseUint(msPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return ms, seq, nil
+}
+
+// compareIDs orders two valid stream IDs like strings.Compare
+func compareIDs(a, b string) int {
+	aMs, aSeq, _ := ParseID(a)
+	bMs, bSeq, _ := ParseID(b)
+	switch {
+	case aMs < bMs || (aMs == bMs && aSeq < bSeq):
+		return -1
+	case aMs == bMs && aSeq == bSeq:
+		return 0
+	default:
+		return 1
+	}
+}
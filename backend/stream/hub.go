@@ -0,0 +1,224 @@
+package stream
+
+import (
+	"backend/utils"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrDropped is returned by Listener.Next once the listener was closed, or
+// dropped by the hub for falling too far behind. In the latter case the client
+// should reconnect with the last ID it saw.
+var ErrDropped = errors.New("stream: listener closed")
+
+var (
+	listenersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backend_stream_listeners",
+		Help: "Clients subscribed to the change stream on this instance.",
+	})
+	dropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_stream_listeners_dropped_total",
+		Help: "Listeners dropped because they did not keep up with the change stream.",
+	})
+)
+
+// Hub tails a Feed and fans its changes out to the listeners of this instance
+type Hub struct {
+	feed        *Feed
+	buffer      int
+	replayLimit int64
+
+	mu        sync.Mutex
+	listeners map[*Listener]struct{}
+}
+
+// NewHub creates a Hub over feed. Each listener buffers up to buffer changes
+// and is sent at most replayLimit missed changes when it resumes.
+func NewHub(feed *Feed, buffer int, replayLimit int64) *Hub {
+	return &Hub{
+		feed:        feed,
+		buffer:      buffer,
+		replayLimit: replayLimit,
+		listeners:   map[*Listener]struct{}{},
+	}
+}
+
+// Start tails the feed until ctx is done, then closes every listener so open
+// streams end and the server can shut down
+func (h *Hub) Start(ctx context.Context) {
+	go func() {
+		defer h.closeAll()
+
+		last := ""
+		for ctx.Err() == nil {
+			if !utils.RedisAvailable() {
+				last = ""
+				wait(ctx, time.Second)
+				continue
+			}
+
+			var err error
+			if last == "" {
+				// Start from the newest change; listeners resume older ones themselves
+				if last, err = h.feed.latest(ctx); err != nil {
+					last = ""
+				}
+			}
+			var changes []Change
+			if err == nil {
+				changes, err = h.feed.read(ctx, last, 5*time.Second)
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					utils.Logger.Warn("failed to read change stream", "error", err)
+					wait(ctx, time.Second)
+				}
+				continue
+			}
+
+			for _, change := range changes {
+				last = change.ID
+				h.broadcast(change)
+			}
+		}
+	}()
+}
+
+// Subscribe registers a listener for the changes appended from now on. When
+// after is set, the changes appended after the change with that ID are sent
+// first, unless some of them are no longer in the stream; the listener then
+// reports a Gap and the client should reload what it shows.
+func (h *Hub) Subscribe(ctx context.Context, after string) (*Listener, error) {
+	if after != "" {
+		if _, _, err := ParseID(after); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &Listener{hub: h, live: make(chan Change, h.buffer), last: after}
+	h.mu.Lock()
+	h.listeners[l] = struct{}{}
+	h.mu.Unlock()
+	listenersGauge.Inc()
+
+	if after == "" {
+		return l, nil
+	}
+
+	// Registered first, so nothing appended while the backlog is read is lost;
+	// Next skips what arrives twice
+	// One more than may be replayed, to tell a full backlog from a longer one
+	backlog, err := h.feed.Since(ctx, after, h.replayLimit+1)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	oldest, err := h.feed.Oldest(ctx)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if (oldest != "" && compareIDs(after, oldest) < 0) || int64(len(backlog)) > h.replayLimit {
+		l.Gap = true
+		l.last = ""
+		return l, nil
+	}
+	l.backlog = backlog
+	return l, nil
+}
+
+// broadcast hands change to every listener, dropping those whose buffer is full
+func (h *Hub) broadcast(change Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for l := range h.listeners {
+		select {
+		case l.live <- change:
+		default:
+			delete(h.listeners, l)
+			close(l.live)
+			listenersGauge.Dec()
+			dropped.Inc()
+		}
+	}
+}
+
+func (h *Hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for l := range h.listeners {
+		delete(h.listeners, l)
+		close(l.live)
+		listenersGauge.Dec()
+	}
+}
+
+func (h *Hub) remove(l *Listener) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.listeners[l]; ok {
+		delete(h.listeners, l)
+		close(l.live)
+		listenersGauge.Dec()
+	}
+}
+
+// Listener receives the changes of a Hub, in stream order
+type Listener struct {
+	// Gap reports that changes after the requested ID were lost
+	Gap bool
+
+	hub     *Hub
+	live    chan Change
+	backlog []Change
+	// last is the ID of the last change returned, to skip duplicates
+	last string
+}
+
+// Next returns the next change, waiting until one arrives or ctx is done
+func (l *Listener) Next(ctx context.Context) (Change, error) {
+	if len(l.backlog) > 0 {
+		change := l.backlog[0]
+		l.backlog = l.backlog[1:]
+		l.last = change.ID
+		return change, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return Change{}, ctx.Err()
+		case change, ok := <-l.live:
+			if !ok {
+				return Change{}, ErrDropped
+			}
+			if l.last != "" && compareIDs(change.ID, l.last) <= 0 {
+				continue
+			}
+			l.last = change.ID
+			return change, nil
+		}
+	}
+}
+
+// Close unsubscribes the listener
+func (l *Listener) Close() {
+	l.hub.remove(l)
+}
+
+// wait sleeps for d or until ctx is done
+func wait(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
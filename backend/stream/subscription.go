@@ -0,0 +1,154 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for a subscriber token that is malformed, forged
+// or expired
+var ErrInvalidToken = errors.New("stream: invalid token")
+
+// Subscription selects the changes a client wants. Empty lists select
+// everything; Filter keeps changes whose document has every field equal to the
+// given value, e.g. {"status": "pending"}.
+type Subscription struct {
+	Resources []string          `json:"resources,omitempty"`
+	Actions   []string          `json:"actions,omitempty"`
+	Filter    map[string]string `json:"filter,omitempty"`
+}
+
+// ParseSubscription reads a subscription from comma-separated query values,
+// with filter written as "field:value,field:value"
+func ParseSubscription(resources, actions, filter string) (Subscription, error) {
+	s := Subscription{Resources: splitList(resources), Actions: splitList(actions)}
+	for _, pair := range splitList(filter) {
+		field, value, ok := strings.Cut(pair, ":")
+		if !ok || field == "" {
+			return Subscription{}, fmt.Errorf("filter %q must be field:value", pair)
+		}
+		if s.Filter == nil {
+			s.Filter = map[string]string{}
+		}
+		s.Filter[field] = value
+	}
+	return s, s.Validate()
+}
+
+// Validate checks the resource and action names
+func (s Subscription) Validate() error {
+	for _, r := range s.Resources {
+		if r != Users && r != Products && r != Orders {
+			return fmt.Errorf("unknown resource %q", r)
+		}
+	}
+	for _, a := range s.Actions {
+		if a != Created && a != Updated && a != Deleted {
+			return fmt.Errorf("unknown action %q", a)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether change is selected by s
+func (s Subscription) Matches(change Change) bool {
+	if len(s.Resources) > 0 && !slices.Contains(s.Resources, change.Resource) {
+		return false
+	}
+	if len(s.Actions) > 0 && !slices.Contains(s.Actions, change.Action) {
+		return false
+	}
+	if len(s.Filter) == 0 {
+		return true
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(change.Data, &doc); err != nil {
+		return false
+	}
+	for field, want := range s.Filter {
+		value, ok := doc[field]
+		if !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	return true
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Principal is who a subscriber is. Admins see every change; a user sees the
+// catalog and their own account and orders.
+type Principal struct {
+	Admin  bool
+	UserID string
+}
+
+// CanSee reports whether p may receive change
+func (p Principal) CanSee(change Change) bool {
+	if p.Admin {
+		return true
+	}
+	switch change.Resource {
+	case Products:
+		return true
+	case Users, Orders:
+		return p.UserID != "" && change.Owner == p.UserID
+	default:
+		return false
+	}
+}
+
+// SignToken issues a token identifying userID to the stream until expires.
+// Tokens have the form "<user id>.<expiry unix seconds>.<signature>".
+func SignToken(secret []byte, userID string, expires time.Time) string {
+	payload := userID + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + sign(secret, payload)
+}
+
+// VerifyToken returns the user ID of a token issued by SignToken
+func VerifyToken(secret []byte, token string, now time.Time) (string, error) {
+	payload, signature, ok := cutLast(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(sign(secret, payload))) {
+		return "", ErrInvalidToken
+	}
+
+	userID, expiry, ok := strings.Cut(payload, ".")
+	if !ok || userID == "" {
+		return "", ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", ErrInvalidToken
+	}
+	return userID, nil
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"backend/config"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	redisUp atomic.Bool
+	mongoUp atomic.Bool
+
+	recoveryHooksMu sync.Mutex
+	recoveryHooks   []func(context.Context)
+)
+
+// RedisAvailable reports whether Redis answered its last health check. Services
+// skip the cache and read straight from MongoDB while it returns false.
+func RedisAvailable() bool {
+	return redisUp.Load()
+}
+
+// MongoAvailable reports whether MongoDB answered its last health check
+func MongoAvailable() bool {
+	return mongoUp.Load()
+}
+
+// Degraded reports whether the API is serving without its cache
+func Degraded() bool {
+	return !RedisAvailable()
+}
+
+// OnRedisRecovered registers fn to run when Redis comes back after an outage.
+// Services use it to drop entries whose invalidation was skipped meanwhile.
+func OnRedisRecovered(fn func(ctx context.Context)) {
+	recoveryHooksMu.Lock()
+	defer recoveryHooksMu.Unlock()
+	recoveryHooks = append(recoveryHooks, fn)
+}
+
+func setRedisUp(up bool) {
+	was := redisUp.Swap(up)
+	dependencyUp.WithLabelValues("redis").Set(boolToFloat(up))
+	degraded.Set(boolToFloat(!up))
+
+	switch {
+	case was && !up:
+		Logger.Warn("Redis unavailable, caching disabled")
+	case !was && up:
+		Logger.Info("Redis available, caching enabled")
+	}
+}
+
+func setMongoUp(up bool) {
+	was := mongoUp.Swap(up)
+	dependencyUp.WithLabelValues("mongodb").Set(boolToFloat(up))
+
+	switch {
+	case was && !up:
+		Logger.Error("MongoDB unavailable")
+	case !was && up:
+		Logger.Info("MongoDB available")
+	}
+}
+
+// StartHealthMonitor pings MongoDB and Redis every config.HealthCheckInterval
+// until ctx is done, keeping RedisAvailable and MongoAvailable current.
+func StartHealthMonitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(config.HealthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkHealth(ctx)
+			}
+		}
+	}()
+}
+
+func checkHealth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, config.HealthCheckInterval)
+	defer cancel()
+
+	setMongoUp(MongoClient.Ping(ctx, nil) == nil)
+
+	wasUp := RedisAvailable()
+	setRedisUp(RedisClient.Ping(ctx).Err() == nil)
+	if !wasUp && RedisAvailable() {
+		recoveryHooksMu.Lock()
+		hooks := append([]func(context.Context){}, recoveryHooks...)
+		recoveryHooksMu.Unlock()
+
+		for _, hook := range hooks {
+			hook(ctx)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
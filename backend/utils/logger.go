@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"backend/config"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logger is the process-wide structured logger. Request handlers should use
+// LoggerFromContext so that lines carry the request ID and trace ID.
+var Logger = slog.New(newLogHandler())
+
+type loggerKey struct{}
+
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	bearerPattern = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=\-]+`)
+	secretPattern = regexp.MustCompile(`(?i)\b(token|password|secret|api[_-]?key)=[^\s&"]+`)
+)
+
+// sensitiveKeys are attribute keys whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"api_key":       true,
+	"cookie":        true,
+}
+
+// InitLogger replaces the standard library logger so that existing log.Printf
+// calls are also written as structured JSON.
+func InitLogger() {
+	slog.SetDefault(Logger)
+	log.SetFlags(0)
+}
+
+func newLogHandler() slog.Handler {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	return slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	})
+}
+
+// redactAttr masks email addresses, credentials and tokens in log attributes
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "[REDACTED]")
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, Redact(err.Error()))
+		}
+		if s, ok := attr.Value.Any().(fmt.Stringer); ok {
+			return slog.String(attr.Key, Redact(s.String()))
+		}
+	}
+	return attr
+}
+
+// Redact masks email addresses, credentials and tokens in s
+func Redact(s string) string {
+	s = emailPattern.ReplaceAllString(s, "[EMAIL]")
+	s = bearerPattern.ReplaceAllString(s, "$1 [REDACTED]")
+	s = secretPattern.ReplaceAllString(s, "$1=[REDACTED]")
+	return s
+}
+
+// Fatal logs msg at error level and exits the process
+func Fatal(msg string, args ...any) {
+	Logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// WithLogger returns a copy of ctx carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the request-scoped logger stored in ctx, falling back
+// to the global Logger. The current trace ID is added when a span is active.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		logger = Logger
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		logger = logger.With("trace_id", spanContext.TraceID().String())
+	}
+	return logger
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// dependencyUp reports 1 when a backing service answered its last health check
+	dependencyUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "backend_dependency_up",
+		Help: "Whether a backing service answered its last health check (1) or not (0).",
+	}, []string{"dependency"})
+
+	// degraded reports 1 while the API is serving without its cache
+	degraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backend_degraded",
+		Help: "Whether the API is running in degraded mode because Redis is unavailable.",
+	})
+)
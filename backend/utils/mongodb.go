@@ -3,33 +3,64 @@ package utils
 import (
 	"backend/config"
 	"context"
-	"log"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 // Global MongoDB client and database variables
 var MongoClient *mongo.Client
 var MongoDB *mongo.Database
-var ctx = context.Background()
 
-// InitMongoDB initializes the MongoDB client and database
+// InitMongoDB initializes the MongoDB client and database, retrying with backoff
+// until config.StartupRetryTimeout passes
 func InitMongoDB() {
-	clientOptions := options.Client().ApplyURI(config.MongoURI)
+	clientOptions := options.Client().ApplyURI(config.MongoURI).SetMonitor(otelmongo.NewMonitor())
 
-	client, err := mongo.Connect(ctx, clientOptions)
+	client, err := mongo.Connect(context.Background(), clientOptions)
 	if err != nil {
-		log.Fatalf("Error connecting to MongoDB: %v", err)
+		Fatal("Error connecting to MongoDB", "error", err)
 	}
 
 	// Check the connection
-	err = client.Ping(ctx, nil)
+	err = retry("mongodb", func(ctx context.Context) error {
+		return client.Ping(ctx, nil)
+	})
 	if err != nil {
-		log.Fatalf("Error pinging MongoDB: %v", err)
+		Fatal("Error pinging MongoDB", "error", err)
 	}
 
-	log.Println("Connected to MongoDB!")
+	setMongoUp(true)
+	Logger.Info("Connected to MongoDB!")
 	MongoClient = client
 	MongoDB = client.Database("test") // Replace with your database name
+
+	detectTransactions(client)
+}
+
+// MongoTransactions reports whether the deployment supports multi-document
+// transactions, which need a replica set or a sharded cluster
+func MongoTransactions() bool {
+	return mongoTransactions
+}
+
+var mongoTransactions bool
+
+func detectTransactions(client *mongo.Client) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(context.Background(), bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		Logger.Warn("Could not detect MongoDB topology", "error", err)
+		return
+	}
+
+	mongoTransactions = hello.SetName != "" || hello.Msg == "isdbgrid"
+	if !mongoTransactions {
+		Logger.Warn("MongoDB is a standalone server, writes and their events are not committed atomically; run a replica set in production")
+	}
 }
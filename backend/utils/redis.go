@@ -3,7 +3,6 @@ package utils
 import (
 	"backend/config"
 	"context"
-	"log"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -11,18 +10,26 @@ import (
 // Global Redis client
 var RedisClient *redis.Client
 
-// InitRedis initializes the Redis client
+// InitRedis initializes the Redis client. Redis is optional: when it cannot be
+// reached within config.StartupRetryTimeout the API starts in degraded mode and
+// the health monitor enables caching once Redis answers.
 func InitRedis() {
 	RedisClient = redis.NewClient(&redis.Options{
 		Addr:     config.RedisAddr,
 		Password: config.RedisPass,
 		DB:       config.RedisDB,
 	})
+	RedisClient.AddHook(newRedisTracingHook())
 
-	_, err := RedisClient.Ping(context.Background()).Result()
+	err := retry("redis", func(ctx context.Context) error {
+		return RedisClient.Ping(ctx).Err()
+	})
 	if err != nil {
-		log.Fatalf("Error connecting to Redis: %v", err)
+		Logger.Warn("Error connecting to Redis, starting in degraded mode", "error", err)
+		setRedisUp(false)
+		return
 	}
 
-	log.Println("Connected to Redis!")
-}
\ No newline at end of file
+	setRedisUp(true)
+	Logger.Info("Connected to Redis!")
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "context"
+
+// PurgeKeys deletes every key matching pattern using SCAN, so Redis is never
+// blocked the way KEYS would block it. It returns the number of keys deleted.
+func PurgeKeys(ctx context.Context, pattern string) (int64, error) {
+	var deleted int64
+	iter := RedisClient.Scan(ctx, 0, pattern, 500).Iterator()
+
+	batch := make([]string, 0, 500)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		n, err := RedisClient.Del(ctx, batch...).Result()
+		deleted += n
+		batch = batch[:0]
+		return err
+	}
+
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return deleted, err
+	}
+	return deleted, flush()
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"backend/config"
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retry calls fn until it succeeds or config.StartupRetryTimeout has passed, sleeping
+// between attempts with exponential backoff and full jitter. It returns the last error.
+func retry(name string, fn func(ctx context.Context) error) error {
+	deadline := time.Now().Add(config.StartupRetryTimeout)
+	interval := config.RetryInitialInterval
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), config.RetryMaxInterval)
+		err := fn(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		wait := backoff(interval)
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		Logger.Warn("Dependency not ready, retrying", "dependency", name, "attempt", attempt, "retry_in", wait.String(), "error", err)
+		time.Sleep(wait)
+
+		interval *= 2
+		if interval > config.RetryMaxInterval {
+			interval = config.RetryMaxInterval
+		}
+	}
+}
+
+// backoff returns a random duration in [0, interval) so that restarting replicas
+// do not retry in lockstep
+func backoff(interval time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(interval)))
+}
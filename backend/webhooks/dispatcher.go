@@ -0,0 +1,240 @@
+package webhooks
+
+import (
+	"backend/models"
+	"backend/utils"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxResponseLog is how much of a response body an attempt records
+	maxResponseLog = 1024
+	// maxAttemptsLog is how many attempts a delivery keeps in its log
+	maxAttemptsLog = 50
+)
+
+var attempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backend_webhook_attempts_total",
+	Help: "Webhook delivery attempts by result (delivered, retry or failed).",
+}, []string{"result"})
+
+// Options configures a Dispatcher
+type Options struct {
+	// Workers is how many deliveries are sent at once
+	Workers int
+	// PollInterval is how often due deliveries are looked for when there were none
+	PollInterval time.Duration
+	// Timeout bounds each POST
+	Timeout time.Duration
+	// MaxAttempts is how many times a delivery is tried before it is marked failed
+	MaxAttempts int
+	// InitialBackoff and MaxBackoff bound the wait between attempts
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// LockTTL is how long a claimed delivery is hidden from other instances
+	LockTTL time.Duration
+}
+
+// Dispatcher sends due deliveries to their subscriptions. Deliveries are
+// claimed with a lock in MongoDB, so any number of instances can dispatch
+// without sending one twice, and one whose instance died is sent again once the
+// lock expired.
+type Dispatcher struct {
+	subscriptions *mongo.Collection
+	deliveries    *mongo.Collection
+	client        *http.Client
+	opts          Options
+}
+
+// NewDispatcher creates a Dispatcher for the deliveries of subscriptions
+func NewDispatcher(subscriptions, deliveries *mongo.Collection, opts Options) *Dispatcher {
+	return &Dispatcher{
+		subscriptions: subscriptions,
+		deliveries:    deliveries,
+		client: &http.Client{
+			Timeout: opts.Timeout,
+			// A redirect could point the signed body anywhere
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		opts: opts,
+	}
+}
+
+// Start ensures the delivery indexes and dispatches until ctx is done
+func (d *Dispatcher) Start(ctx context.Context) {
+	_, err := d.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// Enqueuing an event twice, e.g. when it is consumed again, adds no delivery
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "event_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		utils.Logger.Warn("failed to create webhook delivery indexes", "error", err)
+	}
+
+	for i := 0; i < d.opts.Workers; i++ {
+		go d.work(ctx)
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		delivery, ok, err := d.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			utils.Logger.Warn("failed to claim webhook delivery", "error", err)
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+			case <-time.After(d.opts.PollInterval):
+			}
+			continue
+		}
+		d.deliver(ctx, delivery)
+	}
+}
+
+// claim locks the most overdue pending delivery
+func (d *Dispatcher) claim(ctx context.Context) (models.WebhookDelivery, bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"status":          models.WebhookPending,
+		"next_attempt_at": bson.M{"$lte": now},
+		"locked_until":    bson.M{"$lte": now},
+	}
+	update := bson.M{"$set": bson.M{"locked_until": now.Add(d.opts.LockTTL)}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var delivery models.WebhookDelivery
+	err := d.deliveries.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return delivery, false, nil
+	}
+	return delivery, err == nil, err
+}
+
+// deliver sends a claimed delivery and records the attempt
+func (d *Dispatcher) deliver(ctx context.Context, delivery models.WebhookDelivery) {
+	logger := utils.Logger.With("delivery_id", delivery.ID.Hex(), "subscription_id", delivery.SubscriptionID.Hex(),
+		"event_type", delivery.EventType)
+
+	var subscription models.WebhookSubscription
+	err := d.subscriptions.FindOne(ctx, bson.M{"_id": delivery.SubscriptionID}).Decode(&subscription)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		d.record(ctx, delivery, models.WebhookAttempt{At: time.Now(), Error: "subscription deleted"}, true)
+		return
+	case err != nil:
+		// The lock expires and the delivery is claimed again
+		logger.Warn("failed to load webhook subscription", "error", err)
+		return
+	case !subscription.Active:
+		d.record(ctx, delivery, models.WebhookAttempt{At: time.Now(), Error: "subscription disabled"}, true)
+		return
+	}
+
+	attempt := d.post(ctx, subscription, delivery)
+	if ctx.Err() != nil {
+		// Shutting down; the delivery is sent again once its lock expires
+		return
+	}
+	if attempt.Error != "" {
+		logger.Warn("webhook delivery failed", "url", subscription.URL, "retries", delivery.Retries+1, "error", attempt.Error)
+	}
+	d.record(ctx, delivery, attempt, false)
+}
+
+// post sends the signed delivery to the subscription's URL
+func (d *Dispatcher) post(ctx context.Context, subscription models.WebhookSubscription, delivery models.WebhookDelivery) models.WebhookAttempt {
+	start := time.Now()
+	attempt := models.WebhookAttempt{At: start}
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDeliveryID, delivery.ID.Hex())
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(subscription.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		attempt.DurationMs = time.Since(start).Milliseconds()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseLog))
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = string(response)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		attempt.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	return attempt
+}
+
+// record logs attempt on the delivery and marks it delivered, schedules the
+// next attempt or, after MaxAttempts or when final, marks it failed
+func (d *Dispatcher) record(ctx context.Context, delivery models.WebhookDelivery, attempt models.WebhookAttempt, final bool) {
+	set, result := d.outcome(delivery, attempt, final, time.Now())
+	update := bson.M{
+		"$set":  set,
+		"$push": bson.M{"attempts": bson.M{"$each": bson.A{attempt}, "$slice": -maxAttemptsLog}},
+	}
+	if _, err := d.deliveries.UpdateOne(ctx, bson.M{"_id": delivery.ID}, update); err != nil {
+		utils.Logger.Warn("failed to record webhook attempt", "delivery_id", delivery.ID.Hex(), "error", err)
+	}
+	attempts.WithLabelValues(result).Inc()
+}
+
+// outcome returns the fields to set on a delivery after attempt, made at now,
+// and the result it counts as: delivered, retry or failed
+func (d *Dispatcher) outcome(delivery models.WebhookDelivery, attempt models.WebhookAttempt, final bool, now time.Time) (bson.M, string) {
+	set := bson.M{"locked_until": time.Time{}}
+	if attempt.Error == "" {
+		set["status"] = models.WebhookDelivered
+		set["delivered_at"] = now
+		return set, "delivered"
+	}
+
+	retries := delivery.Retries + 1
+	set["retries"] = retries
+	if final || retries >= d.opts.MaxAttempts {
+		set["status"] = models.WebhookFailed
+		return set, "failed"
+	}
+	set["next_attempt_at"] = now.Add(d.backoff(retries))
+	return set, "retry"
+}
+
+// backoff returns the wait before attempt retries+1, doubling from
+// InitialBackoff up to MaxBackoff, with jitter
+func (d *Dispatcher) backoff(retries int) time.Duration {
+	wait := d.opts.InitialBackoff << min(retries-1, 16)
+	if wait <= 0 || wait > d.opts.MaxBackoff {
+		wait = d.opts.MaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
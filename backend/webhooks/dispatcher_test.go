@@ -0,0 +1,167 @@
+package webhooks
+
+import (
+	"backend/models"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestDispatcher() *Dispatcher {
+	return NewDispatcher(nil, nil, Options{
+		Timeout:        time.Second,
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+	})
+}
+
+func TestDispatcherBackoff(t *testing.T) {
+	d := newTestDispatcher()
+
+	tests := []struct {
+		retries int
+		// Each wait is between half the doubled wait and all of it
+		min, max time.Duration
+	}{
+		{retries: 1, min: 500 * time.Millisecond, max: time.Second},
+		{retries: 2, min: time.Second, max: 2 * time.Second},
+		{retries: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{retries: 4, min: 4 * time.Second, max: 8 * time.Second},
+		{retries: 5, min: 5 * time.Second, max: 10 * time.Second},
+		// The shift is capped, so many retries do not overflow into short waits
+		{retries: 100, min: 5 * time.Second, max: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.retries), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if wait := d.backoff(tt.retries); wait < tt.min || wait > tt.max {
+					t.Fatalf("backoff(%d) = %v, want between %v and %v", tt.retries, wait, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatcherOutcome(t *testing.T) {
+	d := newTestDispatcher()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		retries    int
+		err        string
+		final      bool
+		wantResult string
+		wantStatus any
+		// wantRetries is nil when the retries are left alone
+		wantRetries any
+	}{
+		{name: "delivered", retries: 1, wantResult: "delivered", wantStatus: models.WebhookDelivered},
+		{name: "failed attempt retried", retries: 0, err: "unexpected status 500", wantResult: "retry", wantStatus: nil, wantRetries: 1},
+		{name: "last attempt failed", retries: 2, err: "unexpected status 500", wantResult: "failed", wantStatus: models.WebhookFailed, wantRetries: 3},
+		{name: "final failure", retries: 0, err: "subscription deleted", final: true, wantResult: "failed", wantStatus: models.WebhookFailed, wantRetries: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := models.WebhookDelivery{ID: primitive.NewObjectID(), Retries: tt.retries}
+			set, result := d.outcome(delivery, models.WebhookAttempt{At: now, Error: tt.err}, tt.final, now)
+
+			if result != tt.wantResult {
+				t.Errorf("result = %s, want %s", result, tt.wantResult)
+			}
+			if set["status"] != tt.wantStatus {
+				t.Errorf("status = %v, want %v", set["status"], tt.wantStatus)
+			}
+			if set["retries"] != tt.wantRetries {
+				t.Errorf("retries = %v, want %v", set["retries"], tt.wantRetries)
+			}
+			if locked, ok := set["locked_until"].(time.Time); !ok || !locked.IsZero() {
+				t.Errorf("locked_until = %v, want the lock released", set["locked_until"])
+			}
+
+			next, retried := set["next_attempt_at"].(time.Time)
+			if retried != (tt.wantResult == "retry") {
+				t.Errorf("next_attempt_at = %v, want it set only when retried", set["next_attempt_at"])
+			}
+			if retried && (next.Before(now.Add(500*time.Millisecond)) || next.After(now.Add(time.Second))) {
+				t.Errorf("next_attempt_at = %v, want within the first backoff", next)
+			}
+			if _, ok := set["delivered_at"]; ok != (tt.wantResult == "delivered") {
+				t.Errorf("delivered_at = %v, want it set only when delivered", set["delivered_at"])
+			}
+		})
+	}
+}
+
+func TestDispatcherPost(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		response   string
+		wantError  string
+		wantLogged int
+	}{
+		{name: "delivered", status: http.StatusNoContent, wantError: ""},
+		{name: "error status", status: http.StatusInternalServerError, response: "boom", wantError: "unexpected status 500", wantLogged: 4},
+		{name: "redirect not followed", status: http.StatusFound, wantError: "unexpected status 302"},
+		{name: "response truncated", status: http.StatusOK, response: strings.Repeat("x", 2*maxResponseLog), wantLogged: maxResponseLog},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received *http.Request
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+				body, _ = io.ReadAll(r.Body)
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.response)
+			}))
+			defer server.Close()
+
+			subscription := models.WebhookSubscription{URL: server.URL, Secret: "secret"}
+			delivery := models.WebhookDelivery{ID: primitive.NewObjectID(), EventType: "OrderCreated", Payload: `{"id":"1"}`}
+			attempt := newTestDispatcher().post(context.Background(), subscription, delivery)
+
+			if attempt.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", attempt.Error, tt.wantError)
+			}
+			if attempt.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", attempt.StatusCode, tt.status)
+			}
+			if len(attempt.Response) != tt.wantLogged {
+				t.Errorf("logged %d bytes of the response, want %d", len(attempt.Response), tt.wantLogged)
+			}
+
+			if received.URL.Path != "/" {
+				t.Errorf("request sent to %s, want the subscription URL", received.URL.Path)
+			}
+			if got := received.Header.Get(HeaderDeliveryID); got != delivery.ID.Hex() {
+				t.Errorf("%s = %s, want %s", HeaderDeliveryID, got, delivery.ID.Hex())
+			}
+			if got := received.Header.Get(HeaderEvent); got != "OrderCreated" {
+				t.Errorf("%s = %s, want OrderCreated", HeaderEvent, got)
+			}
+			timestamp, err := strconv.ParseInt(received.Header.Get(HeaderTimestamp), 10, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", HeaderTimestamp, err)
+			}
+			if !Verify("secret", timestamp, body, received.Header.Get(HeaderSignature)) {
+				t.Errorf("%s does not verify", HeaderSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package webhooks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	// The HMAC-SHA256 of "<timestamp>.<body>", as receivers compute it, e.g.
+	// printf '1700000000.{"id":"1"}' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", 1700000000, []byte(`{"id":"1"}`))
+	want := "sha256=086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"
+	if got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"OrderCreated"}`)
+	signature := Sign("secret", 1700000000, body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{name: "valid", secret: "secret", timestamp: 1700000000, body: body, signature: signature, want: true},
+		{name: "other secret", secret: "other", timestamp: 1700000000, body: body, signature: signature, want: false},
+		{name: "other timestamp", secret: "secret", timestamp: 1700000001, body: body, signature: signature, want: false},
+		{name: "tampered body", secret: "secret", timestamp: 1700000000, body: []byte(`{"type":"OrderDeleted"}`), signature: signature, want: false},
+		{name: "digest without prefix", secret: "secret", timestamp: 1700000000, body: body, signature: strings.TrimPrefix(signature, "sha256="), want: false},
+		{name: "empty signature", secret: "secret", timestamp: 1700000000, body: body, signature: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verify(tt.secret, tt.timestamp, tt.body, tt.signature); got != tt.want {
+				t.Errorf("Verify = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a, "whsec_") || len(a) != len("whsec_")+64 {
+		t.Errorf("NewSecret = %s, want whsec_ and 32 bytes of hex", a)
+	}
+	if a == b {
+		t.Error("NewSecret returned the same secret twice")
+	}
+}
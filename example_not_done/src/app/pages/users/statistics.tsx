@@ -6,7 +6,7 @@ import { Bar } from 'react-chartjs-2';
 Chart.register(ArcElement, CategoryScale, LinearScale, BarElement, Title, Tooltip, Legend);
 
 interface UserStatistics {
-  _id: string;
+  period: string;
   count: number;
 }
 
@@ -27,7 +27,7 @@ export default function UserStatistics() {
   };
 
   const chartData = {
-    labels: stats.map(stat => stat._id),
+    labels: stats.map(stat => stat.period),
     datasets: [{
       label: 'User Count',
       data: stats.map(stat => stat.count),